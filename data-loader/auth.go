@@ -17,19 +17,351 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"github.com/racker/go-restclient"
 	"go.uber.org/zap"
+	"golang.org/x/oauth2/clientcredentials"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
-// OptionalIdentityAuthenticator creates an IdentityAuthenticator instance only if the configured
-// admin URL is remote.
-func OptionalIdentityAuthenticator(log *zap.SugaredLogger, config *Config) (restclient.Interceptor, error) {
-	if !strings.Contains(config.AdminUrl, "localhost") {
-		clientAuth, err := restclient.IdentityV2Authenticator(
+const (
+	// AuthModeAuto retains the original behavior of using Identity v2 unless the admin URL is
+	// a localhost one
+	AuthModeAuto       = "auto"
+	AuthModeNone       = "none"
+	AuthModeIdentityV2 = "identity-v2"
+	AuthModeKeystoneV3 = "keystone-v3"
+	AuthModeBearer     = "bearer"
+	AuthModeMtls       = "mtls"
+	AuthModeOAuth2     = "oauth2"
+)
+
+const keystoneAuthTimeout = 60 * time.Second
+
+// keystoneTokenExpiryMargin is how long before its expiration a token is replaced so that
+// requests in flight don't present an expired token
+const keystoneTokenExpiryMargin = time.Minute
+
+// AdminAuthenticator conveys how requests to the Admin API are authenticated
+type AdminAuthenticator struct {
+	// Interceptor, if non-nil, decorates each request such as with a token header
+	Interceptor restclient.Interceptor
+	// Client, if non-nil, is used to send each request such as with a client certificate
+	Client *http.Client
+}
+
+// NewAdminAuthenticator creates the AdminAuthenticator for the configured auth mode after
+// validating the settings of that mode. It returns nil when requests are not authenticated.
+func NewAdminAuthenticator(log *zap.SugaredLogger, config *Config) (*AdminAuthenticator, error) {
+	mode := config.AuthMode
+	if mode == "" || mode == AuthModeAuto {
+		if strings.Contains(config.AdminUrl, "localhost") {
+			mode = AuthModeNone
+		} else {
+			mode = AuthModeIdentityV2
+		}
+		log.Debugw("resolved auto auth mode", "mode", mode, "adminUrl", config.AdminUrl)
+	}
+
+	switch mode {
+	case AuthModeNone:
+		return nil, nil
+
+	case AuthModeIdentityV2:
+		interceptor, err := restclient.IdentityV2Authenticator(
 			config.IdentityUrl, config.IdentityUsername, config.IdentityPassword, config.IdentityApikey)
-		return clientAuth, err
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity-v2 auth config: %w", err)
+		}
+		return &AdminAuthenticator{Interceptor: interceptor}, nil
+
+	case AuthModeKeystoneV3:
+		interceptor, err := keystoneV3Authenticator(config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keystone-v3 auth config: %w", err)
+		}
+		return &AdminAuthenticator{Interceptor: interceptor}, nil
+
+	case AuthModeBearer:
+		interceptor, err := bearerAuthenticator(config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bearer auth config: %w", err)
+		}
+		return &AdminAuthenticator{Interceptor: interceptor}, nil
+
+	case AuthModeMtls:
+		client, err := mtlsClient(config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mtls auth config: %w", err)
+		}
+		return &AdminAuthenticator{Client: client}, nil
+
+	case AuthModeOAuth2:
+		interceptor, err := oauth2Authenticator(config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid oauth2 auth config: %w", err)
+		}
+		return &AdminAuthenticator{Interceptor: interceptor}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown auth mode: %s", mode)
+	}
+}
+
+// clientInterceptor sends the request with the given client rather than the default client,
+// so it must be the last interceptor
+func clientInterceptor(client *http.Client) restclient.Interceptor {
+	return func(req *http.Request, next restclient.NextCallback) (*http.Response, error) {
+		return client.Do(req)
+	}
+}
+
+func bearerAuthenticator(config *Config) (restclient.Interceptor, error) {
+	if config.BearerToken != "" && config.BearerTokenFile != "" {
+		return nil, errors.New("only one of bearer-token or bearer-token-file can be given")
+	}
+
+	if config.BearerToken != "" {
+		token := config.BearerToken
+		return func(req *http.Request, next restclient.NextCallback) (*http.Response, error) {
+			req.Header.Set("Authorization", "Bearer "+token)
+			return next(req)
+		}, nil
+	}
+
+	if config.BearerTokenFile != "" {
+		path := config.BearerTokenFile
+		// fail fast on a missing file, but re-read per request since mounted tokens are rotated
+		if _, err := readTokenFile(path); err != nil {
+			return nil, err
+		}
+		return func(req *http.Request, next restclient.NextCallback) (*http.Response, error) {
+			token, err := readTokenFile(path)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			return next(req)
+		}, nil
+	}
+
+	return nil, errors.New("bearer-token or bearer-token-file is required")
+}
+
+func readTokenFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read bearer token file: %w", err)
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("bearer token file %s is empty", path)
+	}
+	return token, nil
+}
+
+func mtlsClient(config *Config) (*http.Client, error) {
+	if config.ClientCertFile == "" || config.ClientKeyFile == "" {
+		return nil, errors.New("client-cert-file and client-key-file are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if config.ServerCaFile != "" {
+		caPem, err := ioutil.ReadFile(config.ServerCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read server CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found in server CA file %s", config.ServerCaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	// every Admin API request is sent by this client, so it needs the same timeout
+	return &http.Client{Transport: transport, Timeout: getterTimeout}, nil
+}
+
+func oauth2Authenticator(config *Config) (restclient.Interceptor, error) {
+	if config.Oauth2TokenUrl == "" {
+		return nil, errors.New("oauth2-token-url is required")
+	}
+	if config.Oauth2ClientId == "" || config.Oauth2ClientSecret == "" {
+		return nil, errors.New("oauth2-client-id and oauth2-client-secret are required")
+	}
+
+	credentialsConfig := &clientcredentials.Config{
+		ClientID:     config.Oauth2ClientId,
+		ClientSecret: config.Oauth2ClientSecret,
+		TokenURL:     config.Oauth2TokenUrl,
+		Scopes:       config.Oauth2Scopes,
+	}
+	// the token source caches the token until it expires
+	tokenSource := credentialsConfig.TokenSource(context.Background())
+
+	return func(req *http.Request, next restclient.NextCallback) (*http.Response, error) {
+		token, err := tokenSource.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to obtain oauth2 token: %w", err)
+		}
+		token.SetAuthHeader(req)
+		return next(req)
+	}, nil
+}
+
+type keystoneV3AuthenticatorImpl struct {
+	username      string
+	password      string
+	userDomain    string
+	project       string
+	projectDomain string
+	identityUrl   string
+
+	mutex           sync.Mutex
+	token           string
+	tokenExpiration time.Time
+}
+
+type keystoneAuthReq struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string `json:"methods"`
+			Password struct {
+				User struct {
+					Name     string `json:"name"`
+					Password string `json:"password"`
+					Domain   struct {
+						Name string `json:"name"`
+					} `json:"domain"`
+				} `json:"user"`
+			} `json:"password"`
+		} `json:"identity"`
+		Scope *keystoneScope `json:"scope,omitempty"`
+	} `json:"auth"`
+}
+
+type keystoneScope struct {
+	Project struct {
+		Name   string `json:"name"`
+		Domain struct {
+			Name string `json:"name"`
+		} `json:"domain"`
+	} `json:"project"`
+}
+
+// keystoneAuthResp only picks out the fields needed since the token itself is conveyed in
+// the X-Subject-Token response header
+type keystoneAuthResp struct {
+	Token struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	} `json:"token"`
+}
+
+func keystoneV3Authenticator(config *Config) (restclient.Interceptor, error) {
+	if config.IdentityUsername == "" || config.IdentityPassword == "" {
+		return nil, errors.New("identity-username and identity-password are required")
+	}
+
+	_, err := url.Parse(config.IdentityUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Identity URL: %w", err)
+	}
+	// the trailing slash retains any path prefix of the endpoint when resolving the token path
+	identityUrl := strings.TrimSuffix(config.IdentityUrl, "/") + "/"
+
+	impl := &keystoneV3AuthenticatorImpl{
+		username:      config.IdentityUsername,
+		password:      config.IdentityPassword,
+		userDomain:    config.IdentityUserDomain,
+		project:       config.IdentityProject,
+		projectDomain: config.IdentityProjectDomain,
+		identityUrl:   identityUrl,
+	}
+
+	return impl.intercept, nil
+}
+
+func (a *keystoneV3AuthenticatorImpl) intercept(req *http.Request, next restclient.NextCallback) (*http.Response, error) {
+	token, err := a.currentToken()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Auth-Token", token)
+	return next(req)
+}
+
+func (a *keystoneV3AuthenticatorImpl) currentToken() (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if time.Now().Add(keystoneTokenExpiryMargin).After(a.tokenExpiration) {
+		if err := a.authenticate(); err != nil {
+			return "", err
+		}
+	}
+	return a.token, nil
+}
+
+func (a *keystoneV3AuthenticatorImpl) authenticate() error {
+	var authReq keystoneAuthReq
+	authReq.Auth.Identity.Methods = []string{"password"}
+	authReq.Auth.Identity.Password.User.Name = a.username
+	authReq.Auth.Identity.Password.User.Password = a.password
+	authReq.Auth.Identity.Password.User.Domain.Name = a.userDomain
+	if a.project != "" {
+		scope := &keystoneScope{}
+		scope.Project.Name = a.project
+		scope.Project.Domain.Name = a.projectDomain
+		authReq.Auth.Scope = scope
+	}
+
+	var authResp keystoneAuthResp
+	var token string
+	restClient := restclient.NewClient()
+	err := restClient.SetBaseUrl(a.identityUrl)
+	if err != nil {
+		return fmt.Errorf("invalid Identity URL: %w", err)
+	}
+	restClient.Timeout = keystoneAuthTimeout
+	// the token is in a response header, so intercept the response to grab it
+	restClient.AddInterceptor(func(req *http.Request, next restclient.NextCallback) (*http.Response, error) {
+		resp, err := next(req)
+		if resp != nil {
+			token = resp.Header.Get("X-Subject-Token")
+		}
+		return resp, err
+	})
+
+	err = restClient.Exchange("POST", "v3/auth/tokens", nil,
+		restclient.NewJsonEntity(&authReq), restclient.NewJsonEntity(&authResp))
+	if err != nil {
+		return fmt.Errorf("failed to issue token request: %w", err)
+	}
+	if token == "" {
+		return errors.New("token response is missing X-Subject-Token header")
 	}
 
-	return nil, nil
+	a.token = token
+	a.tokenExpiration = authResp.Token.ExpiresAt
+	return nil
 }
@@ -0,0 +1,267 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// interceptHeader runs the request through the authenticator's interceptor and returns the
+// given header as it would be sent
+func interceptHeader(t *testing.T, authenticator *AdminAuthenticator, header string) string {
+	req := httptest.NewRequest("GET", "http://admin.example.com/api/admin/zones", nil)
+	var sent string
+	_, err := authenticator.Interceptor(req, func(req *http.Request) (*http.Response, error) {
+		sent = req.Header.Get(header)
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	require.NoError(t, err)
+	return sent
+}
+
+func TestNewAdminAuthenticator_Auto(t *testing.T) {
+	authenticator, err := NewAdminAuthenticator(zap.NewNop().Sugar(), &Config{
+		AuthMode: AuthModeAuto,
+		AdminUrl: "http://localhost:8888",
+	})
+	require.NoError(t, err)
+	assert.Nil(t, authenticator)
+
+	authenticator, err = NewAdminAuthenticator(zap.NewNop().Sugar(), &Config{
+		AuthMode:         AuthModeAuto,
+		AdminUrl:         "https://admin.example.com",
+		IdentityUrl:      "https://identity.example.com",
+		IdentityUsername: "user",
+		IdentityApikey:   "key",
+	})
+	require.NoError(t, err)
+	require.NotNil(t, authenticator)
+	assert.NotNil(t, authenticator.Interceptor)
+}
+
+func TestNewAdminAuthenticator_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		err    string
+	}{
+		{
+			name:   "unknown mode",
+			config: Config{AuthMode: "kerberos"},
+			err:    "unknown auth mode: kerberos",
+		},
+		{
+			name:   "bearer without token",
+			config: Config{AuthMode: AuthModeBearer},
+			err:    "invalid bearer auth config: bearer-token or bearer-token-file is required",
+		},
+		{
+			name:   "bearer with both",
+			config: Config{AuthMode: AuthModeBearer, BearerToken: "t", BearerTokenFile: "/tmp/t"},
+			err:    "invalid bearer auth config: only one of bearer-token or bearer-token-file can be given",
+		},
+		{
+			name:   "keystone without password",
+			config: Config{AuthMode: AuthModeKeystoneV3, IdentityUsername: "user"},
+			err:    "invalid keystone-v3 auth config: identity-username and identity-password are required",
+		},
+		{
+			name:   "mtls without key",
+			config: Config{AuthMode: AuthModeMtls, ClientCertFile: "cert.pem"},
+			err:    "invalid mtls auth config: client-cert-file and client-key-file are required",
+		},
+		{
+			name:   "oauth2 without secret",
+			config: Config{AuthMode: AuthModeOAuth2, Oauth2TokenUrl: "https://token", Oauth2ClientId: "id"},
+			err:    "invalid oauth2 auth config: oauth2-client-id and oauth2-client-secret are required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAdminAuthenticator(zap.NewNop().Sugar(), &tt.config)
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestNewAdminAuthenticator_Bearer(t *testing.T) {
+	authenticator, err := NewAdminAuthenticator(zap.NewNop().Sugar(), &Config{
+		AuthMode:    AuthModeBearer,
+		BearerToken: "static-token",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "Bearer static-token", interceptHeader(t, authenticator, "Authorization"))
+}
+
+func TestNewAdminAuthenticator_BearerFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-auth")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("first\n"), 0600))
+
+	authenticator, err := NewAdminAuthenticator(zap.NewNop().Sugar(), &Config{
+		AuthMode:        AuthModeBearer,
+		BearerTokenFile: tokenFile,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer first", interceptHeader(t, authenticator, "Authorization"))
+
+	// rotated tokens are picked up
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("second"), 0600))
+	assert.Equal(t, "Bearer second", interceptHeader(t, authenticator, "Authorization"))
+}
+
+func TestNewAdminAuthenticator_KeystoneV3(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/identity/v3/auth/tokens", r.URL.Path)
+
+		var authReq keystoneAuthReq
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&authReq))
+		assert.Equal(t, []string{"password"}, authReq.Auth.Identity.Methods)
+		assert.Equal(t, "user", authReq.Auth.Identity.Password.User.Name)
+		assert.Equal(t, "pass", authReq.Auth.Identity.Password.User.Password)
+		assert.Equal(t, "Default", authReq.Auth.Identity.Password.User.Domain.Name)
+		require.NotNil(t, authReq.Auth.Scope)
+		assert.Equal(t, "admin", authReq.Auth.Scope.Project.Name)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Subject-Token", "keystone-token")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"token": map[string]interface{}{
+				"expires_at": time.Now().Add(time.Hour).Format(time.RFC3339),
+			},
+		})
+	}))
+	defer ts.Close()
+
+	authenticator, err := NewAdminAuthenticator(zap.NewNop().Sugar(), &Config{
+		AuthMode:              AuthModeKeystoneV3,
+		IdentityUrl:           ts.URL + "/identity/",
+		IdentityUsername:      "user",
+		IdentityPassword:      "pass",
+		IdentityUserDomain:    "Default",
+		IdentityProject:       "admin",
+		IdentityProjectDomain: "Default",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "keystone-token", interceptHeader(t, authenticator, "X-Auth-Token"))
+	// token is reused until it expires
+	assert.Equal(t, "keystone-token", interceptHeader(t, authenticator, "X-Auth-Token"))
+	assert.Equal(t, 1, requests)
+}
+
+func TestNewAdminAuthenticator_KeystoneV3RefreshesBeforeExpiry(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/identity/v3/auth/tokens", r.URL.Path)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Subject-Token", fmt.Sprintf("keystone-token-%d", requests))
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"token": map[string]interface{}{
+				// within the expiry margin
+				"expires_at": time.Now().Add(keystoneTokenExpiryMargin / 2).Format(time.RFC3339),
+			},
+		})
+	}))
+	defer ts.Close()
+
+	authenticator, err := NewAdminAuthenticator(zap.NewNop().Sugar(), &Config{
+		AuthMode:           AuthModeKeystoneV3,
+		IdentityUrl:        ts.URL + "/identity",
+		IdentityUsername:   "user",
+		IdentityPassword:   "pass",
+		IdentityUserDomain: "Default",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "keystone-token-1", interceptHeader(t, authenticator, "X-Auth-Token"))
+	assert.Equal(t, "keystone-token-2", interceptHeader(t, authenticator, "X-Auth-Token"))
+	assert.Equal(t, 2, requests)
+}
+
+func TestNewAdminAuthenticator_OAuth2(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "salus.admin", r.PostForm.Get("scope"))
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"oauth-token","token_type":"bearer","expires_in":3600}`))
+	}))
+	defer ts.Close()
+
+	authenticator, err := NewAdminAuthenticator(zap.NewNop().Sugar(), &Config{
+		AuthMode:           AuthModeOAuth2,
+		Oauth2TokenUrl:     ts.URL,
+		Oauth2ClientId:     "id",
+		Oauth2ClientSecret: "secret",
+		Oauth2Scopes:       []string{"salus.admin"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "Bearer oauth-token", interceptHeader(t, authenticator, "Authorization"))
+}
+
+func TestNewAdminAuthenticator_MtlsMissingFiles(t *testing.T) {
+	_, err := NewAdminAuthenticator(zap.NewNop().Sugar(), &Config{
+		AuthMode:       AuthModeMtls,
+		ClientCertFile: "does-not-exist.pem",
+		ClientKeyFile:  "does-not-exist-key.pem",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to load client certificate")
+}
+
+func TestNewAdminAuthenticator_MtlsTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-auth")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(t, dir, "client", nil, nil)
+	authenticator, err := NewAdminAuthenticator(zap.NewNop().Sugar(), &Config{
+		AuthMode:       AuthModeMtls,
+		ClientCertFile: certFile,
+		ClientKeyFile:  keyFile,
+	})
+	require.NoError(t, err)
+
+	require.NotNil(t, authenticator.Client)
+	assert.Equal(t, getterTimeout, authenticator.Client.Timeout)
+}
@@ -25,11 +25,41 @@ import (
 	"go.uber.org/zap"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type loadFromGitCmd struct {
-	GithubToken string `usage:"access [token] for private Github repos" env:"GITHUB_TOKEN"`
+	GithubToken string `secret:"true" usage:"access [token] for private Github repos"`
 	Sha         string `usage:"a specific commit SHA to check out"`
+	Options     loadOptionFlags
+}
+
+// loadOptionFlags selects the content processed by a loading command and how it is loaded
+type loadOptionFlags struct {
+	Only             []string `flag:"only" usage:"if given, only the loader [definitions] to load"`
+	Exclude          []string `flag:"exclude" usage:"loader [definitions] to skip"`
+	Path             []string `flag:"path" usage:"if given, only load content files matching these gitignore style [patterns], relative to the content root"`
+	AllowLargeChange bool     `flag:"allow-large-change" usage:"load even when the planned changes exceed the guardrails"`
+}
+
+func (f *loadOptionFlags) loadOptions() (LoadOptions, error) {
+	options := LoadOptions{
+		Definitions:      f.Only,
+		Exclude:          f.Exclude,
+		Paths:            f.Path,
+		AllowLargeChange: f.AllowLargeChange,
+	}
+	return options, options.Validate()
+}
+
+// githubTokenLegacyEnv reads GITHUB_TOKEN, which earlier releases supported for load-from-git
+func githubTokenLegacyEnv(flagName string) string {
+	if flagName == "github-token" {
+		return "GITHUB_TOKEN"
+	}
+	return ""
 }
 
 func (c *loadFromGitCmd) Name() string {
@@ -64,13 +94,22 @@ func (c *loadFromGitCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...i
 		return subcommands.ExitUsageError
 	}
 
+	options, err := c.Options.loadOptions()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitUsageError
+	}
+
 	repoUrl := f.Arg(0)
 	logger.Debugw("running load-from-git",
-		"repo", repoUrl, "sha", c.Sha, "config", config)
+		"repo", repoUrl, "sha", c.Sha, "config", config, "options", options)
 
 	sourceContent := NewSourceContentFromGit(logger, repoUrl, c.Sha, c.GithubToken)
 
-	err := setupAndLoad(config, logger, sourceContent)
+	err = setupAndLoad(ctx, config, logger, sourceContent, &LoadRecord{
+		Repository: repoUrl,
+		Sha:        c.Sha,
+	}, options)
 	if err != nil {
 		logger.Errorw("data loading failed", "err", err)
 		return subcommands.ExitFailure
@@ -80,6 +119,9 @@ func (c *loadFromGitCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...i
 }
 
 type loadFromLocalDirCmd struct {
+	Options       loadOptionFlags
+	Watch         bool          `usage:"keep running and reload the loader definitions whose content changes"`
+	WatchDebounce time.Duration `usage:"how long changes must settle before reloading" default:"500ms"`
 }
 
 func (c *loadFromLocalDirCmd) Name() string {
@@ -91,12 +133,17 @@ func (c *loadFromLocalDirCmd) Synopsis() string {
 }
 
 func (c *loadFromLocalDirCmd) Usage() string {
-	return `load-from-local contentDirPath
+	return `load-from-local [flags] contentDirPath
+Flags:
 `
 }
 
-func (c *loadFromLocalDirCmd) SetFlags(*flag.FlagSet) {
-	// none to set
+func (c *loadFromLocalDirCmd) SetFlags(f *flag.FlagSet) {
+	filler := flagsfiller.New()
+	err := filler.Fill(f, c)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 func (c *loadFromLocalDirCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
@@ -109,13 +156,25 @@ func (c *loadFromLocalDirCmd) Execute(ctx context.Context, f *flag.FlagSet, args
 		return subcommands.ExitUsageError
 	}
 
+	options, err := c.Options.loadOptions()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitUsageError
+	}
+
 	path := f.Arg(0)
 	logger.Debugw("running load-from-local",
-		"path", path, "config", config)
+		"path", path, "config", config, "options", options)
+
+	if c.Watch {
+		return c.watch(ctx, config, logger, path, options)
+	}
 
 	sourceContent := NewSourceContentFromDir(logger, path)
 
-	err := setupAndLoad(config, logger, sourceContent)
+	err = setupAndLoad(ctx, config, logger, sourceContent, &LoadRecord{
+		Path: path,
+	}, options)
 	if err != nil {
 		logger.Errorw("data loading failed", "err", err)
 		return subcommands.ExitFailure
@@ -124,11 +183,124 @@ func (c *loadFromLocalDirCmd) Execute(ctx context.Context, f *flag.FlagSet, args
 	return subcommands.ExitSuccess
 }
 
+// watch loads all the content and then reloads the changed loader definitions, printing the
+// result of each file. Failed loads are reported and watching continues.
+func (c *loadFromLocalDirCmd) watch(ctx context.Context, config *Config, logger *zap.SugaredLogger,
+	path string, options LoadOptions) subcommands.ExitStatus {
+	options.OnFileResult = func(result FileResult) {
+		printFileResult(os.Stdout, result)
+	}
+
+	load := func(ctx context.Context, changed []string) {
+		loadOptions, included := restrictOptions(options, changed)
+		if !included {
+			logger.Debugw("ignoring changes of excluded loader definitions", "changed", changed)
+			return
+		}
+
+		err := setupAndLoad(ctx, config, logger, NewSourceContentFromDir(logger, path), &LoadRecord{
+			Path: path,
+		}, loadOptions)
+		if err != nil && ctx.Err() == nil {
+			logger.Errorw("data loading failed", "err", err, "definitions", loadOptions.Definitions)
+		}
+	}
+
+	load(ctx, nil)
+	// blocks until shutdown is signalled
+	err := NewLocalContentWatcher(logger, path, c.WatchDebounce, load).Run(ctx)
+	if err != nil {
+		logger.Errorw("failed to watch content directory", "err", err)
+		return subcommands.ExitFailure
+	}
+
+	return subcommands.ExitSuccess
+}
+
+type validateCmd struct {
+}
+
+func (c *validateCmd) Name() string {
+	return "validate"
+}
+
+func (c *validateCmd) Synopsis() string {
+	return "Validates content in a local directory without loading it"
+}
+
+func (c *validateCmd) Usage() string {
+	return `validate contentDirPath
+`
+}
+
+func (c *validateCmd) SetFlags(*flag.FlagSet) {
+	// none to set
+}
+
+func (c *validateCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	logger := args[0].(*zap.SugaredLogger)
+	config := args[1].(*Config)
+
+	if f.NArg() < 1 {
+		_, _ = fmt.Fprintln(os.Stderr, "missing content directory path")
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+
+	decryptor, err := NewContentDecryptor(config.AgeKeyFile, config.AgeKey)
+	if err != nil {
+		logger.Errorw("failed to setup content decryption", "err", err)
+		return subcommands.ExitFailure
+	}
+
+	report, err := ValidateContent(f.Arg(0), decryptor)
+	if err != nil {
+		logger.Errorw("failed to validate content", "err", err)
+		return subcommands.ExitFailure
+	}
+
+	for _, issue := range report.Warnings {
+		logger.Warnw("content not fully validated",
+			"definition", issue.Definition, "path", issue.Path, "reason", issue.Message)
+	}
+	for _, issue := range report.Errors {
+		logger.Errorw("invalid content",
+			"definition", issue.Definition, "path", issue.Path, "err", issue.Message)
+	}
+	logger.Infow("validated content",
+		"checked", report.Checked, "errors", len(report.Errors), "warnings", len(report.Warnings))
+
+	if !report.Valid() {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
 type webhookServerCmd struct {
 	Port          int      `usage:"the port where webhook server will bind" default:"8080"`
-	GithubToken   string   `usage:"access [token] for private Github repos"`
-	WebhookSecret string   `usage:"secret key coordinated with webhook declaration in Github"`
+	GithubToken   string   `secret:"true" usage:"access [token] for private Github repos"`
+	WebhookSecret string   `secret:"true" usage:"secret key coordinated with webhook declaration in Github"`
 	MatchingRefs  []string `usage:"if given, limit to push events that regex-match"`
+	ReloadToken   string   `secret:"true" usage:"if given, enables the /reload endpoint for callers presenting this bearer [token]"`
+	RoutingConfig string   `usage:"a YAML or JSON [file] that routes repositories and refs to Admin API targets. Replaces admin-url and matching-refs"`
+	// ContentRepository is only used for probing since push events convey their own repository
+	ContentRepository string        `usage:"the clone [URL] of the content repository, used to check git access for readiness"`
+	ReadinessCacheTtl time.Duration `usage:"how long readiness check results are reused" default:"10s"`
+	ShutdownTimeout   time.Duration `usage:"how long running loads may finish after SIGTERM before being cancelled" default:"30s"`
+	RequireApproval   bool          `usage:"only plan the loads of push events until approved at the /pending endpoints. Declared per target with routing-config"`
+	ApprovalExpiry    time.Duration `usage:"how long a pending load may be approved" default:"24h"`
+	PendingLocation   string        `usage:"a redis:// [URL] shared by replicas, or else a directory, where pending loads are kept. Defaults to data-dir, otherwise they're only kept in memory, which requires a single replica"`
+	DriftInterval     time.Duration `usage:"if given, how often the heads of drift-refs in content-repository are compared with their targets"`
+	DriftRefs         []string      `usage:"the branches or tags checked for drift, where HEAD is the default branch" default:"HEAD"`
+	DriftApply        bool          `usage:"load the changes found by drift checks rather than only reporting them"`
+	DeliveryCacheSize int           `usage:"how many processed push deliveries are remembered so that a redelivery returns the original result, disabled when 0. Persisted within data-dir when given" default:"1000"`
+	TlsCertFile       string        `usage:"if given, serve TLS with this PEM certificate [file], which is reloaded when changed"`
+	TlsKeyFile        string        `usage:"the PEM key [file] of tls-cert-file"`
+	ClientCaFile      string        `usage:"if given, the PEM CA [file] that verifies client certificates, which authorize manual and admin requests in place of reload-token"`
+	AdminPort         int           `usage:"if given, the port serving the manual and admin endpoints, metrics, and readiness rather than port"`
+	MaxRequestBytes   int64         `usage:"the largest request body accepted, unlimited when 0" default:"26214400"`
+	ReadTimeout       time.Duration `usage:"how long reading a request may take" default:"30s"`
+	WriteTimeout      time.Duration `usage:"how long handling a request and writing its response may take, which needs to exceed the longest load" default:"10m"`
 }
 
 func (c *webhookServerCmd) Name() string {
@@ -145,7 +317,7 @@ func (c *webhookServerCmd) Usage() string {
 }
 
 func (c *webhookServerCmd) SetFlags(f *flag.FlagSet) {
-	filler := flagsfiller.New(flagsfiller.WithEnv(""))
+	filler := flagsfiller.New()
 	err := filler.Fill(f, c)
 	if err != nil {
 		log.Fatal(err)
@@ -158,22 +330,91 @@ func (c *webhookServerCmd) Execute(ctx context.Context, f *flag.FlagSet, args ..
 
 	logger.Debugw("running webhook-server")
 
-	authenticator, err := OptionalIdentityAuthenticator(logger, config)
+	router, err := c.setupRouter(logger, config)
 	if err != nil {
-		logger.Errorw("failed to setup authenticator", "err", err)
+		logger.Errorw("failed to setup routing", "err", err)
 		return subcommands.ExitFailure
 	}
 
-	loader, err := NewLoader(logger, authenticator, config.AdminUrl)
-
 	gitContentBuilder := func(repository string, sha string) SourceContent {
 		return NewSourceContentFromGit(logger, repository, sha, c.GithubToken)
 	}
 
-	webhookServer := NewWebhookServer(logger, loader, c.Port, gitContentBuilder, c.WebhookSecret, c.MatchingRefs)
+	webhookServer := NewWebhookServer(logger, router, c.Port, gitContentBuilder, c.WebhookSecret)
+	err = webhookServer.SetupServing(ServingConfig{
+		TlsCertFile:     c.TlsCertFile,
+		TlsKeyFile:      c.TlsKeyFile,
+		ClientCaFile:    c.ClientCaFile,
+		AdminPort:       c.AdminPort,
+		MaxRequestBytes: c.MaxRequestBytes,
+		ReadTimeout:     c.ReadTimeout,
+		WriteTimeout:    c.WriteTimeout,
+	})
+	if err != nil {
+		logger.Errorw("failed to setup serving", "err", err)
+		return subcommands.ExitFailure
+	}
+	if c.ReloadToken != "" || c.ClientCaFile != "" {
+		webhookServer.SetupReload(c.ReloadToken, NewGitRefResolver(c.GithubToken))
+	}
+	if requiresApproval(router) {
+		if c.ReloadToken == "" && c.ClientCaFile == "" {
+			logger.Errorw("reload-token or client-ca-file is required to approve pending loads")
+			return subcommands.ExitFailure
+		}
+		pendingLocation := c.PendingLocation
+		if pendingLocation == "" {
+			pendingLocation = config.DataDir
+		}
+		err = webhookServer.SetupApproval(c.ApprovalExpiry, pendingLocation)
+		if err != nil {
+			logger.Errorw("failed to setup approval", "err", err)
+			return subcommands.ExitFailure
+		}
+	}
+	if c.DriftInterval > 0 {
+		if c.ContentRepository == "" {
+			logger.Errorw("content-repository is required to check for drift")
+			return subcommands.ExitFailure
+		}
+		if c.ReloadToken == "" && c.ClientCaFile == "" {
+			logger.Errorw("reload-token or client-ca-file is required to report drift")
+			return subcommands.ExitFailure
+		}
+		webhookServer.SetupDrift(DriftConfig{
+			Repository: c.ContentRepository,
+			Refs:       c.DriftRefs,
+			Interval:   c.DriftInterval,
+			Apply:      c.DriftApply,
+		}, NewGitRefResolver(c.GithubToken))
+	}
+	webhookServer.SetupReadiness(NewReadinessChecker(logger, c.readinessChecks(router), c.ReadinessCacheTtl))
+	webhookServer.SetupShutdown(c.ShutdownTimeout)
+
+	if c.DeliveryCacheSize > 0 {
+		var deliveriesPath string
+		if config.DataDir != "" {
+			deliveriesPath = filepath.Join(config.DataDir, deliveriesFilename)
+		}
+		err = webhookServer.SetupDeliveryDedupe(c.DeliveryCacheSize, deliveriesPath)
+		if err != nil {
+			logger.Errorw("failed to setup delivery deduplication", "err", err)
+			return subcommands.ExitFailure
+		}
+	}
+
+	if config.DataDir != "" {
+		historyStore, err := OpenHistoryStore(config.DataDir)
+		if err != nil {
+			logger.Errorw("failed to open history store", "err", err)
+			return subcommands.ExitFailure
+		}
+		defer historyStore.Close()
+		webhookServer.SetupHistory(historyStore)
+	}
 
-	// blocks unless error at startup
-	err = webhookServer.Start()
+	// blocks until shutdown is signalled or error at startup
+	err = webhookServer.Start(ctx)
 	if err != nil {
 		logger.Errorw("webhook server failed", "err", err)
 		return subcommands.ExitFailure
@@ -181,3 +422,70 @@ func (c *webhookServerCmd) Execute(ctx context.Context, f *flag.FlagSet, args ..
 
 	return subcommands.ExitSuccess
 }
+
+func (c *webhookServerCmd) readinessChecks(router *Router) []HealthCheck {
+	checks := targetHealthChecks(router)
+	if c.ContentRepository != "" {
+		checks = append(checks, gitRemoteHealthCheck(c.ContentRepository, c.GithubToken))
+	}
+	return append(checks, tempDirHealthCheck())
+}
+
+func (c *webhookServerCmd) setupRouter(logger *zap.SugaredLogger, config *Config) (*Router, error) {
+	if c.RoutingConfig == "" {
+		authenticator, err := NewAdminAuthenticator(logger, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup authenticator: %w", err)
+		}
+
+		loader, err := NewLoader(logger, authenticator, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create loader: %w", err)
+		}
+
+		router, err := NewSingleTargetRouter(loader, c.MatchingRefs)
+		if err != nil {
+			return nil, err
+		}
+		router.Targets()[0].RequireApproval = c.RequireApproval
+		return router, nil
+	}
+
+	if len(c.MatchingRefs) > 0 {
+		return nil, fmt.Errorf("matching-refs cannot be combined with routing-config")
+	}
+	if c.RequireApproval {
+		return nil, fmt.Errorf("require-approval cannot be combined with routing-config, which declares it per target")
+	}
+
+	routingConfig, err := LoadRoutingConfig(c.RoutingConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.StateLocation != "" && len(routingConfig.Targets) > 1 &&
+		!strings.Contains(config.StateLocation, stateTargetPlaceholder) {
+		return nil, fmt.Errorf("state-location must include %s when routing to multiple targets",
+			stateTargetPlaceholder)
+	}
+
+	router, err := NewRouter(routingConfig, targetLoaderBuilder(logger, config))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, target := range routingConfig.Targets {
+		logger.Infow("configured routing target",
+			"target", target.Name, "adminUrl", target.AdminUrl, "requireApproval", target.RequireApproval)
+	}
+	return router, nil
+}
+
+func requiresApproval(router *Router) bool {
+	for _, target := range router.Targets() {
+		if target.RequireApproval {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,419 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/google/subcommands"
+	"github.com/itzg/go-flagsfiller"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	envPrefix      = "DATA_LOADER_"
+	configFileFlag = "config"
+	redactedValue  = "<redacted>"
+)
+
+// ConfigFile holds the settings of a YAML or JSON config file. Top-level keys are global flag
+// names and a subcommand's flags are set in a section keyed by the subcommand name. Keys may
+// be given in kebab-case, such as admin-url, or camelCase, such as adminUrl.
+type ConfigFile map[string]interface{}
+
+// LegacyEnvNamer returns the unprefixed environment variable name that earlier releases read
+// for the given flag or an empty string if there was none
+type LegacyEnvNamer func(flagName string) string
+
+// LoadConfigFile reads a YAML or JSON config file
+func LoadConfigFile(path string) (ConfigFile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var configFile ConfigFile
+	err = yaml.Unmarshal(content, &configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if configFile == nil {
+		configFile = ConfigFile{}
+	}
+
+	return configFile, nil
+}
+
+// globals returns the top-level settings, excluding subcommand sections
+func (c ConfigFile) globals() map[string]interface{} {
+	settings := make(map[string]interface{})
+	for key, value := range c {
+		if !isSection(value) {
+			settings[key] = value
+		}
+	}
+	return settings
+}
+
+// section returns the settings of the given subcommand, which may be empty
+func (c ConfigFile) section(name string) (map[string]interface{}, error) {
+	value, exists := c[name]
+	if !exists {
+		return nil, nil
+	}
+
+	raw, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config section %s must be a mapping", name)
+	}
+	settings := make(map[string]interface{}, len(raw))
+	for key, value := range raw {
+		settings[fmt.Sprint(key)] = value
+	}
+	return settings, nil
+}
+
+// validateSections ensures each subcommand section is named after a known subcommand
+func (c ConfigFile) validateSections(commandNames []string) error {
+	for key, value := range c {
+		if !isSection(value) {
+			continue
+		}
+		known := false
+		for _, name := range commandNames {
+			if key == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("config section %s does not match a subcommand", key)
+		}
+	}
+	return nil
+}
+
+func isSection(value interface{}) bool {
+	_, ok := value.(map[interface{}]interface{})
+	return ok
+}
+
+// setupGlobalConfig loads the config file, if any, and applies it along with the environment
+// to the global flags that were not given on the command line
+func setupGlobalConfig(flagSet *flag.FlagSet, commandNames []string) (ConfigFile, error) {
+	path := flagSet.Lookup(configFileFlag).Value.String()
+	if path == "" {
+		path = os.Getenv(envName(envPrefix, configFileFlag))
+	}
+
+	configFile := ConfigFile{}
+	if path != "" {
+		var err error
+		configFile, err = LoadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = configFile.validateSections(commandNames)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := applyConfigLayers(flagSet, configFile.globals(), legacyEnvOriginal)
+	if err != nil {
+		return nil, err
+	}
+	return configFile, nil
+}
+
+// applyConfigLayers sets each flag that was not given on the command line from, in order of
+// precedence, its DATA_LOADER_* environment variable, its legacy environment variable, or the
+// given config file settings. Flags otherwise retain their defaults.
+func applyConfigLayers(flagSet *flag.FlagSet, settings map[string]interface{}, legacyEnv LegacyEnvNamer) error {
+	fileValues := make(map[string]string, len(settings))
+	for key, value := range settings {
+		f := lookupFlag(flagSet, key)
+		if f == nil || f.Name == configFileFlag {
+			return fmt.Errorf("config setting %s does not match an option", key)
+		}
+		formatted, err := formatSetting(value)
+		if err != nil {
+			return fmt.Errorf("invalid config setting %s: %w", key, err)
+		}
+		fileValues[f.Name] = formatted
+	}
+
+	given := make(map[string]bool)
+	flagSet.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var err error
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] || f.Name == configFileFlag {
+			return
+		}
+
+		source := "config file"
+		value, exists := fileValues[f.Name]
+		if legacyEnv != nil {
+			if legacyName := legacyEnv(f.Name); legacyName != "" {
+				if envValue, ok := os.LookupEnv(legacyName); ok {
+					source, value, exists = "environment variable "+legacyName, envValue, true
+				}
+			}
+		}
+		name := envName(envPrefix, f.Name)
+		if envValue, ok := os.LookupEnv(name); ok {
+			source, value, exists = "environment variable "+name, envValue, true
+		}
+
+		if exists {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("invalid value for %s from %s: %w", f.Name, source, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// lookupFlag finds the flag for a config key given in kebab-case or camelCase
+func lookupFlag(flagSet *flag.FlagSet, key string) *flag.Flag {
+	normalized := normalizeConfigKey(key)
+	var found *flag.Flag
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if normalizeConfigKey(f.Name) == normalized {
+			found = f
+		}
+	})
+	return found
+}
+
+func normalizeConfigKey(key string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(key))
+}
+
+// formatSetting converts a config file value into the string form accepted by flags, where
+// lists become comma separated
+func formatSetting(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			if isSection(item) {
+				return "", fmt.Errorf("list items must be scalars")
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ","), nil
+	case map[interface{}]interface{}:
+		return "", fmt.Errorf("must be a scalar or list")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// envName converts a flag name into an environment variable name, such as admin-url into
+// DATA_LOADER_ADMIN_URL
+func envName(prefix string, flagName string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// legacyEnvFlags are the global and webhook-server flags whose unprefixed variable names
+// earlier releases supported
+var legacyEnvFlags = map[string]bool{
+	"identity-url":      true,
+	"identity-username": true,
+	"identity-password": true,
+	"identity-apikey":   true,
+	"admin-url":         true,
+	"debug":             true,
+	"port":              true,
+	"github-token":      true,
+	"webhook-secret":    true,
+	"matching-refs":     true,
+}
+
+// legacyEnvOriginal reads the unprefixed variable name of the flags in legacyEnvFlags.
+// Flags added since then are only read from their DATA_LOADER_* variable.
+func legacyEnvOriginal(flagName string) string {
+	if !legacyEnvFlags[flagName] {
+		return ""
+	}
+	return envName("", flagName)
+}
+
+// describeEnv adds the environment variable of each flag to its usage
+func describeEnv(flagSet *flag.FlagSet) {
+	flagSet.VisitAll(func(f *flag.Flag) {
+		f.Usage = fmt.Sprintf("%s (env %s)", f.Usage, envName(envPrefix, f.Name))
+	})
+}
+
+// secretFlags returns the names of flags filled from fields of the given struct reference that
+// are tagged with secret:"true"
+func secretFlags(from interface{}) map[string]bool {
+	secrets := make(map[string]bool)
+	t := reflect.TypeOf(from).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("secret") != "true" {
+			continue
+		}
+		if name, exists := field.Tag.Lookup("flag"); exists {
+			secrets[name] = true
+		} else {
+			secrets[flagsfiller.DefaultFieldRenamer(field.Name)] = true
+		}
+	}
+	return secrets
+}
+
+// effectiveSettings renders the current flag values in config file form with secrets redacted
+func effectiveSettings(flagSet *flag.FlagSet, secrets map[string]bool) yaml.MapSlice {
+	var settings yaml.MapSlice
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if f.Name == configFileFlag {
+			return
+		}
+		value := f.Value.String()
+		if secrets[f.Name] && value != "" {
+			value = redactedValue
+		}
+		settings = append(settings, yaml.MapItem{Key: f.Name, Value: value})
+	})
+	return settings
+}
+
+// layeredCommand applies a subcommand's config file section and environment variables to its
+// flags before executing it
+type layeredCommand struct {
+	subcommands.Command
+	legacyEnv LegacyEnvNamer
+}
+
+func (c *layeredCommand) SetFlags(f *flag.FlagSet) {
+	c.Command.SetFlags(f)
+	describeEnv(f)
+}
+
+func (c *layeredCommand) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	logger := args[0].(*zap.SugaredLogger)
+	configFile := args[2].(ConfigFile)
+
+	err := c.applyConfig(f, configFile)
+	if err != nil {
+		logger.Errorw("invalid config", "err", err)
+		return subcommands.ExitUsageError
+	}
+
+	return c.Command.Execute(ctx, f, args...)
+}
+
+func (c *layeredCommand) applyConfig(f *flag.FlagSet, configFile ConfigFile) error {
+	settings, err := configFile.section(c.Name())
+	if err != nil {
+		return err
+	}
+	return applyConfigLayers(f, settings, c.legacyEnv)
+}
+
+type configCmd struct {
+	commands []*layeredCommand
+}
+
+func (c *configCmd) Name() string {
+	return "config"
+}
+
+func (c *configCmd) Synopsis() string {
+	return "Prints the effective configuration with secrets redacted"
+}
+
+func (c *configCmd) Usage() string {
+	return `config print
+Prints the effective global and subcommand options in config file form
+`
+}
+
+func (c *configCmd) SetFlags(*flag.FlagSet) {
+	// none to set
+}
+
+func (c *configCmd) Execute(_ context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	logger := args[0].(*zap.SugaredLogger)
+	config := args[1].(*Config)
+	configFile := args[2].(ConfigFile)
+
+	if f.NArg() != 1 || f.Arg(0) != "print" {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+
+	settings, err := c.effectiveConfig(flag.CommandLine, config, configFile)
+	if err != nil {
+		logger.Errorw("invalid config", "err", err)
+		return subcommands.ExitUsageError
+	}
+
+	out, err := yaml.Marshal(settings)
+	if err != nil {
+		logger.Errorw("failed to render config", "err", err)
+		return subcommands.ExitFailure
+	}
+	_, _ = os.Stdout.Write(out)
+
+	return subcommands.ExitSuccess
+}
+
+// effectiveConfig renders the given global flags followed by a section for each subcommand
+// that has options, where subcommand flags are resolved as if that subcommand was run
+func (c *configCmd) effectiveConfig(globalFlags *flag.FlagSet, config *Config, configFile ConfigFile) (yaml.MapSlice, error) {
+	settings := effectiveSettings(globalFlags, secretFlags(config))
+
+	commands := make([]*layeredCommand, len(c.commands))
+	copy(commands, c.commands)
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Name() < commands[j].Name()
+	})
+
+	for _, command := range commands {
+		flagSet := flag.NewFlagSet(command.Name(), flag.ContinueOnError)
+		command.Command.SetFlags(flagSet)
+
+		err := command.applyConfig(flagSet, configFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", command.Name(), err)
+		}
+
+		section := effectiveSettings(flagSet, secretFlags(command.Command))
+		if len(section) > 0 {
+			settings = append(settings, yaml.MapItem{Key: command.Name(), Value: section})
+		}
+	}
+
+	return settings, nil
+}
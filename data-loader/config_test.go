@@ -0,0 +1,141 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"flag"
+	"github.com/itzg/go-flagsfiller"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type layeredTestOptions struct {
+	FromDefault string `default:"default"`
+	FromFile    string
+	FromEnv     string
+	FromLegacy  string
+	FromFlag    string
+	Refs        []string
+	Token       string `secret:"true"`
+}
+
+func newLayeredTestFlags(t *testing.T, options *layeredTestOptions) *flag.FlagSet {
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	require.NoError(t, flagsfiller.New().Fill(flagSet, options))
+	return flagSet
+}
+
+func TestApplyConfigLayers_Precedence(t *testing.T) {
+	var options layeredTestOptions
+	flagSet := newLayeredTestFlags(t, &options)
+	require.NoError(t, flagSet.Parse([]string{"-from-flag", "flag"}))
+
+	require.NoError(t, os.Setenv("DATA_LOADER_FROM_ENV", "env"))
+	defer os.Unsetenv("DATA_LOADER_FROM_ENV")
+	require.NoError(t, os.Setenv("DATA_LOADER_FROM_FLAG", "env"))
+	defer os.Unsetenv("DATA_LOADER_FROM_FLAG")
+	require.NoError(t, os.Setenv("FROM_LEGACY", "legacy"))
+	defer os.Unsetenv("FROM_LEGACY")
+
+	err := applyConfigLayers(flagSet, map[string]interface{}{
+		"fromFile":    "file",
+		"from-env":    "file",
+		"from-legacy": "file",
+		"from-flag":   "file",
+		"refs":        []interface{}{"master", "prod"},
+	}, func(flagName string) string {
+		return envName("", flagName)
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, layeredTestOptions{
+		FromDefault: "default",
+		FromFile:    "file",
+		FromEnv:     "env",
+		FromLegacy:  "legacy",
+		FromFlag:    "flag",
+		Refs:        []string{"master", "prod"},
+	}, options)
+}
+
+func TestLegacyEnvOriginal(t *testing.T) {
+	assert.Equal(t, "ADMIN_URL", legacyEnvOriginal("admin-url"))
+	assert.Equal(t, "GITHUB_TOKEN", legacyEnvOriginal("github-token"))
+	assert.Equal(t, "", legacyEnvOriginal("state-location"))
+	assert.Equal(t, "", legacyEnvOriginal("client-ca-file"))
+}
+
+func TestApplyConfigLayers_UnknownSetting(t *testing.T) {
+	var options layeredTestOptions
+	flagSet := newLayeredTestFlags(t, &options)
+
+	err := applyConfigLayers(flagSet, map[string]interface{}{
+		"not-an-option": "value",
+	}, nil)
+	assert.EqualError(t, err, "config setting not-an-option does not match an option")
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "data-loader-config")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(`
+admin-url: https://admin.example.com
+webhook-server:
+  port: 9090
+`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	configFile, err := LoadConfigFile(file.Name())
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{
+		"admin-url": "https://admin.example.com",
+	}, configFile.globals())
+
+	section, err := configFile.section("webhook-server")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"port": 9090}, section)
+
+	assert.NoError(t, configFile.validateSections([]string{"webhook-server"}))
+	assert.EqualError(t, configFile.validateSections([]string{"load-from-git"}),
+		"config section webhook-server does not match a subcommand")
+}
+
+func TestEffectiveSettings_Redacted(t *testing.T) {
+	var options layeredTestOptions
+	flagSet := newLayeredTestFlags(t, &options)
+	require.NoError(t, flagSet.Parse([]string{"-token", "very-secret", "-refs", "master"}))
+
+	settings := effectiveSettings(flagSet, secretFlags(&options))
+
+	assert.Equal(t, yaml.MapSlice{
+		{Key: "from-default", Value: "default"},
+		{Key: "from-env", Value: ""},
+		{Key: "from-file", Value: ""},
+		{Key: "from-flag", Value: ""},
+		{Key: "from-legacy", Value: ""},
+		{Key: "refs", Value: "master"},
+		{Key: "token", Value: redactedValue},
+	}, settings)
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/golang-lru"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	deliveriesFilename = "deliveries.json"
+	// forceParam and forceHeader ask for a duplicate delivery to be processed again
+	forceParam      = "force"
+	forceHeader     = "X-Data-Loader-Force"
+	duplicateHeader = "X-Data-Loader-Duplicate"
+)
+
+// DeliveryResult is the response to a processed webhook delivery
+type DeliveryResult struct {
+	DeliveryId  string    `json:"deliveryId"`
+	StatusCode  int       `json:"statusCode"`
+	ContentType string    `json:"contentType,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+	ProcessedAt time.Time `json:"processedAt"`
+}
+
+// deliveryCache remembers the results of the most recently processed deliveries and, if
+// given a path, persists them so they survive restarts
+type deliveryCache struct {
+	log   *zap.SugaredLogger
+	cache *lru.Cache
+	path  string
+	// persistMutex orders the writes of the persisted file
+	persistMutex sync.Mutex
+	// inFlightMutex guards inFlight along with checking the cache before a delivery begins
+	inFlightMutex sync.Mutex
+	inFlight      map[string]*inFlightDelivery
+}
+
+// inFlightDelivery is a delivery being processed, whose done channel is closed once finished
+type inFlightDelivery struct {
+	done chan struct{}
+	// result is only set when the delivery succeeded
+	result *DeliveryResult
+}
+
+func newDeliveryCache(log *zap.SugaredLogger, size int, path string) (*deliveryCache, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create delivery cache: %w", err)
+	}
+	c := &deliveryCache{
+		log:      log,
+		cache:    cache,
+		path:     path,
+		inFlight: make(map[string]*inFlightDelivery),
+	}
+
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read deliveries file: %w", err)
+		}
+		if err == nil {
+			var results []*DeliveryResult
+			err = json.Unmarshal(content, &results)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse deliveries file: %w", err)
+			}
+			// oldest first, so the most recent are retained
+			for _, result := range results {
+				cache.Add(result.DeliveryId, result)
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// get returns the result of the delivery or nil if it wasn't processed or was evicted
+func (c *deliveryCache) get(deliveryId string) *DeliveryResult {
+	value, exists := c.cache.Get(deliveryId)
+	if !exists {
+		return nil
+	}
+	return value.(*DeliveryResult)
+}
+
+func (c *deliveryCache) add(result *DeliveryResult) {
+	c.cache.Add(result.DeliveryId, result)
+	if c.path == "" {
+		return
+	}
+
+	c.persistMutex.Lock()
+	defer c.persistMutex.Unlock()
+
+	var results []*DeliveryResult
+	for _, key := range c.cache.Keys() {
+		if value, exists := c.cache.Peek(key); exists {
+			results = append(results, value.(*DeliveryResult))
+		}
+	}
+	content, err := json.Marshal(results)
+	if err == nil {
+		err = writeFileAtomically(c.path, content)
+	}
+	if err != nil {
+		// only duplicate detection across restarts is affected
+		c.log.Warnw("failed to persist deliveries", "err", err, "path", c.path)
+	}
+}
+
+// begin returns the original result of the delivery, waiting for it while another request
+// processes the same delivery. Otherwise, the delivery is marked as in flight until the
+// returned function is called with its result. A forced delivery only waits for the other
+// request to finish before it is processed again.
+func (c *deliveryCache) begin(ctx context.Context, deliveryId string, forced bool) (*DeliveryResult, func(*DeliveryResult), error) {
+	for {
+		c.inFlightMutex.Lock()
+		flight, exists := c.inFlight[deliveryId]
+		if !exists {
+			if original := c.get(deliveryId); original != nil && !forced {
+				c.inFlightMutex.Unlock()
+				return original, nil, nil
+			}
+			flight = &inFlightDelivery{done: make(chan struct{})}
+			c.inFlight[deliveryId] = flight
+			c.inFlightMutex.Unlock()
+			return nil, func(result *DeliveryResult) {
+				c.finish(deliveryId, flight, result)
+			}, nil
+		}
+		c.inFlightMutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-flight.done:
+		}
+		if flight.result != nil && !forced {
+			return flight.result, nil, nil
+		}
+		// the other request failed or this one is forced, so try to process it
+	}
+}
+
+// finish remembers the result of the in flight delivery, if it succeeded, and releases the
+// requests waiting for it
+func (c *deliveryCache) finish(deliveryId string, flight *inFlightDelivery, result *DeliveryResult) {
+	// failed deliveries aren't remembered so that a redelivery retries them
+	if result.StatusCode < 300 {
+		c.add(result)
+		flight.result = result
+	}
+
+	c.inFlightMutex.Lock()
+	delete(c.inFlight, deliveryId)
+	c.inFlightMutex.Unlock()
+	close(flight.done)
+}
+
+// SetupDeliveryDedupe remembers the results of the given number of processed push deliveries
+// so that a redelivery returns the original result. The results are persisted at the path,
+// if given.
+func (s *WebhookServer) SetupDeliveryDedupe(size int, path string) error {
+	deliveries, err := newDeliveryCache(s.log, size, path)
+	if err != nil {
+		return err
+	}
+	s.deliveries = deliveries
+	return nil
+}
+
+// isForced reports if the request asks for a duplicate delivery to be processed again
+func isForced(r *http.Request) bool {
+	for _, value := range []string{r.URL.Query().Get(forceParam), r.Header.Get(forceHeader)} {
+		if forced, err := strconv.ParseBool(value); err == nil && forced {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *WebhookServer) writeDeliveryResult(w http.ResponseWriter, result *DeliveryResult) {
+	if result.ContentType != "" {
+		w.Header().Set("Content-Type", result.ContentType)
+	}
+	w.Header().Set(duplicateHeader, "true")
+	w.WriteHeader(result.StatusCode)
+	_, err := w.Write(result.Body)
+	if err != nil {
+		s.log.Warnw("failed to send duplicate delivery response", "err", err)
+	}
+}
+
+// recordingResponseWriter retains the status and body written to the response
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// result describes the recorded response, where a response without a status is OK
+func (w *recordingResponseWriter) result(deliveryId string) *DeliveryResult {
+	statusCode := w.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	return &DeliveryResult{
+		DeliveryId:  deliveryId,
+		StatusCode:  statusCode,
+		ContentType: w.Header().Get("Content-Type"),
+		Body:        w.body.Bytes(),
+		ProcessedAt: time.Now(),
+	}
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingLoader counts loads and fails them with err, if given
+type countingLoader struct {
+	loads int
+	err   error
+}
+
+func (l *countingLoader) LoadAll(context.Context, string, LoadOptions) (*LoaderStats, error) {
+	l.loads++
+	stats := newLoaderStats()
+	stats.Created = l.loads
+	return stats, l.err
+}
+
+func TestWebhookServer_handleWebhook_DuplicateDelivery(t *testing.T) {
+	server, loader := createTestDedupeServer(t, "")
+
+	first := deliverPush(t, server, "id-1", nil)
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Empty(t, first.Header().Get(duplicateHeader))
+
+	second := deliverPush(t, server, "id-1", nil)
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, "true", second.Header().Get(duplicateHeader))
+	assert.Equal(t, first.Header().Get("Content-Type"), second.Header().Get("Content-Type"))
+	assert.JSONEq(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, 1, loader.loads)
+
+	// a different delivery of the same push is loaded
+	deliverPush(t, server, "id-2", nil)
+	assert.Equal(t, 2, loader.loads)
+}
+
+func TestWebhookServer_handleWebhook_ForcedDuplicateDelivery(t *testing.T) {
+	server, loader := createTestDedupeServer(t, "")
+	deliverPush(t, server, "id-1", nil)
+
+	resp := deliverPush(t, server, "id-1", func(req *http.Request) {
+		req.Header.Set(forceHeader, "true")
+	})
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Equal(t, 1, loader.loads)
+
+	resp = deliverPush(t, server, "id-1", func(req *http.Request) {
+		req.Header.Set(forceHeader, "true")
+		req.Header.Set("Authorization", "Bearer reload-token")
+	})
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Header().Get(duplicateHeader))
+	assert.Equal(t, 2, loader.loads)
+
+	resp = deliverPush(t, server, "id-1", func(req *http.Request) {
+		req.URL.RawQuery = forceParam + "=true"
+		req.Header.Set("Authorization", "Bearer reload-token")
+	})
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, 3, loader.loads)
+
+	// the forced result replaces the original
+	resp = deliverPush(t, server, "id-1", nil)
+	assert.Contains(t, resp.Body.String(), `"Created":3`)
+}
+
+func TestWebhookServer_handleWebhook_FailedDeliveryRetried(t *testing.T) {
+	server, loader := createTestDedupeServer(t, "")
+	loader.err = errors.New("admin API unavailable")
+
+	resp := deliverPush(t, server, "id-1", nil)
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+
+	loader.err = nil
+	resp = deliverPush(t, server, "id-1", nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Header().Get(duplicateHeader))
+	assert.Equal(t, 2, loader.loads)
+}
+
+// releasedLoader holds each load until released with the error, if any, it returns
+type releasedLoader struct {
+	started chan struct{}
+	release chan error
+	loads   int32
+}
+
+func (l *releasedLoader) LoadAll(context.Context, string, LoadOptions) (*LoaderStats, error) {
+	atomic.AddInt32(&l.loads, 1)
+	l.started <- struct{}{}
+	err := <-l.release
+	stats := newLoaderStats()
+	stats.Created = 1
+	return stats, err
+}
+
+func TestWebhookServer_handleWebhook_ConcurrentDuplicateDelivery(t *testing.T) {
+	server, _ := createTestDedupeServer(t, "")
+	loader := &releasedLoader{started: make(chan struct{}, 2), release: make(chan error, 2)}
+	server.router.Targets()[0].Loader = loader
+
+	responses := make(chan *httptest.ResponseRecorder, 2)
+	go func() { responses <- deliverPush(t, server, "id-1", nil) }()
+	<-loader.started
+	go func() { responses <- deliverPush(t, server, "id-1", nil) }()
+
+	// the redelivery waits for the delivery in flight rather than loading again
+	select {
+	case <-responses:
+		t.Fatal("expected the deliveries to wait for the load")
+	case <-time.After(100 * time.Millisecond):
+	}
+	loader.release <- nil
+
+	first, second := <-responses, <-responses
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Empty(t, first.Header().Get(duplicateHeader))
+	assert.Equal(t, "true", second.Header().Get(duplicateHeader))
+	assert.JSONEq(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&loader.loads))
+}
+
+func TestWebhookServer_handleWebhook_ConcurrentDuplicateOfFailedDelivery(t *testing.T) {
+	server, _ := createTestDedupeServer(t, "")
+	loader := &releasedLoader{started: make(chan struct{}, 2), release: make(chan error, 2)}
+	server.router.Targets()[0].Loader = loader
+
+	failed := make(chan *httptest.ResponseRecorder, 1)
+	go func() { failed <- deliverPush(t, server, "id-1", nil) }()
+	<-loader.started
+	retried := make(chan *httptest.ResponseRecorder, 1)
+	go func() { retried <- deliverPush(t, server, "id-1", nil) }()
+
+	// the waiting redelivery loads once the delivery in flight fails
+	loader.release <- errors.New("admin API unavailable")
+	assert.Equal(t, http.StatusInternalServerError, (<-failed).Code)
+	<-loader.started
+	loader.release <- nil
+	resp := <-retried
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Header().Get(duplicateHeader))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&loader.loads))
+}
+
+func TestWebhookServer_handleWebhook_PersistedDeliveries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-deliveries")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, deliveriesFilename)
+
+	server, loader := createTestDedupeServer(t, path)
+	deliverPush(t, server, "id-1", nil)
+	assert.Equal(t, 1, loader.loads)
+
+	restarted, restartedLoader := createTestDedupeServer(t, path)
+	resp := deliverPush(t, restarted, "id-1", nil)
+	assert.Equal(t, "true", resp.Header().Get(duplicateHeader))
+	assert.Equal(t, 0, restartedLoader.loads)
+}
+
+func TestDeliveryCache_EvictsOldest(t *testing.T) {
+	cache, err := newDeliveryCache(zap.NewNop().Sugar(), 2, "")
+	require.NoError(t, err)
+
+	cache.add(&DeliveryResult{DeliveryId: "id-1"})
+	cache.add(&DeliveryResult{DeliveryId: "id-2"})
+	cache.add(&DeliveryResult{DeliveryId: "id-3"})
+
+	assert.Nil(t, cache.get("id-1"))
+	assert.NotNil(t, cache.get("id-2"))
+	assert.NotNil(t, cache.get("id-3"))
+}
+
+func deliverPush(t *testing.T, server *WebhookServer, deliveryId string, customize func(req *http.Request)) *httptest.ResponseRecorder {
+	reqBody, err := os.Open("testdata/webhook_push_req.json")
+	require.NoError(t, err)
+	defer reqBody.Close()
+
+	req := createWebhookReq(reqBody, "push", "")
+	req.Header.Set("X-Github-Delivery", deliveryId)
+	if customize != nil {
+		customize(req)
+	}
+	resp := httptest.NewRecorder()
+	server.handleWebhook(resp, req)
+	return resp
+}
+
+func createTestDedupeServer(t *testing.T, path string) (*WebhookServer, *countingLoader) {
+	loader := &countingLoader{}
+	router, err := NewSingleTargetRouter(loader, nil)
+	require.NoError(t, err)
+
+	sourceContent := new(MockSourceContent)
+	sourceContent.On("Prepare").Return(mockContentPath, nil)
+	sourceContent.On("Cleanup").Return()
+	builder := &MockGitContentBuilder{sourceContent: sourceContent}
+	builder.On("build", mock.Anything, mock.Anything).Return(sourceContent)
+
+	server := NewWebhookServer(zap.NewNop().Sugar(), router, 8080, builder.build, "")
+	server.SetupReload("reload-token", nil)
+	require.NoError(t, server.SetupDeliveryDedupe(10, path))
+	return server, loader
+}
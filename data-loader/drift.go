@@ -0,0 +1,208 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	driftOutcomeInSync     = "in_sync"
+	driftOutcomeDrifted    = "drifted"
+	driftOutcomeReconciled = "reconciled"
+	driftOutcomeFailed     = "failed"
+)
+
+// DriftConfig declares the refs of a content repository that are periodically compared with
+// their targets
+type DriftConfig struct {
+	Repository string
+	// Refs are branch or tag names, where HEAD is the default branch
+	Refs     []string
+	Interval time.Duration
+	// Apply loads the content when drift is found rather than only reporting it
+	Apply bool
+}
+
+// DriftStatus is the outcome of the latest drift check of a ref
+type DriftStatus struct {
+	Target     string    `json:"target,omitempty"`
+	Repository string    `json:"repository"`
+	Ref        string    `json:"ref"`
+	Sha        string    `json:"sha,omitempty"`
+	CheckedAt  time.Time `json:"checkedAt"`
+	Outcome    string    `json:"outcome"`
+	// Plan is the changes the content would make to the target, which were loaded when the
+	// outcome is reconciled
+	Plan  *LoadPlan    `json:"plan,omitempty"`
+	Stats *LoaderStats `json:"stats,omitempty"`
+	Error string       `json:"error,omitempty"`
+}
+
+type driftReconciler struct {
+	config      DriftConfig
+	refResolver GitRefResolver
+
+	mutex    sync.Mutex
+	statuses map[string]*DriftStatus
+}
+
+// SetupDrift enables periodic drift checks of the given refs and the drift endpoint
+func (s *WebhookServer) SetupDrift(config DriftConfig, refResolver GitRefResolver) {
+	s.drift = &driftReconciler{
+		config:      config,
+		refResolver: refResolver,
+		statuses:    make(map[string]*DriftStatus),
+	}
+}
+
+// reconcileDrift checks each ref at startup and then at the configured interval until the
+// context is done
+func (s *WebhookServer) reconcileDrift(ctx context.Context) {
+	s.log.Infow("checking for drift periodically",
+		"repository", s.drift.config.Repository, "refs", s.drift.config.Refs,
+		"interval", s.drift.config.Interval, "apply", s.drift.config.Apply)
+
+	ticker := time.NewTicker(s.drift.config.Interval)
+	defer ticker.Stop()
+	for {
+		for _, ref := range s.drift.config.Refs {
+			if ctx.Err() != nil {
+				return
+			}
+			s.checkDrift(ref)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkDrift plans loading the head of the ref into its routed target and, if configured and
+// the target doesn't require approval, applies the changes
+func (s *WebhookServer) checkDrift(ref string) *DriftStatus {
+	status := &DriftStatus{
+		Repository: s.drift.config.Repository,
+		Ref:        ref,
+		CheckedAt:  time.Now(),
+	}
+	err := s.runDriftCheck(status)
+	if err != nil {
+		s.log.Warnw("failed to check for drift", "err", err, "ref", ref, "target", status.Target)
+		status.Outcome = driftOutcomeFailed
+		status.Error = err.Error()
+	} else {
+		s.log.Infow("checked for drift", "status", status)
+	}
+	recordDriftCheck(status)
+
+	s.drift.mutex.Lock()
+	defer s.drift.mutex.Unlock()
+	s.drift.statuses[ref] = status
+	return status
+}
+
+func (s *WebhookServer) runDriftCheck(status *DriftStatus) error {
+	refName, sha, err := s.drift.refResolver(status.Repository, status.Ref)
+	if err != nil {
+		return err
+	}
+	status.Ref = refName
+	status.Sha = sha
+
+	target := s.router.Route(status.Repository, refName)
+	if target == nil {
+		return fmt.Errorf("no route matches repository %s and ref %s", status.Repository, refName)
+	}
+	status.Target = target.Name
+
+	record := &LoadRecord{
+		Trigger:    triggerDrift,
+		Repository: status.Repository,
+		Ref:        refName,
+		Sha:        sha,
+	}
+	stats, err := s.planLoad(target, record)
+	if err != nil {
+		return err
+	}
+	status.Sha = record.Sha
+	status.Plan = stats.Plan
+
+	if stats.Plan.Creates+stats.Plan.Deletes == 0 {
+		status.Outcome = driftOutcomeInSync
+		return nil
+	}
+	// approval targets are only changed by approved pushes
+	if !s.drift.config.Apply || target.RequireApproval {
+		status.Outcome = driftOutcomeDrifted
+		return nil
+	}
+	if len(stats.Plan.Violations) > 0 {
+		// a large change is only loaded by a manual reload that allows it
+		s.log.Warnw("not reconciling drift that exceeds change guardrails",
+			"ref", refName, "target", target.Name, "violations", stats.Plan.Violations)
+		status.Outcome = driftOutcomeDrifted
+		return nil
+	}
+
+	s.log.Infow("loading source content to reconcile drift",
+		"ref", refName, "sha", record.Sha, "target", target.Name, "plan", stats.Plan)
+	stats, err = s.loadFromGit(target, &LoadRecord{
+		Trigger:    triggerDrift,
+		Repository: status.Repository,
+		Ref:        refName,
+		Sha:        record.Sha,
+	}, LoadOptions{ExpectedFingerprint: stats.Plan.Fingerprint})
+	if err != nil {
+		return fmt.Errorf("failed to reconcile drift of target %s: %w", target.Name, err)
+	}
+	status.Outcome = driftOutcomeReconciled
+	status.Stats = stats
+	return nil
+}
+
+func (s *WebhookServer) handleDrift(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.isAuthorizedCaller(r) {
+		s.log.Warnw("unauthorized drift request", "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.drift.mutex.Lock()
+	statuses := make([]*DriftStatus, 0, len(s.drift.statuses))
+	for _, ref := range s.drift.config.Refs {
+		if status, exists := s.drift.statuses[ref]; exists {
+			statuses = append(statuses, status)
+		}
+	}
+	s.drift.mutex.Unlock()
+
+	s.writeJsonResponse(w, statuses)
+}
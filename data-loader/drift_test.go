@@ -0,0 +1,204 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+const driftTestRepository = "https://github.com/example/content.git"
+
+func TestWebhookServer_checkDrift_DetectOnly(t *testing.T) {
+	server, loader, builder := createTestDriftServer(t, "drift-detect", false)
+	loader.creates = 2
+
+	status := server.checkDrift("master")
+
+	assert.Equal(t, driftOutcomeDrifted, status.Outcome)
+	assert.Equal(t, "drift-detect", status.Target)
+	assert.Equal(t, "refs/heads/master", status.Ref)
+	assert.Equal(t, "mock-revision", status.Sha)
+	assert.Equal(t, 2, status.Plan.Creates)
+	assert.Nil(t, status.Stats)
+	assert.Equal(t, []LoadOptions{{Revision: "mock-revision", PlanOnly: true}}, loader.loads)
+	builder.AssertCalled(t, "build", driftTestRepository, "sha-1")
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(driftEntities.WithLabelValues("drift-detect", "create")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(driftChecks.WithLabelValues("drift-detect", driftOutcomeDrifted)))
+
+	resp := httptest.NewRecorder()
+	server.handleDrift(resp, httptest.NewRequest("GET", "/drift", nil))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	resp = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/drift", nil)
+	req.Header.Set("Authorization", "Bearer reload-token")
+	server.handleDrift(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var statuses []*DriftStatus
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &statuses))
+	require.Len(t, statuses, 1)
+	assert.Equal(t, driftOutcomeDrifted, statuses[0].Outcome)
+	assert.Equal(t, 2, statuses[0].Plan.Creates)
+}
+
+func TestWebhookServer_checkDrift_InSync(t *testing.T) {
+	server, loader, _ := createTestDriftServer(t, "drift-in-sync", true)
+
+	status := server.checkDrift("master")
+
+	assert.Equal(t, driftOutcomeInSync, status.Outcome)
+	// nothing to apply
+	assert.Len(t, loader.loads, 1)
+	assert.Equal(t, float64(0), testutil.ToFloat64(driftEntities.WithLabelValues("drift-in-sync", "create")))
+}
+
+func TestWebhookServer_checkDrift_Apply(t *testing.T) {
+	server, loader, _ := createTestDriftServer(t, "drift-apply", true)
+	loader.creates = 1
+
+	status := server.checkDrift("master")
+
+	assert.Equal(t, driftOutcomeReconciled, status.Outcome)
+	require.NotNil(t, status.Stats)
+	assert.Equal(t, 1, status.Stats.Created)
+	require.Len(t, loader.loads, 2)
+	assert.Equal(t, LoadOptions{Revision: "mock-revision", ExpectedFingerprint: "fp-1"}, loader.loads[1])
+}
+
+func TestWebhookServer_checkDrift_ExceedsGuardrails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-drift")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTestContent(t, dir, "zones", "dfw.json", `{"name":"public/dfw"}`)
+	writeTestContent(t, dir, "zones", "ord.json", `{"name":"public/ord"}`)
+
+	var posted int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "POST" {
+			posted++
+		}
+		_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+	}))
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL, MaxCreates: 1})
+	require.NoError(t, err)
+	server, _, _ := createTestDriftServer(t, "drift-guardrails", true)
+	server.router.Targets()[0].Loader = loader
+	server.gitContentBuilder = func(repository string, sha string) SourceContent {
+		return NewSourceContentFromDir(zap.NewNop().Sugar(), dir)
+	}
+
+	status := server.checkDrift("master")
+
+	// reported rather than failed, but not applied
+	assert.Equal(t, driftOutcomeDrifted, status.Outcome)
+	assert.Empty(t, status.Error)
+	require.NotNil(t, status.Plan)
+	assert.Equal(t, 2, status.Plan.Creates)
+	assert.Equal(t, []string{"the load would create 2 entities, more than the limit of 1"}, status.Plan.Violations)
+	assert.Nil(t, status.Stats)
+	assert.Equal(t, 0, posted)
+}
+
+func TestWebhookServer_checkDrift_ApprovalTargetOnlyDetects(t *testing.T) {
+	server, loader, _ := createTestDriftServer(t, "drift-approval", true)
+	server.router.Targets()[0].RequireApproval = true
+	loader.creates = 1
+
+	status := server.checkDrift("master")
+
+	assert.Equal(t, driftOutcomeDrifted, status.Outcome)
+	assert.Len(t, loader.loads, 1)
+}
+
+func TestWebhookServer_reconcileDrift_ChecksAtStartup(t *testing.T) {
+	server, loader, _ := createTestDriftServer(t, "drift-startup", false)
+	server.drift.config.Interval = time.Hour
+	loader.creates = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.reconcileDrift(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		server.drift.mutex.Lock()
+		defer server.drift.mutex.Unlock()
+		return server.drift.statuses["master"] != nil
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+	assert.Len(t, loader.loads, 1)
+}
+
+func TestWebhookServer_checkDrift_ResolveFailed(t *testing.T) {
+	server, loader, _ := createTestDriftServer(t, "drift-failed", false)
+	server.drift.refResolver = func(repository string, ref string) (string, string, error) {
+		return "", "", errors.New("unable to list refs")
+	}
+
+	status := server.checkDrift("master")
+
+	assert.Equal(t, driftOutcomeFailed, status.Outcome)
+	assert.Equal(t, "unable to list refs", status.Error)
+	assert.Empty(t, loader.loads)
+}
+
+func createTestDriftServer(t *testing.T, targetName string, apply bool) (*WebhookServer, *planningLoader, *MockGitContentBuilder) {
+	loader := &planningLoader{fingerprint: "fp-1"}
+	router, err := NewSingleTargetRouter(loader, nil)
+	require.NoError(t, err)
+	// distinct names keep the metrics of each test apart
+	router.Targets()[0].Name = targetName
+
+	sourceContent := new(MockSourceContent)
+	sourceContent.On("Prepare").Return(mockContentPath, nil)
+	sourceContent.On("Cleanup").Return()
+	builder := &MockGitContentBuilder{sourceContent: sourceContent}
+	builder.On("build", mock.Anything, mock.Anything).Return(sourceContent)
+
+	server := NewWebhookServer(zap.NewNop().Sugar(), router, 8080, builder.build, "")
+	server.SetupReload("reload-token", nil)
+	server.SetupDrift(DriftConfig{
+		Repository: driftTestRepository,
+		Refs:       []string{"master"},
+		Interval:   time.Minute,
+		Apply:      apply,
+	}, func(repository string, ref string) (string, string, error) {
+		return "refs/heads/" + ref, "sha-1", nil
+	})
+	return server, loader, builder
+}
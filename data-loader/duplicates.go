@@ -0,0 +1,112 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// findDuplicateKeys reads the content files of a definition and returns the paths, relative
+// to the source content, of files that share unique field values. Each group of colliding
+// paths is sorted and the groups are ordered by their first path. Tombstones of the same
+// entity don't collide with each other. Files whose unique fields can't be determined
+// without the Admin API, such as references, are left for loading to report.
+func findDuplicateKeys(definition LoaderDefinition, sourceContentPath string, filter *contentFilter,
+	decryptor *ContentDecryptor, secrets *SecretSources) ([][]string, error) {
+
+	definitionPath := filepath.Join(sourceContentPath, definition.Name)
+	if _, err := os.Stat(definitionPath); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	// unique field key to the paths of the live content and tombstones that declared it
+	live := make(map[string][]string)
+	tombstones := make(map[string][]string)
+
+	err := walkContentFiles(sourceContentPath, definitionPath, filter,
+		func(path string, relPath string) error {
+			key, tombstone, ok := contentFileKey(definition, decryptor, secrets, path)
+			if !ok {
+				return nil
+			}
+			if tombstone {
+				tombstones[key] = append(tombstones[key], relPath)
+			} else {
+				live[key] = append(live[key], relPath)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk content of %s: %w", definition.Name, err)
+	}
+
+	var duplicates [][]string
+	for key, paths := range live {
+		paths = append(paths, tombstones[key]...)
+		if len(paths) > 1 {
+			sort.Strings(paths)
+			duplicates = append(duplicates, paths)
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		return duplicates[i][0] < duplicates[j][0]
+	})
+	return duplicates, nil
+}
+
+// contentFileKey returns the unique field key of a content file and whether it is a tombstone.
+// It is not ok when the file can't be decoded or its unique fields aren't plain values.
+func contentFileKey(definition LoaderDefinition, decryptor *ContentDecryptor, secrets *SecretSources,
+	path string) (key string, tombstone bool, ok bool) {
+	decoded, err := decryptor.decodeContentFile(path)
+	if err != nil || decoded.content == nil {
+		return "", false, false
+	}
+	content, err := secrets.resolveSecrets(decoded.content)
+	if err != nil {
+		return "", false, false
+	}
+	tombstone, err = isTombstone(content)
+	if err != nil {
+		return "", false, false
+	}
+	fieldValues, err := extractFieldValues(definition, content)
+	if err != nil {
+		return "", false, false
+	}
+	for _, value := range fieldValues {
+		if isSopsEncrypted(value) || isEntityRef(value) {
+			return "", false, false
+		}
+	}
+	return UniquenessTracker{}.formKey(fieldValues), tombstone, true
+}
+
+// duplicateKeysError describes groups of content files that share unique field values
+type duplicateKeysError [][]string
+
+func (e duplicateKeysError) Error() string {
+	groups := make([]string, len(e))
+	for i, paths := range e {
+		groups[i] = strings.Join(paths, ", ")
+	}
+	return fmt.Sprintf("content files have the same unique field values: %s", strings.Join(groups, "; "))
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestFindDuplicateKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-duplicates")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	release := `{"type":"TELEGRAF","version":"1.13.2","labels":{"agent_discovered_os":"linux","agent_discovered_arch":"amd64"}}`
+	writeTestContent(t, dir, "agent-releases", "a.json", release)
+	writeTestContent(t, dir, "agent-releases", "nested/b.json", release)
+	writeTestContent(t, dir, "agent-releases", "c.json",
+		`{"type":"TELEGRAF","version":"1.13.2","labels":{"agent_discovered_os":"linux","agent_discovered_arch":"arm64"}}`)
+	writeTestContent(t, dir, "zones", "dfw.json", `{"name":"public/dfw"}`)
+	writeTestContent(t, dir, "zones", "dfw-removed.json", `{"name":"public/dfw","$delete":true}`)
+	writeTestContent(t, dir, "zones", "ord-removed.json", `{"name":"public/ord","$delete":true}`)
+	writeTestContent(t, dir, "zones", "ord-removed-again.json", `{"name":"public/ord","$delete":true}`)
+
+	duplicates, err := findDuplicateKeys(*findLoaderDefinition("agent-releases"), dir, nil, &ContentDecryptor{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{
+		"agent-releases/a.json",
+		"agent-releases/nested/b.json",
+	}}, duplicates)
+
+	duplicates, err = findDuplicateKeys(*findLoaderDefinition("zones"), dir, nil, &ContentDecryptor{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{
+		"zones/dfw-removed.json",
+		"zones/dfw.json",
+	}}, duplicates)
+
+	duplicates, err = findDuplicateKeys(*findLoaderDefinition("monitor-templates"), dir, nil, &ContentDecryptor{}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, duplicates)
+}
+
+func TestLoaderImpl_LoadAll_DuplicateKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-duplicates")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTestContent(t, dir, "zones", "a.json", `{"name":"public/dfw"}`)
+	writeTestContent(t, dir, "zones", "b.json", `{"name":"public/dfw"}`)
+	writeTestContent(t, dir, "monitor-templates", "cpu.json", `{"name":"cpu"}`)
+
+	var posted []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			posted = append(posted, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+	}))
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL})
+	require.NoError(t, err)
+
+	stats, err := loader.LoadAll(context.Background(), dir, LoadOptions{})
+	require.Error(t, err)
+
+	assert.Equal(t, []string{"/api/monitor-templates"}, posted)
+	assert.Equal(t, "content files have the same unique field values: zones/a.json, zones/b.json",
+		stats.Definitions["zones"].Error)
+}
+
+func TestLoaderImpl_LoadAll_TracksCreated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-duplicates")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the keys are only known once the references are resolved, so pre-flight can't catch them
+	ref := `{"$ref":{"definition":"zones","key":{"name":"public/dfw"}}}`
+	writeTestContent(t, dir, "tenant-metadata", "a.json", `{"tenantId":`+ref+`,"key":"k","value":"a"}`)
+	writeTestContent(t, dir, "tenant-metadata", "b.json", `{"tenantId":`+ref+`,"key":"k","value":"b"}`)
+
+	var posted int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/zones":
+			_, _ = w.Write([]byte(`{"content":[{"id":"z-1","name":"public/dfw"}],"last":true}`))
+		case r.Method == "GET" && r.URL.Path == "/api/tenant-metadata/z-1":
+			http.NotFound(w, r)
+		case r.Method == "POST":
+			posted++
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+		}
+	}))
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL})
+	require.NoError(t, err)
+
+	stats, err := loader.LoadAll(context.Background(), dir, LoadOptions{
+		Definitions: []string{"tenant-metadata"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, posted)
+	assert.Equal(t, 1, stats.Created)
+	assert.Equal(t, 1, stats.SkippedExisting)
+}
@@ -0,0 +1,597 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	jsonFileExt     = ".json"
+	yamlFileExt     = ".yaml"
+	ymlFileExt      = ".yml"
+	ageFileExt      = ".age"
+	ageArmorHeader  = "-----BEGIN AGE ENCRYPTED FILE-----"
+	sopsMetadataKey = "sops"
+)
+
+var errNoDecryptionKey = errors.New("content is encrypted, but no decryption key is configured")
+
+// errSopsMacMismatch conveys that values of a SOPS file were changed, added, or removed
+// after it was encrypted
+var errSopsMacMismatch = errors.New("SOPS MAC doesn't match the content, which was changed after encryption")
+
+var sopsValuePattern = regexp.MustCompile(`^ENC\[AES256_GCM,data:([^,]*),iv:([^,]+),tag:([^,]+),type:(\w+)]$`)
+
+// ContentDecryptor decrypts content files that are either wholly encrypted with age, named
+// with a .json.age extension, or JSON or YAML files with SOPS encrypted values whose data key
+// is encrypted for an age recipient. Decryption only happens in memory.
+type ContentDecryptor struct {
+	identities []age.Identity
+}
+
+// decodedContent is the content of a source content file
+type decodedContent struct {
+	content interface{}
+	// encrypted indicates the file was encrypted, so its decrypted content must not be logged
+	encrypted bool
+	// locked indicates the file is encrypted, but there is no key, so content is nil for age
+	// files and still holds encrypted values for SOPS files
+	locked bool
+	// hash is the hex encoded SHA-256 of the file as stored
+	hash string
+}
+
+// NewContentDecryptor parses the age identities in the given key file and key, where both
+// are optional. Without identities, only unencrypted content can be read.
+func NewContentDecryptor(keyFile string, key string) (*ContentDecryptor, error) {
+	decryptor := &ContentDecryptor{}
+
+	if keyFile != "" {
+		file, err := os.Open(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open age key file: %w", err)
+		}
+		defer file.Close()
+
+		identities, err := age.ParseIdentities(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse age key file: %w", err)
+		}
+		decryptor.identities = append(decryptor.identities, identities...)
+	}
+
+	if key != "" {
+		identities, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			// errors can quote the key, so don't wrap
+			return nil, errors.New("failed to parse age key")
+		}
+		decryptor.identities = append(decryptor.identities, identities...)
+	}
+
+	return decryptor, nil
+}
+
+// isContentFile reports whether the path is a JSON content file, which may be age encrypted,
+// or a YAML content file
+func isContentFile(path string) bool {
+	return strings.HasSuffix(path, jsonFileExt) || strings.HasSuffix(path, jsonFileExt+ageFileExt) ||
+		isYamlFile(path)
+}
+
+func isYamlFile(path string) bool {
+	return strings.HasSuffix(path, yamlFileExt) || strings.HasSuffix(path, ymlFileExt)
+}
+
+// readContentFile decodes the content file, decrypting it if needed
+func (d *ContentDecryptor) readContentFile(path string) (*decodedContent, error) {
+	decoded, err := d.decodeContentFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if decoded.locked {
+		return nil, errNoDecryptionKey
+	}
+	return decoded, nil
+}
+
+// decodeContentFile decodes the content file and decrypts it, if possible
+func (d *ContentDecryptor) decodeContentFile(path string) (*decodedContent, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source content file: %w", err)
+	}
+	hash := hashContent(raw)
+
+	if strings.HasSuffix(path, ageFileExt) {
+		if len(d.identities) == 0 {
+			return &decodedContent{encrypted: true, locked: true, hash: hash}, nil
+		}
+		plaintext, err := d.decryptAge(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		content, err := decodeJson(bytes.NewReader(plaintext))
+		if err != nil {
+			return nil, err
+		}
+		return &decodedContent{content: content, encrypted: true, hash: hash}, nil
+	}
+
+	yamlFormat := isYamlFile(path)
+	content, err := decodeContent(raw, yamlFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	contentMap, ok := content.(map[string]interface{})
+	if !ok {
+		return &decodedContent{content: content, hash: hash}, nil
+	}
+	metadata, isSops := contentMap[sopsMetadataKey]
+	if !isSops {
+		return &decodedContent{content: content, hash: hash}, nil
+	}
+	delete(contentMap, sopsMetadataKey)
+
+	if len(d.identities) == 0 {
+		return &decodedContent{content: content, encrypted: true, locked: true, hash: hash}, nil
+	}
+	dataKey, err := d.sopsDataKey(metadata)
+	if err != nil {
+		return nil, err
+	}
+	err = verifySopsMac(raw, yamlFormat, metadata, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := decryptSopsValues(contentMap, dataKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt SOPS values: %w", err)
+	}
+	return &decodedContent{content: decrypted, encrypted: true, hash: hash}, nil
+}
+
+// decodeContent decodes JSON or YAML content, where YAML is decoded into the same types as
+// JSON
+func decodeContent(raw []byte, yamlFormat bool) (interface{}, error) {
+	if !yamlFormat {
+		return decodeJson(bytes.NewReader(raw))
+	}
+
+	var content interface{}
+	err := yaml.Unmarshal(raw, &content)
+	if err == nil {
+		// round trip through JSON to convert numbers and timestamps
+		var encoded []byte
+		encoded, err = json.Marshal(content)
+		if err == nil {
+			return decodeJson(bytes.NewReader(encoded))
+		}
+	}
+	return nil, fmt.Errorf("failed to decode source content: %w", err)
+}
+
+// hashContent is the hex encoded SHA-256 of a content file as stored
+func hashContent(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func decodeJson(reader io.Reader) (interface{}, error) {
+	var content interface{}
+	err := json.NewDecoder(reader).Decode(&content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode source content: %w", err)
+	}
+	return content, nil
+}
+
+// decryptAge decrypts binary or armored age content
+func (d *ContentDecryptor) decryptAge(encrypted io.Reader) ([]byte, error) {
+	buffered := bufio.NewReader(encrypted)
+	start, _ := buffered.Peek(len(ageArmorHeader))
+	var source io.Reader = buffered
+	if string(start) == ageArmorHeader {
+		source = armor.NewReader(buffered)
+	}
+
+	decrypted, err := age.Decrypt(source, d.identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt age content: %w", err)
+	}
+	plaintext, err := ioutil.ReadAll(decrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt age content: %w", err)
+	}
+	return plaintext, nil
+}
+
+// sopsDataKey decrypts the data key from the first age recipient entry of the SOPS metadata
+// that one of the identities can decrypt
+func (d *ContentDecryptor) sopsDataKey(metadata interface{}) ([]byte, error) {
+	var sopsMetadata struct {
+		Age []struct {
+			Recipient string `json:"recipient"`
+			Enc       string `json:"enc"`
+		} `json:"age"`
+	}
+	// round trip through JSON to pick out the fields
+	encoded, err := json.Marshal(metadata)
+	if err == nil {
+		err = json.Unmarshal(encoded, &sopsMetadata)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOPS metadata: %w", err)
+	}
+	if len(sopsMetadata.Age) == 0 {
+		return nil, errors.New("SOPS metadata has no age recipients")
+	}
+
+	var lastErr error
+	for _, entry := range sopsMetadata.Age {
+		dataKey, err := d.decryptAge(strings.NewReader(entry.Enc))
+		if err == nil {
+			return dataKey, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("failed to decrypt SOPS data key: %w", lastErr)
+}
+
+// decryptSopsValues returns a copy of the content where each SOPS encrypted value is
+// decrypted, where path is the key path used as additional authenticated data
+func decryptSopsValues(content interface{}, dataKey []byte, path []string) (interface{}, error) {
+	switch v := content.(type) {
+	case map[string]interface{}:
+		decrypted := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			// copy the path so that siblings don't share appended elements
+			valuePath := append(append([]string{}, path...), key)
+			decryptedValue, err := decryptSopsValues(value, dataKey, valuePath)
+			if err != nil {
+				return nil, err
+			}
+			decrypted[key] = decryptedValue
+		}
+		return decrypted, nil
+
+	case []interface{}:
+		// SOPS does not include list indices in the path
+		decrypted := make([]interface{}, len(v))
+		for i, value := range v {
+			decryptedValue, err := decryptSopsValues(value, dataKey, path)
+			if err != nil {
+				return nil, err
+			}
+			decrypted[i] = decryptedValue
+		}
+		return decrypted, nil
+
+	case string:
+		if !isSopsEncrypted(v) {
+			return v, nil
+		}
+		decrypted, err := decryptSopsValue(v, dataKey, sopsAdditionalData(path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", strings.Join(path, "."), err)
+		}
+		return decrypted, nil
+
+	default:
+		return content, nil
+	}
+}
+
+func isSopsEncrypted(value interface{}) bool {
+	str, ok := value.(string)
+	return ok && sopsValuePattern.MatchString(str)
+}
+
+// sopsAdditionalData is the additional authenticated data of a value at the key path
+func sopsAdditionalData(path []string) string {
+	return strings.Join(path, ":") + ":"
+}
+
+func decryptSopsValue(value string, dataKey []byte, additionalData string) (interface{}, error) {
+	plaintext, valueType, err := openSopsValue(value, dataKey, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	switch valueType {
+	case "str", "bytes":
+		return string(plaintext), nil
+	case "int", "float":
+		// consistent with decoding JSON numbers into interface{}
+		number, err := strconv.ParseFloat(string(plaintext), 64)
+		if err != nil {
+			// parse errors quote the value, so don't wrap
+			return nil, fmt.Errorf("decrypted value is not a valid %s", valueType)
+		}
+		return number, nil
+	case "bool":
+		b, err := strconv.ParseBool(string(plaintext))
+		if err != nil {
+			return nil, fmt.Errorf("decrypted value is not a valid %s", valueType)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unsupported value type %s", valueType)
+	}
+}
+
+// openSopsValue decrypts and authenticates the SOPS encrypted value, returning its plaintext
+// and type
+func openSopsValue(value string, dataKey []byte, additionalData string) ([]byte, string, error) {
+	matches := sopsValuePattern.FindStringSubmatch(value)
+	if matches == nil {
+		return nil, "", errors.New("value is not SOPS encrypted")
+	}
+	data, err := base64.StdEncoding.DecodeString(matches[1])
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid data encoding: %w", err)
+	}
+	iv, err := base64.StdEncoding.DecodeString(matches[2])
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid iv encoding: %w", err)
+	}
+	tag, err := base64.StdEncoding.DecodeString(matches[3])
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid tag encoding: %w", err)
+	}
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid data key: %w", err)
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid iv: %w", err)
+	}
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to authenticate value: %w", err)
+	}
+	return plaintext, matches[4], nil
+}
+
+// verifySopsMac recomputes the MAC of the file's values the way SOPS does, which is a SHA-512
+// of every value in document order, or only the encrypted ones when mac_only_encrypted is set,
+// and compares it with the MAC of the metadata, which is encrypted with the last modified
+// time as additional data
+func verifySopsMac(raw []byte, yamlFormat bool, metadata interface{}, dataKey []byte) error {
+	var sopsMetadata struct {
+		Mac              string `json:"mac"`
+		LastModified     string `json:"lastmodified"`
+		MacOnlyEncrypted bool   `json:"mac_only_encrypted"`
+	}
+	// round trip through JSON to pick out the fields
+	encoded, err := json.Marshal(metadata)
+	if err == nil {
+		err = json.Unmarshal(encoded, &sopsMetadata)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid SOPS metadata: %w", err)
+	}
+	if sopsMetadata.Mac == "" {
+		return errors.New("SOPS metadata has no mac")
+	}
+	lastModified, err := time.Parse(time.RFC3339, sopsMetadata.LastModified)
+	if err != nil {
+		return fmt.Errorf("invalid SOPS lastmodified: %w", err)
+	}
+	expected, _, err := openSopsValue(sopsMetadata.Mac, dataKey, lastModified.Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt SOPS mac: %w", err)
+	}
+
+	leaves, err := sopsLeaves(raw, yamlFormat)
+	if err != nil {
+		return fmt.Errorf("failed to read SOPS values: %w", err)
+	}
+	hash := sha512.New()
+	for _, leaf := range leaves {
+		var leafBytes []byte
+		if isSopsEncrypted(leaf.value) {
+			leafBytes, _, err = openSopsValue(leaf.value.(string), dataKey, sopsAdditionalData(leaf.path))
+			if err != nil {
+				return fmt.Errorf("failed to decrypt %s: %w", strings.Join(leaf.path, "."), err)
+			}
+		} else if sopsMetadata.MacOnlyEncrypted {
+			continue
+		} else {
+			leafBytes, err = sopsValueBytes(leaf.value)
+			if err != nil {
+				return fmt.Errorf("invalid value of %s: %w", strings.Join(leaf.path, "."), err)
+			}
+		}
+		hash.Write(leafBytes)
+	}
+
+	computed := strings.ToUpper(hex.EncodeToString(hash.Sum(nil)))
+	if subtle.ConstantTimeCompare([]byte(computed), expected) != 1 {
+		return errSopsMacMismatch
+	}
+	return nil
+}
+
+// sopsValueBytes converts an unencrypted value to the bytes SOPS hashes, which are nil for
+// null values
+func sopsValueBytes(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []byte(v), nil
+	case int:
+		return []byte(strconv.Itoa(v)), nil
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64)), nil
+	case bool:
+		if v {
+			return []byte("True"), nil
+		}
+		return []byte("False"), nil
+	default:
+		return nil, fmt.Errorf("unsupported type %T", value)
+	}
+}
+
+// sopsLeaf is a scalar value of a SOPS file and the path of keys leading to it
+type sopsLeaf struct {
+	path  []string
+	value interface{}
+}
+
+// sopsLeaves returns the scalar values of the file, other than its SOPS metadata, in document
+// order, which decoding into maps doesn't retain
+func sopsLeaves(raw []byte, yamlFormat bool) ([]sopsLeaf, error) {
+	var leaves []sopsLeaf
+	if yamlFormat {
+		var document yaml.Node
+		err := yaml.Unmarshal(raw, &document)
+		if err != nil {
+			return nil, err
+		}
+		err = yamlLeaves(&document, nil, true, &leaves)
+		return leaves, err
+	}
+
+	err := jsonLeaves(json.NewDecoder(bytes.NewReader(raw)), nil, true, &leaves)
+	return leaves, err
+}
+
+func jsonLeaves(decoder *json.Decoder, path []string, top bool, leaves *[]sopsLeaf) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		for decoder.More() {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := keyToken.(string)
+			if top && key == sopsMetadataKey {
+				var skipped interface{}
+				if err := decoder.Decode(&skipped); err != nil {
+					return err
+				}
+				continue
+			}
+			// copy the path so that siblings don't share appended elements
+			err = jsonLeaves(decoder, append(append([]string{}, path...), key), false, leaves)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+		return err
+
+	case json.Delim('['):
+		// SOPS does not include list indices in the path
+		for decoder.More() {
+			if err := jsonLeaves(decoder, path, false, leaves); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+		return err
+
+	default:
+		*leaves = append(*leaves, sopsLeaf{path: path, value: token})
+		return nil
+	}
+}
+
+func yamlLeaves(node *yaml.Node, path []string, top bool, leaves *[]sopsLeaf) error {
+	// SOPS encrypts and hashes comments as values of their own
+	if node.HeadComment != "" || node.LineComment != "" || node.FootComment != "" {
+		return errors.New("SOPS YAML files with comments are not supported")
+	}
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			if err := yamlLeaves(child, path, top, leaves); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if top && key.Value == sopsMetadataKey {
+				continue
+			}
+			if key.HeadComment != "" || key.LineComment != "" || key.FootComment != "" {
+				return errors.New("SOPS YAML files with comments are not supported")
+			}
+			err := yamlLeaves(value, append(append([]string{}, path...), key.Value), false, leaves)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := yamlLeaves(child, path, false, leaves); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case yaml.AliasNode:
+		return yamlLeaves(node.Alias, path, top, leaves)
+
+	default:
+		var value interface{}
+		if err := node.Decode(&value); err != nil {
+			return err
+		}
+		*leaves = append(*leaves, sopsLeaf{path: path, value: value})
+		return nil
+	}
+}
@@ -0,0 +1,341 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func ageEncrypt(t *testing.T, recipient age.Recipient, plaintext []byte, armored bool) []byte {
+	var out bytes.Buffer
+	var dst io.Writer = &out
+	var armorWriter io.WriteCloser
+	if armored {
+		armorWriter = armor.NewWriter(&out)
+		dst = armorWriter
+	}
+
+	w, err := age.Encrypt(dst, recipient)
+	require.NoError(t, err)
+	_, err = w.Write(plaintext)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	if armorWriter != nil {
+		require.NoError(t, armorWriter.Close())
+	}
+	return out.Bytes()
+}
+
+// sopsEncrypt encrypts a value the same way as SOPS
+func sopsEncrypt(t *testing.T, dataKey []byte, value string, valueType string, additionalData string) string {
+	block, err := aes.NewCipher(dataKey)
+	require.NoError(t, err)
+	iv := make([]byte, 32)
+	_, err = rand.Read(iv)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	require.NoError(t, err)
+
+	sealed := gcm.Seal(nil, iv, []byte(value), []byte(additionalData))
+	data, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]",
+		base64.StdEncoding.EncodeToString(data),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(tag),
+		valueType)
+}
+
+// sopsMac encrypts the MAC of the plaintext values, in document order, the same way as SOPS
+func sopsMac(t *testing.T, dataKey []byte, lastModified string, values ...string) string {
+	hash := sha512.New()
+	for _, value := range values {
+		hash.Write([]byte(value))
+	}
+	return sopsEncrypt(t, dataKey, strings.ToUpper(hex.EncodeToString(hash.Sum(nil))), "str", lastModified)
+}
+
+// sopsTestMetadata creates the SOPS metadata of a data key encrypted for the identity
+func sopsTestMetadata(t *testing.T, identity *age.X25519Identity, dataKey []byte, mac string) map[string]interface{} {
+	return map[string]interface{}{
+		"age": []interface{}{
+			map[string]interface{}{
+				"recipient": identity.Recipient().String(),
+				"enc":       string(ageEncrypt(t, identity.Recipient(), dataKey, true)),
+			},
+		},
+		"lastmodified": "2020-11-02T15:04:05Z",
+		"mac":          mac,
+		"version":      "3.6.1",
+	}
+}
+
+// writeSopsContent writes a SOPS encrypted tenant-metadata file whose value is encrypted and
+// returns the data key
+func writeSopsContent(t *testing.T, path string, identity *age.X25519Identity) []byte {
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	require.NoError(t, err)
+
+	metadata, err := json.Marshal(sopsTestMetadata(t, identity, dataKey,
+		sopsMac(t, dataKey, "2020-11-02T15:04:05Z", "t-1", "db", "hunter2", "5432")))
+	require.NoError(t, err)
+	// written by hand since the MAC depends on the order of the values
+	content := fmt.Sprintf(`{"tenantId":"t-1","key":"db","value":{"password":%q,"ports":[%q]},"sops":%s}`,
+		sopsEncrypt(t, dataKey, "hunter2", "str", "value:password:"),
+		sopsEncrypt(t, dataKey, "5432", "int", "value:ports:"),
+		metadata)
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return dataKey
+}
+
+func hashTestFile(t *testing.T, path string) string {
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestContentDecryptor_readContentFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-encryption")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	decryptor, err := NewContentDecryptor("", identity.String())
+	require.NoError(t, err)
+
+	plain := filepath.Join(dir, "plain.json")
+	require.NoError(t, ioutil.WriteFile(plain, []byte(`{"name":"plain"}`), 0644))
+	binaryAge := filepath.Join(dir, "binary.json.age")
+	require.NoError(t, ioutil.WriteFile(binaryAge,
+		ageEncrypt(t, identity.Recipient(), []byte(`{"name":"binary"}`), false), 0644))
+	armoredAge := filepath.Join(dir, "armored.json.age")
+	require.NoError(t, ioutil.WriteFile(armoredAge,
+		ageEncrypt(t, identity.Recipient(), []byte(`{"name":"armored"}`), true), 0644))
+	sops := filepath.Join(dir, "sops.json")
+	writeSopsContent(t, sops, identity)
+
+	decoded, err := decryptor.readContentFile(plain)
+	require.NoError(t, err)
+	assert.Equal(t, &decodedContent{content: map[string]interface{}{"name": "plain"},
+		hash: hashTestFile(t, plain)}, decoded)
+
+	decoded, err = decryptor.readContentFile(binaryAge)
+	require.NoError(t, err)
+	assert.Equal(t, &decodedContent{content: map[string]interface{}{"name": "binary"}, encrypted: true,
+		hash: hashTestFile(t, binaryAge)}, decoded)
+
+	decoded, err = decryptor.readContentFile(armoredAge)
+	require.NoError(t, err)
+	assert.Equal(t, &decodedContent{content: map[string]interface{}{"name": "armored"}, encrypted: true,
+		hash: hashTestFile(t, armoredAge)}, decoded)
+
+	decoded, err = decryptor.readContentFile(sops)
+	require.NoError(t, err)
+	assert.Equal(t, &decodedContent{
+		content: map[string]interface{}{
+			"tenantId": "t-1",
+			"key":      "db",
+			"value": map[string]interface{}{
+				"password": "hunter2",
+				"ports":    []interface{}{float64(5432)},
+			},
+		},
+		encrypted: true,
+		hash:      hashTestFile(t, sops),
+	}, decoded)
+}
+
+func TestContentDecryptor_NoKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-encryption")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	sops := filepath.Join(dir, "sops.json")
+	writeSopsContent(t, sops, identity)
+
+	decryptor, err := NewContentDecryptor("", "")
+	require.NoError(t, err)
+
+	_, err = decryptor.readContentFile(sops)
+	assert.Equal(t, errNoDecryptionKey, err)
+
+	// unencrypted values are still available for validation
+	decoded, err := decryptor.decodeContentFile(sops)
+	require.NoError(t, err)
+	assert.True(t, decoded.locked)
+	content := decoded.content.(map[string]interface{})
+	assert.Equal(t, "t-1", content["tenantId"])
+	assert.NotContains(t, content, "sops")
+}
+
+func TestContentDecryptor_WrongKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-encryption")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	sops := filepath.Join(dir, "sops.json")
+	writeSopsContent(t, sops, identity)
+
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	keyFile := filepath.Join(dir, "keys.txt")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("# other key\n"+other.String()+"\n"), 0600))
+
+	decryptor, err := NewContentDecryptor(keyFile, "")
+	require.NoError(t, err)
+
+	_, err = decryptor.readContentFile(sops)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to decrypt SOPS data key")
+}
+
+func TestContentDecryptor_SopsMac(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-encryption")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	decryptor, err := NewContentDecryptor("", identity.String())
+	require.NoError(t, err)
+
+	sops := filepath.Join(dir, "sops.json")
+	writeSopsContent(t, sops, identity)
+	original, err := ioutil.ReadFile(sops)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		modify func(content string) string
+		err    string
+	}{
+		{
+			name: "changed plaintext value",
+			modify: func(content string) string {
+				return strings.Replace(content, `"key":"db"`, `"key":"other"`, 1)
+			},
+			err: errSopsMacMismatch.Error(),
+		},
+		{
+			name: "removed encrypted value",
+			modify: func(content string) string {
+				start := strings.Index(content, `,"ports"`)
+				end := strings.Index(content, `]}`)
+				return content[:start] + content[end+1:]
+			},
+			err: errSopsMacMismatch.Error(),
+		},
+		{
+			name: "reordered values",
+			modify: func(content string) string {
+				return strings.Replace(content, `"tenantId":"t-1","key":"db"`, `"key":"db","tenantId":"t-1"`, 1)
+			},
+			err: errSopsMacMismatch.Error(),
+		},
+		{
+			name: "removed mac",
+			modify: func(content string) string {
+				start := strings.Index(content, `"mac":`)
+				end := strings.Index(content[start:], `",`)
+				return content[:start] + content[start+end+2:]
+			},
+			err: "SOPS metadata has no mac",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, ioutil.WriteFile(sops, []byte(tt.modify(string(original))), 0644))
+			_, err := decryptor.readContentFile(sops)
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestContentDecryptor_Yaml(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-encryption")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	decryptor, err := NewContentDecryptor("", identity.String())
+	require.NoError(t, err)
+
+	plain := filepath.Join(dir, "plain.yaml")
+	require.NoError(t, ioutil.WriteFile(plain, []byte("name: plain\nport: 5432\n"), 0644))
+	decoded, err := decryptor.readContentFile(plain)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "plain", "port": float64(5432)}, decoded.content)
+
+	dataKey := make([]byte, 32)
+	_, err = rand.Read(dataKey)
+	require.NoError(t, err)
+	metadata, err := json.Marshal(sopsTestMetadata(t, identity, dataKey,
+		sopsMac(t, dataKey, "2020-11-02T15:04:05Z", "t-1", "5432", "hunter2", "True")))
+	require.NoError(t, err)
+	// JSON is also YAML
+	content := fmt.Sprintf("tenantId: t-1\nport: 5432\nvalue:\n  password: %s\n  enabled: true\nsops: %s\n",
+		sopsEncrypt(t, dataKey, "hunter2", "str", "value:password:"), metadata)
+	sops := filepath.Join(dir, "sops.yml")
+	require.NoError(t, ioutil.WriteFile(sops, []byte(content), 0644))
+
+	decoded, err = decryptor.readContentFile(sops)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"tenantId": "t-1",
+		"port":     float64(5432),
+		"value":    map[string]interface{}{"password": "hunter2", "enabled": true},
+	}, decoded.content)
+	assert.True(t, decoded.encrypted)
+
+	tampered := filepath.Join(dir, "tampered.yaml")
+	require.NoError(t, ioutil.WriteFile(tampered, []byte(strings.Replace(content, "port: 5432", "port: 5433", 1)), 0644))
+	_, err = decryptor.readContentFile(tampered)
+	assert.Equal(t, errSopsMacMismatch, err)
+
+	commented := filepath.Join(dir, "commented.yaml")
+	require.NoError(t, ioutil.WriteFile(commented, []byte("# database\n"+content), 0644))
+	_, err = decryptor.readContentFile(commented)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "comments are not supported")
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	ignore "github.com/sabhiram/go-gitignore"
+	"os"
+	"path/filepath"
+)
+
+// loaderIgnoreFile at the root of the source content lists gitignore patterns of files that
+// are never loaded
+const loaderIgnoreFile = ".loaderignore"
+
+// contentFilter selects the content files to process by their path relative to the source
+// content. A nil filter selects all files.
+type contentFilter struct {
+	// ignored is nil when there is no loader ignore file
+	ignored *ignore.GitIgnore
+	// selected is nil when all files that aren't ignored are selected
+	selected *ignore.GitIgnore
+}
+
+// newContentFilter combines the loader ignore file of the source content, if any, with path
+// patterns that select files, which use the same gitignore syntax
+func newContentFilter(sourceContentPath string, paths []string) (*contentFilter, error) {
+	filter := &contentFilter{}
+
+	ignored, err := ignore.CompileIgnoreFile(filepath.Join(sourceContentPath, loaderIgnoreFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %w", loaderIgnoreFile, err)
+	}
+	filter.ignored = ignored
+
+	if len(paths) > 0 {
+		filter.selected, err = ignore.CompileIgnoreLines(paths...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path patterns: %w", err)
+		}
+	}
+
+	return filter, nil
+}
+
+// skipsDir reports whether the directory is ignored along with everything beneath it
+func (f *contentFilter) skipsDir(relPath string) bool {
+	if f == nil || f.ignored == nil {
+		return false
+	}
+	// patterns ending with a slash only match directories, which are given with a trailing slash
+	return f.ignored.MatchesPath(relPath) || f.ignored.MatchesPath(relPath+"/")
+}
+
+// includes reports whether the content file is processed
+func (f *contentFilter) includes(relPath string) bool {
+	if f == nil {
+		return true
+	}
+	if f.ignored != nil && f.ignored.MatchesPath(relPath) {
+		return false
+	}
+	return f.selected == nil || f.selected.MatchesPath(relPath)
+}
+
+// walkContentFiles walks the content files of a definition that the filter includes
+func walkContentFiles(sourceContentPath string, definitionPath string, filter *contentFilter,
+	walkFn func(path string, relPath string) error) error {
+
+	return filepath.Walk(definitionPath,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(sourceContentPath, path)
+			if err != nil {
+				return err
+			}
+			relPath = filepath.ToSlash(relPath)
+
+			if info.IsDir() {
+				if filter.skipsDir(relPath) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !isContentFile(path) || !filter.includes(relPath) {
+				return nil
+			}
+			return walkFn(path, relPath)
+		})
+}
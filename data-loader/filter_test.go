@@ -0,0 +1,123 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestContentFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-filter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, loaderIgnoreFile), []byte(`# drafts aren't ready
+drafts/
+*.wip.json
+`), 0644))
+
+	filter, err := newContentFilter(dir, nil)
+	require.NoError(t, err)
+	assert.True(t, filter.includes("zones/dfw.json"))
+	assert.False(t, filter.includes("zones/dfw.wip.json"))
+	assert.True(t, filter.skipsDir("zones/drafts"))
+	assert.False(t, filter.includes("zones/drafts/ord.json"))
+
+	filter, err = newContentFilter(dir, []string{"agent-releases/telegraf/**", "zones/ord.json"})
+	require.NoError(t, err)
+	assert.True(t, filter.includes("agent-releases/telegraf/linux/amd64.json"))
+	assert.False(t, filter.includes("agent-releases/filebeat/linux.json"))
+	assert.True(t, filter.includes("zones/ord.json"))
+	assert.False(t, filter.includes("zones/dfw.json"))
+
+	var noFilter *contentFilter
+	assert.True(t, noFilter.includes("zones/dfw.json"))
+	assert.False(t, noFilter.skipsDir("zones"))
+}
+
+func TestContentFilter_noIgnoreFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-filter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filter, err := newContentFilter(dir, nil)
+	require.NoError(t, err)
+	assert.True(t, filter.includes("zones/dfw.json"))
+}
+
+func TestLoadOptions_includes(t *testing.T) {
+	zones := *findLoaderDefinition("zones")
+	templates := *findLoaderDefinition("monitor-templates")
+
+	assert.True(t, LoadOptions{}.includes(zones))
+	assert.False(t, LoadOptions{Exclude: []string{"zones"}}.includes(zones))
+	assert.True(t, LoadOptions{Exclude: []string{"zones"}}.includes(templates))
+	assert.False(t, LoadOptions{Definitions: []string{"zones"}, Exclude: []string{"zones"}}.includes(zones))
+
+	assert.EqualError(t, LoadOptions{Exclude: []string{"unknown"}}.Validate(), "unknown loader definition: unknown")
+}
+
+func TestLoaderImpl_LoadAll_Filtered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-filter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, loaderIgnoreFile), []byte("ignored/\n"), 0644))
+	writeTestContent(t, dir, "zones", "dfw.json", `{"name":"public/dfw"}`)
+	writeTestContent(t, dir, "zones", "ord.json", `{"name":"public/ord"}`)
+	// would otherwise be a duplicate of dfw.json
+	writeTestContent(t, dir, "zones", "ignored/dfw.json", `{"name":"public/dfw"}`)
+	writeTestContent(t, dir, "monitor-templates", "cpu.json", `{"name":"cpu"}`)
+	writeTestContent(t, dir, "monitor-translations", "cpu.json", `{"monitorType":"cpu","name":"cpu"}`)
+
+	var posted []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "POST" {
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			posted = append(posted, r.URL.Path+" "+body["name"].(string))
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+	}))
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL})
+	require.NoError(t, err)
+
+	_, err = loader.LoadAll(context.Background(), dir, LoadOptions{
+		Exclude: []string{"monitor-translations"},
+		Paths:   []string{"zones/dfw.json", "monitor-templates/"},
+	})
+	require.NoError(t, err)
+
+	sort.Strings(posted)
+	assert.Equal(t, []string{"/api/monitor-templates cpu", "/api/zones public/dfw"}, posted)
+}
@@ -3,17 +3,24 @@ module github.com/racker/salus-tools/data-loader
 go 1.13
 
 require (
+	filippo.io/age v1.0.0
+	github.com/alicebob/miniredis/v2 v2.30.0
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/go-redis/redis v6.15.9+incompatible
 	github.com/google/go-github/v28 v28.1.1
 	github.com/google/subcommands v1.0.1
+	github.com/hashicorp/golang-lru v0.5.4
 	github.com/itzg/go-flagsfiller v1.4.0
+	github.com/prometheus/client_golang v1.8.0
 	github.com/racker/go-restclient v1.2.1
+	github.com/sabhiram/go-gitignore v0.0.0-20180611051255-d3107576ba94
 	github.com/stretchr/testify v1.4.0
 	github.com/yalp/jsonpath v0.0.0-20180802001716-5cc68e5049a0
+	go.etcd.io/bbolt v1.3.5
 	go.uber.org/multierr v1.4.0 // indirect
 	go.uber.org/zap v1.13.0
-	golang.org/x/crypto v0.0.0-20191117063200-497ca9f6d64f // indirect
-	golang.org/x/net v0.0.0-20191116160921-f9c825593386 // indirect
-	golang.org/x/sys v0.0.0-20191118133127-cf1e2d577169 // indirect
-	golang.org/x/tools v0.0.0-20191118051429-5a76f03bc7c3 // indirect
+	golang.org/x/oauth2 v0.0.0-20190226205417-e64efc72b421
 	gopkg.in/src-d/go-git.v4 v4.13.1
+	gopkg.in/yaml.v2 v2.3.0
+	gopkg.in/yaml.v3 v3.0.1
 )
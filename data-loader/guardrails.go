@@ -0,0 +1,112 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Guardrails limit the changes a single load may make, which protects against content
+// mistakes such as a mass rename of files. A zero limit is unlimited.
+type Guardrails struct {
+	// MaxCreates is the most entities that may be created
+	MaxCreates int
+	// MaxChangePercent is the most entities that may be created or deleted as a percent of
+	// the existing entities. It doesn't apply when there are no existing entities.
+	MaxChangePercent float64
+}
+
+// violations describes each limit exceeded by the planned changes of the subject
+func (g Guardrails) violations(subject string, existing int, creates int, deletes int) []string {
+	var violations []string
+	if g.MaxCreates > 0 && creates > g.MaxCreates {
+		violations = append(violations, fmt.Sprintf("%s would create %d entities, more than the limit of %d",
+			subject, creates, g.MaxCreates))
+	}
+	if g.MaxChangePercent > 0 && existing > 0 {
+		changePercent := float64(creates+deletes) * 100 / float64(existing)
+		if changePercent > g.MaxChangePercent {
+			violations = append(violations, fmt.Sprintf(
+				"%s would create or delete %d entities, %.1f%% of the %d existing, more than the limit of %g%%",
+				subject, creates+deletes, changePercent, existing, g.MaxChangePercent))
+		}
+	}
+	return violations
+}
+
+// LoadPlan counts the changes a load would make before any are made
+type LoadPlan struct {
+	// Existing excludes loader definitions that look up existing entities individually
+	Existing    int
+	Creates     int
+	Deletes     int
+	Definitions map[string]*DefinitionPlan
+	// Fingerprint digests the existing entities the plan was computed against
+	Fingerprint string
+	// Violations are the exceeded guardrails, which refuse applying the plan unless large
+	// changes are allowed
+	Violations []string
+}
+
+type DefinitionPlan struct {
+	// Existing is the number of existing entities, which is only those that matched content
+	// files when the definition looks up existing entities individually
+	Existing int
+	Creates  int
+	Deletes  int
+}
+
+func newLoadPlan() *LoadPlan {
+	return &LoadPlan{
+		Definitions: make(map[string]*DefinitionPlan),
+	}
+}
+
+// GuardrailError conveys that a load was refused since its plan exceeds the guardrails
+type GuardrailError struct {
+	Violations []string
+}
+
+func (e *GuardrailError) Error() string {
+	return fmt.Sprintf("load refused since it exceeds change guardrails: %s", strings.Join(e.Violations, "; "))
+}
+
+// checkGuardrails compares the plan against the guardrails of each definition and the
+// overall guardrails
+func (l *LoaderImpl) checkGuardrails(plan *LoadPlan, runs []*definitionRun) error {
+	var violations []string
+	for _, defRun := range runs {
+		guardrails := l.definitionGuardrails
+		if defRun.definition.Guardrails != nil {
+			guardrails = *defRun.definition.Guardrails
+		}
+		existing := defRun.plan.Existing
+		if defRun.definition.Lookup != nil {
+			existing = 0
+		}
+		violations = append(violations,
+			guardrails.violations(defRun.definition.Name, existing, defRun.plan.Creates, defRun.plan.Deletes)...)
+	}
+	violations = append(violations,
+		l.guardrails.violations("the load", plan.Existing, plan.Creates, plan.Deletes)...)
+
+	if len(violations) > 0 {
+		return &GuardrailError{Violations: violations}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestGuardrails_violations(t *testing.T) {
+	assert.Empty(t, Guardrails{}.violations("zones", 10, 100, 100))
+	assert.Empty(t, Guardrails{MaxCreates: 5, MaxChangePercent: 50}.violations("zones", 10, 5, 0))
+
+	assert.Equal(t, []string{"zones would create 6 entities, more than the limit of 5"},
+		Guardrails{MaxCreates: 5}.violations("zones", 10, 6, 0))
+	assert.Equal(t, []string{"zones would create or delete 6 entities, 60.0% of the 10 existing, more than the limit of 50%"},
+		Guardrails{MaxChangePercent: 50}.violations("zones", 10, 2, 4))
+	// the initial load of a definition isn't a change of existing entities
+	assert.Empty(t, Guardrails{MaxChangePercent: 50}.violations("zones", 0, 6, 0))
+}
+
+func TestLoaderImpl_checkGuardrails_DefinitionOverride(t *testing.T) {
+	loader := &LoaderImpl{definitionGuardrails: Guardrails{MaxCreates: 1}}
+	runs := []*definitionRun{
+		{
+			definition: LoaderDefinition{Name: "generous", Guardrails: &Guardrails{MaxCreates: 10}},
+			plan:       &DefinitionPlan{Creates: 5},
+		},
+		{
+			definition: LoaderDefinition{Name: "default"},
+			plan:       &DefinitionPlan{Creates: 2},
+		},
+	}
+
+	err := loader.checkGuardrails(&LoadPlan{Creates: 7}, runs)
+	require.Error(t, err)
+	assert.Equal(t, []string{"default would create 2 entities, more than the limit of 1"},
+		err.(*GuardrailError).Violations)
+}
+
+func TestLoaderImpl_LoadAll_Guardrails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-guardrails")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 3; i++ {
+		writeTestContent(t, dir, "monitor-templates", fmt.Sprintf("t%d.json", i), fmt.Sprintf(`{"name":"t%d"}`, i))
+	}
+	// references a planned template, so it is planned as a create too
+	writeTestContent(t, dir, "monitor-metadata-policies", "policy.json", `{
+  "scope": "GLOBAL", "subscope": null, "targetClassName": "Monitor", "valueType": "STRING", "key": "template",
+  "value": {"$ref": {"definition": "monitor-templates", "key": {"name": "t0"}}}
+}`)
+	writeTestContent(t, dir, "zones", "dfw.json", `{"name":"public/dfw","$delete":true}`)
+
+	var posted int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "POST":
+			posted++
+			// echo the created entity back with an id
+			var entity map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&entity))
+			entity["id"] = fmt.Sprintf("created-%d", posted)
+			require.NoError(t, json.NewEncoder(w).Encode(entity))
+		case r.Method == "DELETE":
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Path == "/api/zones":
+			_, _ = w.Write([]byte(`{"content":[{"id":"z-1","name":"public/dfw"},{"id":"z-2","name":"public/ord"}],"last":true}`))
+		default:
+			_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+		}
+	}))
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{
+		AdminUrl:                   ts.URL,
+		MaxCreates:                 3,
+		DefinitionMaxChangePercent: 25,
+	})
+	require.NoError(t, err)
+
+	stats, err := loader.LoadAll(context.Background(), dir, LoadOptions{})
+	require.Error(t, err)
+	var guardrailErr *GuardrailError
+	require.True(t, errors.As(err, &guardrailErr))
+	assert.Equal(t, []string{
+		"zones would create or delete 1 entities, 50.0% of the 2 existing, more than the limit of 25%",
+		"the load would create 4 entities, more than the limit of 3",
+	}, guardrailErr.Violations)
+	assert.Equal(t, 0, posted)
+	assert.Equal(t, 4, stats.Plan.Creates)
+	assert.Equal(t, 1, stats.Plan.Deletes)
+	assert.Equal(t, 3, stats.Plan.Definitions["monitor-templates"].Creates)
+
+	// a plan is reported along with the guardrails it exceeds
+	stats, err = loader.LoadAll(context.Background(), dir, LoadOptions{PlanOnly: true})
+	require.NoError(t, err)
+	assert.Equal(t, guardrailErr.Violations, stats.Plan.Violations)
+	assert.Equal(t, 4, stats.Plan.Creates)
+	assert.Equal(t, 0, posted)
+
+	stats, err = loader.LoadAll(context.Background(), dir, LoadOptions{AllowLargeChange: true})
+	require.NoError(t, err)
+	assert.Equal(t, 4, posted)
+	assert.Equal(t, 4, stats.Created)
+	assert.Equal(t, 1, stats.Deleted)
+}
+
+// refusingLoader refuses each load as if it exceeded the guardrails
+type refusingLoader struct{}
+
+func (refusingLoader) LoadAll(context.Context, string, LoadOptions) (*LoaderStats, error) {
+	return newLoaderStats(), &GuardrailError{Violations: []string{"zones would create 100 entities, more than the limit of 10"}}
+}
+
+func TestWebhookServer_handleWebhook_RefusesLargeChange(t *testing.T) {
+	router, err := NewSingleTargetRouter(refusingLoader{}, nil)
+	require.NoError(t, err)
+
+	sourceContent := new(MockSourceContent)
+	sourceContent.On("Prepare").Return(mockContentPath, nil)
+	sourceContent.On("Cleanup").Return()
+	builder := &MockGitContentBuilder{sourceContent: sourceContent}
+	builder.On("build", mock.Anything, mock.Anything).Return(sourceContent)
+
+	server := NewWebhookServer(zap.NewNop().Sugar(), router, 8080, builder.build, "")
+
+	reqBody, err := os.Open("testdata/webhook_push_req.json")
+	require.NoError(t, err)
+	defer reqBody.Close()
+
+	resp := httptest.NewRecorder()
+	server.handleWebhook(resp, createWebhookReq(reqBody, "push", ""))
+
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "zones would create 100 entities")
+}
@@ -0,0 +1,260 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/racker/go-restclient"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	checkStatusOk     = "ok"
+	checkStatusFailed = "failed"
+	// readinessCheckTimeout bounds each check, such as listing the refs of a hung git remote
+	readinessCheckTimeout = 5 * time.Second
+)
+
+// HealthCheck is a named check that returns an error when not healthy
+type HealthCheck struct {
+	Name  string
+	Check func() error
+}
+
+// CheckResult is the outcome of one HealthCheck
+type CheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReadinessReport is the response body of the readiness endpoint
+type ReadinessReport struct {
+	Ready     bool          `json:"ready"`
+	CheckedAt time.Time     `json:"checkedAt"`
+	Checks    []CheckResult `json:"checks"`
+}
+
+// targetProbe is implemented by loaders that can verify their connectivity to an Admin API target
+type targetProbe interface {
+	CheckAuthentication() error
+	CheckAdminApi() error
+}
+
+// ReadinessChecker runs readiness checks and caches the report for a short time so that
+// frequent probes don't hammer Identity, the Admin API, and Github
+type ReadinessChecker struct {
+	log      *zap.SugaredLogger
+	checks   []HealthCheck
+	cacheTtl time.Duration
+	// checkTimeout bounds how long a report waits for each check
+	checkTimeout time.Duration
+
+	mutex      sync.Mutex
+	lastReport *ReadinessReport
+	// running holds the runs of the checks, by index, that haven't finished, which includes a
+	// timed out run that is waited on rather than started again
+	running map[int]*runningCheck
+}
+
+type runningCheck struct {
+	// done is closed once err is set
+	done chan struct{}
+	err  error
+}
+
+func NewReadinessChecker(log *zap.SugaredLogger, checks []HealthCheck, cacheTtl time.Duration) *ReadinessChecker {
+	return &ReadinessChecker{
+		log:          log.Named("readiness"),
+		checks:       checks,
+		cacheTtl:     cacheTtl,
+		checkTimeout: readinessCheckTimeout,
+		running:      make(map[int]*runningCheck),
+	}
+}
+
+// Check returns the cached report, if still fresh, or runs all checks concurrently
+func (c *ReadinessChecker) Check() *ReadinessReport {
+	c.mutex.Lock()
+	lastReport := c.lastReport
+	c.mutex.Unlock()
+	if lastReport != nil && time.Since(lastReport.CheckedAt) < c.cacheTtl {
+		return lastReport
+	}
+
+	report := &ReadinessReport{
+		Ready:     true,
+		CheckedAt: time.Now(),
+		Checks:    make([]CheckResult, len(c.checks)),
+	}
+	var wg sync.WaitGroup
+	for i, check := range c.checks {
+		wg.Add(1)
+		go func(i int, check HealthCheck) {
+			defer wg.Done()
+			result := CheckResult{
+				Name:   check.Name,
+				Status: checkStatusOk,
+			}
+			if err := c.runCheck(i, check); err != nil {
+				c.log.Warnw("readiness check failed", "check", check.Name, "err", err)
+				result.Status = checkStatusFailed
+				result.Error = err.Error()
+			}
+			report.Checks[i] = result
+		}(i, check)
+	}
+	wg.Wait()
+	for _, result := range report.Checks {
+		if result.Status != checkStatusOk {
+			report.Ready = false
+		}
+	}
+
+	c.mutex.Lock()
+	c.lastReport = report
+	c.mutex.Unlock()
+	return report
+}
+
+// runCheck runs the check, or joins its run that hasn't finished, and waits for up to the
+// check timeout
+func (c *ReadinessChecker) runCheck(i int, check HealthCheck) error {
+	c.mutex.Lock()
+	run, exists := c.running[i]
+	if !exists {
+		run = &runningCheck{done: make(chan struct{})}
+		c.running[i] = run
+		go func() {
+			run.err = check.Check()
+			c.mutex.Lock()
+			delete(c.running, i)
+			c.mutex.Unlock()
+			close(run.done)
+		}()
+	}
+	c.mutex.Unlock()
+
+	timer := time.NewTimer(c.checkTimeout)
+	defer timer.Stop()
+	select {
+	case <-run.done:
+		return run.err
+	case <-timer.C:
+		return fmt.Errorf("timed out after %s", c.checkTimeout)
+	}
+}
+
+func (c *ReadinessChecker) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	report := c.Check()
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		c.log.Warnw("failed to marshal readiness report", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", string(restclient.JsonType))
+	if report.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, err = w.Write(body)
+	if err != nil {
+		c.log.Warnw("failed to send readiness response", "err", err)
+	}
+}
+
+// newHealthMux creates a mux serving metrics, liveness, and, if a checker is given, readiness
+// to which servers add their own endpoints
+func newHealthMux(readinessChecker *ReadinessChecker) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", handleLiveness)
+	if readinessChecker != nil {
+		mux.HandleFunc("/readyz", readinessChecker.handleReadiness)
+	}
+
+	// register legacy healthcheck endpoint
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+// handleLiveness only conveys that the server is able to handle requests
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", string(restclient.JsonType))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"status":"ok"}`))
+}
+
+// targetHealthChecks creates checks of Identity authentication and Admin API connectivity for
+// each routing target whose loader supports probing
+func targetHealthChecks(router *Router) []HealthCheck {
+	var checks []HealthCheck
+	for _, target := range router.Targets() {
+		probe, ok := target.Loader.(targetProbe)
+		if !ok {
+			continue
+		}
+		checks = append(checks,
+			HealthCheck{
+				Name:  fmt.Sprintf("identity:%s", target.Name),
+				Check: probe.CheckAuthentication,
+			},
+			HealthCheck{
+				Name:  fmt.Sprintf("admin-api:%s", target.Name),
+				Check: probe.CheckAdminApi,
+			})
+	}
+	return checks
+}
+
+// gitRemoteHealthCheck verifies the repository can be accessed with the configured token
+func gitRemoteHealthCheck(repository string, githubToken string) HealthCheck {
+	return HealthCheck{
+		Name: "git-remote",
+		Check: func() error {
+			return checkGitRemote(repository, githubToken)
+		},
+	}
+}
+
+// tempDirHealthCheck verifies content can be cloned into the temp directory
+func tempDirHealthCheck() HealthCheck {
+	return HealthCheck{
+		Name: "temp-dir",
+		Check: func() error {
+			file, err := ioutil.TempFile("", "data-loader-ready")
+			if err != nil {
+				return fmt.Errorf("temp dir is not writable: %w", err)
+			}
+			_ = file.Close()
+			return os.Remove(file.Name())
+		},
+	}
+}
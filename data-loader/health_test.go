@@ -0,0 +1,130 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/racker/go-restclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadinessChecker_handleReadiness(t *testing.T) {
+	checker := NewReadinessChecker(zap.NewNop().Sugar(), []HealthCheck{
+		{Name: "good", Check: func() error { return nil }},
+		{Name: "bad", Check: func() error { return errors.New("unreachable") }},
+	}, time.Minute)
+
+	resp := httptest.NewRecorder()
+	checker.handleReadiness(resp, httptest.NewRequest("GET", "/readyz", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
+
+	var report ReadinessReport
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &report))
+	assert.False(t, report.Ready)
+	assert.Equal(t, []CheckResult{
+		{Name: "good", Status: "ok"},
+		{Name: "bad", Status: "failed", Error: "unreachable"},
+	}, report.Checks)
+}
+
+func TestReadinessChecker_Check_Cached(t *testing.T) {
+	calls := 0
+	checker := NewReadinessChecker(zap.NewNop().Sugar(), []HealthCheck{
+		{Name: "counting", Check: func() error {
+			calls++
+			return nil
+		}},
+	}, time.Minute)
+
+	assert.True(t, checker.Check().Ready)
+	assert.True(t, checker.Check().Ready)
+
+	assert.Equal(t, 1, calls)
+}
+
+func TestReadinessChecker_Check_HungCheck(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	checker := NewReadinessChecker(zap.NewNop().Sugar(), []HealthCheck{
+		{Name: "good", Check: func() error { return nil }},
+		{Name: "hung", Check: func() error {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return nil
+		}},
+	}, 0)
+	checker.checkTimeout = 50 * time.Millisecond
+
+	report := checker.Check()
+	assert.False(t, report.Ready)
+	assert.Equal(t, []CheckResult{
+		{Name: "good", Status: "ok"},
+		{Name: "hung", Status: "failed", Error: "timed out after 50ms"},
+	}, report.Checks)
+
+	// the hung run is waited on rather than started again
+	assert.False(t, checker.Check().Ready)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		return checker.Check().Ready
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestLoaderImpl_Checks(t *testing.T) {
+	var authHeader string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("x-auth-token")
+		assert.Equal(t, "/api/agent-releases", r.URL.Path)
+		_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+	}))
+	defer ts.Close()
+
+	authenticated := 0
+	var authenticator restclient.Interceptor = func(req *http.Request, next restclient.NextCallback) (*http.Response, error) {
+		authenticated++
+		req.Header.Set("x-auth-token", "token")
+		return next(req)
+	}
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), &AdminAuthenticator{Interceptor: authenticator}, &Config{AdminUrl: ts.URL})
+	require.NoError(t, err)
+	probe := loader.(targetProbe)
+
+	require.NoError(t, probe.CheckAuthentication())
+	assert.Equal(t, 1, authenticated)
+	// the authentication check must not reach the Admin API
+	assert.Equal(t, "", authHeader)
+
+	require.NoError(t, probe.CheckAdminApi())
+	assert.Equal(t, "token", authHeader)
+}
+
+func TestTempDirHealthCheck(t *testing.T) {
+	assert.NoError(t, tempDirHealthCheck().Check())
+}
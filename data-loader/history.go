@@ -0,0 +1,202 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	triggerWebhook = "webhook"
+	triggerManual  = "manual"
+	triggerCli     = "cli"
+	// triggerApproval is the approval of a pending load planned for a push event
+	triggerApproval = "approval"
+	// triggerDrift is a periodic drift check that found and applied changes
+	triggerDrift = "drift"
+	// triggerWatch is the watch-git command polling a changed head
+	triggerWatch = "watch"
+)
+
+const (
+	outcomeSuccess = "success"
+	outcomeFailed  = "failed"
+)
+
+const (
+	historyFilename     = "history.db"
+	historyBucket       = "loads"
+	historyOpenTimeout  = 5 * time.Second
+	defaultHistoryLimit = 100
+)
+
+// LoadRecord describes one load, where its source is either Repository and Sha or Path
+type LoadRecord struct {
+	Id         uint64       `json:"id"`
+	Target     string       `json:"target"`
+	Trigger    string       `json:"trigger"`
+	DeliveryId string       `json:"deliveryId,omitempty"`
+	Repository string       `json:"repository,omitempty"`
+	Ref        string       `json:"ref,omitempty"`
+	Sha        string       `json:"sha,omitempty"`
+	Path       string       `json:"path,omitempty"`
+	StartedAt  time.Time    `json:"startedAt"`
+	FinishedAt time.Time    `json:"finishedAt"`
+	Outcome    string       `json:"outcome"`
+	Error      string       `json:"error,omitempty"`
+	Stats      *LoaderStats `json:"stats,omitempty"`
+}
+
+// finish completes the record with the outcome of the load
+func (r *LoadRecord) finish(stats *LoaderStats, err error) {
+	r.FinishedAt = time.Now()
+	r.Stats = stats
+	if err != nil {
+		r.Outcome = outcomeFailed
+		r.Error = err.Error()
+	} else {
+		r.Outcome = outcomeSuccess
+	}
+}
+
+// HistoryFilter selects load records where empty fields match any value
+type HistoryFilter struct {
+	Repository string
+	Ref        string
+	Outcome    string
+	Limit      int
+}
+
+func (f HistoryFilter) matches(record *LoadRecord) bool {
+	return (f.Repository == "" || f.Repository == record.Repository) &&
+		(f.Ref == "" || f.Ref == record.Ref) &&
+		(f.Outcome == "" || f.Outcome == record.Outcome)
+}
+
+type HistoryStore interface {
+	// Record assigns the record an ID and persists it
+	Record(record *LoadRecord) error
+	// Query returns the matching records, newest first
+	Query(filter HistoryFilter) ([]*LoadRecord, error)
+	Close() error
+}
+
+type boltHistoryStore struct {
+	db *bbolt.DB
+}
+
+// OpenHistoryStore opens or creates the history database in the given data directory
+func OpenHistoryStore(dataDir string) (HistoryStore, error) {
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create data dir: %w", err)
+	}
+
+	db, err := bbolt.Open(filepath.Join(dataDir, historyFilename), 0644,
+		&bbolt.Options{Timeout: historyOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history database: %w", err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(historyBucket))
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize history database: %w", err)
+	}
+
+	return &boltHistoryStore{db: db}, nil
+}
+
+func (s *boltHistoryStore) Record(record *LoadRecord) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(historyBucket))
+
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return fmt.Errorf("failed to allocate record id: %w", err)
+		}
+		record.Id = id
+
+		value, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to encode record: %w", err)
+		}
+
+		return bucket.Put(historyKey(id), value)
+	})
+}
+
+func (s *boltHistoryStore) Query(filter HistoryFilter) ([]*LoadRecord, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+
+	records := make([]*LoadRecord, 0)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket([]byte(historyBucket)).Cursor()
+		// keys are big-endian IDs, so walk backwards for newest first
+		for k, v := cursor.Last(); k != nil && len(records) < limit; k, v = cursor.Prev() {
+			var record LoadRecord
+			err := json.Unmarshal(v, &record)
+			if err != nil {
+				return fmt.Errorf("failed to decode record %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			if filter.matches(&record) {
+				records = append(records, &record)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (s *boltHistoryStore) Close() error {
+	return s.db.Close()
+}
+
+// recordLoad persists the record, if a store is configured. Failures are only logged since
+// history must not interfere with loading.
+func recordLoad(log *zap.SugaredLogger, store HistoryStore, record *LoadRecord) {
+	if store == nil {
+		return
+	}
+	err := store.Record(record)
+	if err != nil {
+		log.Warnw("failed to record load history", "err", err, "record", record)
+	}
+}
+
+func historyKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
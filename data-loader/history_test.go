@@ -0,0 +1,78 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBoltHistoryStore_RecordAndQuery(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "history-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	store, err := OpenHistoryStore(dataDir)
+	require.NoError(t, err)
+
+	first := &LoadRecord{Trigger: triggerWebhook, Repository: "repo-a", Ref: "refs/heads/master"}
+	first.finish(&LoaderStats{Created: 1}, nil)
+	require.NoError(t, store.Record(first))
+
+	second := &LoadRecord{Trigger: triggerManual, Repository: "repo-a", Ref: "refs/heads/staging"}
+	second.finish(nil, errors.New("admin API unavailable"))
+	require.NoError(t, store.Record(second))
+
+	third := &LoadRecord{Trigger: triggerCli, Path: "/content"}
+	third.finish(&LoaderStats{}, nil)
+	require.NoError(t, store.Record(third))
+
+	records, err := store.Query(HistoryFilter{})
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	// newest first
+	assert.Equal(t, uint64(3), records[0].Id)
+	assert.Equal(t, uint64(1), records[2].Id)
+
+	records, err = store.Query(HistoryFilter{Repository: "repo-a", Outcome: outcomeFailed})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "admin API unavailable", records[0].Error)
+
+	records, err = store.Query(HistoryFilter{Ref: "refs/heads/master"})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, 1, records[0].Stats.Created)
+
+	records, err = store.Query(HistoryFilter{Limit: 2})
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+
+	// and records survive re-opening
+	require.NoError(t, store.Close())
+	store, err = OpenHistoryStore(dataDir)
+	require.NoError(t, err)
+	defer store.Close()
+
+	records, err = store.Query(HistoryFilter{})
+	require.NoError(t, err)
+	assert.Len(t, records, 3)
+}
@@ -66,5 +66,19 @@ var loaderDefinitions = []LoaderDefinition{
 		UniqueFieldPaths: []string{
 			"$.tenantId",
 		},
+		// grows with every tenant, so each may instead be retrieved individually when named
+		// by the lookup-definitions config
+		Lookup: &LookupStrategy{
+			UrlTemplate: "/api/tenant-metadata/{$.tenantId}",
+		},
 	},
 }
+
+func findLoaderDefinition(name string) *LoaderDefinition {
+	for i := range loaderDefinitions {
+		if loaderDefinitions[i].Name == name {
+			return &loaderDefinitions[i]
+		}
+	}
+	return nil
+}
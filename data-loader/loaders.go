@@ -17,16 +17,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/racker/go-restclient"
 	"github.com/yalp/jsonpath"
 	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -36,6 +43,41 @@ type LoaderDefinition struct {
 	Name             string
 	ApiPath          string
 	UniqueFieldPaths []string
+	// UniqueFieldOptions adjusts how the value at each of the UniqueFieldPaths becomes part of
+	// the unique key. Paths without options must be present and are compared as-is.
+	UniqueFieldOptions map[string]UniqueFieldOptions
+	// Lookup, if given, retrieves the existing entity of each source content entity rather
+	// than all existing entities of the definition
+	Lookup *LookupStrategy
+	// Guardrails, if given, replace the configured guardrails of each definition
+	Guardrails *Guardrails
+}
+
+// UniqueFieldOptions declares how one unique field value is read and compared
+type UniqueFieldOptions struct {
+	// MissingAsNull treats an absent field like one that is null rather than failing
+	MissingAsNull bool
+	// Normalizations are applied in order to string values
+	Normalizations []Normalization
+}
+
+// Normalization adjusts a string unique field value so that equivalent values compare equal
+type Normalization string
+
+const (
+	NormalizeTrim     Normalization = "trim"
+	NormalizeCaseFold Normalization = "case-fold"
+)
+
+func (n Normalization) apply(value string) string {
+	switch n {
+	case NormalizeTrim:
+		return strings.TrimSpace(value)
+	case NormalizeCaseFold:
+		return strings.ToLower(value)
+	default:
+		return value
+	}
 }
 
 func (l *LoaderDefinition) String() string {
@@ -45,137 +87,540 @@ func (l *LoaderDefinition) String() string {
 type PagedContent struct {
 	Content []interface{}
 	Last    bool
+	// TotalPages is zero when the Admin API doesn't convey it
+	TotalPages int
 }
 
 type Loader interface {
-	LoadAll(sourceContentPath string) (*LoaderStats, error)
+	LoadAll(ctx context.Context, sourceContentPath string, options LoadOptions) (*LoaderStats, error)
+}
+
+// LoadOptions adjusts what a single LoadAll invocation processes
+type LoadOptions struct {
+	// Definitions limits loading to the loader definitions with these names. All definitions
+	// are loaded when empty.
+	Definitions []string `json:"definitions,omitempty"`
+	// Exclude skips the loader definitions with these names
+	Exclude []string `json:"exclude,omitempty"`
+	// Paths limits loading to content files that match these gitignore style patterns, which
+	// are relative to the root of the source content. All files are loaded when empty.
+	Paths []string `json:"paths,omitempty"`
+	// AllowLargeChange loads content even when its plan exceeds the guardrails
+	AllowLargeChange bool `json:"allowLargeChange,omitempty"`
+	// Revision of the source content, which is recorded in the load state
+	Revision string `json:"-"`
+	// PlanOnly stops the load once its plan is computed, which is conveyed by the stats
+	PlanOnly bool `json:"-"`
+	// ExpectedFingerprint, if given, refuses the load unless the existing entities still
+	// have the fingerprint of an earlier plan
+	ExpectedFingerprint string `json:"-"`
+	// OnFileResult, if given, is called with the outcome of each content file as it is loaded
+	OnFileResult func(result FileResult) `json:"-"`
+}
+
+// fileResultInvalid is the outcome of a content file that couldn't be processed, which stops
+// the loading of its loader definition
+const fileResultInvalid = "invalid"
+
+// FileResult is the outcome of loading one content file
+type FileResult struct {
+	Definition string
+	// Path is relative to the root of the source content
+	Path string
+	// Result is an entity result or invalid
+	Result string
+	Err    error
+}
+
+// Validate ensures the options only reference known loader definitions
+func (o LoadOptions) Validate() error {
+	for _, names := range [][]string{o.Definitions, o.Exclude} {
+		for _, name := range names {
+			if findLoaderDefinition(name) == nil {
+				return fmt.Errorf("unknown loader definition: %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+func (o LoadOptions) includes(definition LoaderDefinition) bool {
+	if containsString(o.Exclude, definition.Name) {
+		return false
+	}
+	return len(o.Definitions) == 0 || containsString(o.Definitions, definition.Name)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
 type LoaderStats struct {
 	SkippedExisting int
 	Created         int
 	FailedToCreate  int
+	Deleted         int
+	AlreadyDeleted  int
+	FailedToDelete  int
+	// Definitions breaks down the stats by loader definition name
+	Definitions map[string]*DefinitionStats `json:",omitempty"`
+	// Plan is the changes the load planned to make
+	Plan *LoadPlan `json:",omitempty"`
+}
+
+type DefinitionStats struct {
+	SkippedExisting int
+	Created         int
+	FailedToCreate  int
+	Deleted         int
+	AlreadyDeleted  int
+	FailedToDelete  int
+	// Error conveys why the definition could not be fully processed
+	Error string `json:",omitempty"`
+}
+
+func newLoaderStats() *LoaderStats {
+	return &LoaderStats{
+		Definitions: make(map[string]*DefinitionStats),
+	}
+}
+
+func (s *LoaderStats) forDefinition(definition LoaderDefinition) *DefinitionStats {
+	definitionStats, exists := s.Definitions[definition.Name]
+	if !exists {
+		definitionStats = &DefinitionStats{}
+		s.Definitions[definition.Name] = definitionStats
+	}
+	return definitionStats
+}
+
+// record tallies the result of processing one source content entity in the overall stats,
+// the definition's stats, and the entity metrics
+func (s *LoaderStats) record(definition LoaderDefinition, result string) {
+	definitionStats := s.forDefinition(definition)
+	switch result {
+	case entityResultCreated:
+		s.Created += 1
+		definitionStats.Created += 1
+	case entityResultSkipped:
+		s.SkippedExisting += 1
+		definitionStats.SkippedExisting += 1
+	case entityResultFailed:
+		s.FailedToCreate += 1
+		definitionStats.FailedToCreate += 1
+	case entityResultDeleted:
+		s.Deleted += 1
+		definitionStats.Deleted += 1
+	case entityResultAlreadyDeleted:
+		s.AlreadyDeleted += 1
+		definitionStats.AlreadyDeleted += 1
+	case entityResultDeleteFailed:
+		s.FailedToDelete += 1
+		definitionStats.FailedToDelete += 1
+	}
+	loadedEntities.WithLabelValues(definition.Name, result).Inc()
+}
+
+// loadRun holds the state of one LoadAll
+type loadRun struct {
+	stats *LoaderStats
+	// entities indexes existing and created entities so that references can be resolved
+	entities entityIndex
+	// state is nil when no state store is configured
+	state             *stateTracker
+	sourceContentPath string
+	filter            *contentFilter
+	// definitions are those prepared so far, by name
+	definitions  map[string]*definitionRun
+	onFileResult func(result FileResult)
+}
+
+// relPath returns the slash separated path of the content file relative to the source content
+func (r *loadRun) relPath(path string) string {
+	relPath, err := filepath.Rel(r.sourceContentPath, path)
+	if err != nil {
+		relPath = path
+	}
+	return filepath.ToSlash(relPath)
+}
+
+// recordResult records the outcome of the content file at path in the stats and reports it to
+// any file result callback
+func (r *loadRun) recordResult(definition LoaderDefinition, path string, result string, err error) {
+	if result != fileResultInvalid {
+		r.stats.record(definition, result)
+	}
+	if r.onFileResult == nil {
+		return
+	}
+	r.onFileResult(FileResult{
+		Definition: definition.Name,
+		Path:       r.relPath(path),
+		Result:     result,
+		Err:        err,
+	})
 }
 
 type LoaderImpl struct {
-	log        *zap.SugaredLogger
-	restClient *restclient.Client
+	log           *zap.SugaredLogger
+	restClient    *restclient.Client
+	authenticator restclient.Interceptor
+	decryptor     *ContentDecryptor
+	// secrets is nil when content may not reference secrets
+	secrets    *SecretSources
+	stateStore StateStore
+	// locker is nil when loads aren't serialized across processes
+	locker LoadLocker
+	// lockKey identifies the Admin API target whose loads are serialized
+	lockKey string
+	// pageSize is left to the Admin API when zero
+	pageSize        int
+	pageConcurrency int
+	// lookupDefinitions names the definitions whose lookup strategy is used
+	lookupDefinitions map[string]bool
+	// guardrails apply to the whole load and definitionGuardrails to each definition that
+	// doesn't declare its own
+	guardrails           Guardrails
+	definitionGuardrails Guardrails
+}
+
+// setupAndLoad is used by the loading commands to prepare and load the source content and
+// record the load, described by the given record, in the history when a data dir is configured
+func setupAndLoad(ctx context.Context, config *Config, log *zap.SugaredLogger, sourceContent SourceContent,
+	record *LoadRecord, options LoadOptions) error {
+	defer pushMetrics(log, config.PushgatewayUrl)
+
+	if config.DataDir != "" {
+		historyStore, err := OpenHistoryStore(config.DataDir)
+		if err != nil {
+			log.Warnw("unable to open history store, so load will not be recorded", "err", err)
+		} else {
+			defer historyStore.Close()
+			record.Target = defaultTargetName
+			if record.Trigger == "" {
+				record.Trigger = triggerCli
+			}
+			record.StartedAt = time.Now()
+			defer func() {
+				recordLoad(log, historyStore, record)
+			}()
+		}
+	}
+
+	stats, err := prepareAndLoad(ctx, config, log, sourceContent, options)
+	record.Sha = sourceContent.Revision()
+	record.finish(stats, err)
+	if err != nil {
+		return err
+	}
+
+	recordSuccessfulLoad(defaultTargetName, record.Sha)
+	return nil
 }
 
-func setupAndLoad(config *Config, log *zap.SugaredLogger, sourceContent SourceContent) error {
-	sourceContentPath, err := sourceContent.Prepare()
+func prepareAndLoad(ctx context.Context, config *Config, log *zap.SugaredLogger, sourceContent SourceContent,
+	options LoadOptions) (*LoaderStats, error) {
+	sourceContentPath, err := sourceContent.Prepare(ctx)
 	if err != nil {
-		return fmt.Errorf("unable to prepare source content: %w", err)
+		return nil, fmt.Errorf("unable to prepare source content: %w", err)
 	}
 	defer sourceContent.Cleanup()
 
-	clientAuth, err := OptionalIdentityAuthenticator(log, config)
+	clientAuth, err := NewAdminAuthenticator(log, config)
 	if err != nil {
-		return fmt.Errorf("failed to setup Identity auth: %w", err)
+		return nil, fmt.Errorf("failed to setup Admin API auth: %w", err)
 	}
 
-	loader, err := NewLoader(log, clientAuth, config.AdminUrl)
+	loader, err := NewLoader(log, clientAuth, config)
 	if err != nil {
-		return fmt.Errorf("failed to create loader: %w", err)
+		return nil, fmt.Errorf("failed to create loader: %w", err)
 	}
 
-	_, err = loader.LoadAll(sourceContentPath)
+	options.Revision = sourceContent.Revision()
+	stats, err := loader.LoadAll(ctx, sourceContentPath, options)
 	if err != nil {
-		return fmt.Errorf("failed to perform all loading: %w", err)
+		return stats, fmt.Errorf("failed to perform all loading: %w", err)
 	}
 
-	return nil
+	return stats, nil
 }
 
-func NewLoader(log *zap.SugaredLogger, identityAuthenticator restclient.Interceptor, adminUrl string) (Loader, error) {
+// NewLoader creates a loader for the Admin API of the given config
+func NewLoader(log *zap.SugaredLogger, authenticator *AdminAuthenticator, config *Config) (Loader, error) {
 	ourLogger := log.Named("loader")
 	ourLogger.Debugw("Setting up loader",
-		"adminUrl", adminUrl)
+		"adminUrl", config.AdminUrl)
+
+	decryptor, err := NewContentDecryptor(config.AgeKeyFile, config.AgeKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup content decryption: %w", err)
+	}
+	secrets, err := NewSecretSources(config.SecretEnvPrefix, config.SecretDirs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup secret references: %w", err)
+	}
+
+	lookupDefinitions, err := newLookupDefinitions(config.LookupDefinitions)
+	if err != nil {
+		return nil, err
+	}
 
 	restClient := restclient.NewClient()
-	err := restClient.SetBaseUrl(adminUrl)
+	err = restClient.SetBaseUrl(config.AdminUrl)
 	if err != nil {
 		return nil, fmt.Errorf("invalid admin URL: %w", err)
 	}
 	restClient.Timeout = getterTimeout
-	if identityAuthenticator != nil {
-		restClient.AddInterceptor(identityAuthenticator)
+	var tokenInterceptor restclient.Interceptor
+	if authenticator != nil && authenticator.Interceptor != nil {
+		tokenInterceptor = authenticator.Interceptor
+		restClient.AddInterceptor(tokenInterceptor)
+	}
+	restClient.AddInterceptor(adminApiMetricsInterceptor)
+	if authenticator != nil && authenticator.Client != nil {
+		restClient.AddInterceptor(clientInterceptor(authenticator.Client))
+	}
+
+	var stateStore StateStore
+	if config.StateLocation != "" {
+		stateStore, err = NewStateStore(context.Background(),
+			stateLocationForTarget(config.StateLocation, defaultTargetName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup state store: %w", err)
+		}
+	}
+
+	var locker LoadLocker
+	if config.LockLocation != "" {
+		locker, err = NewLoadLocker(ourLogger, config.LockLocation, config.LockTimeout, config.LockLease)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup load lock: %w", err)
+		}
 	}
 
 	return &LoaderImpl{
-		log:        ourLogger,
-		restClient: restClient,
+		log:               ourLogger,
+		restClient:        restClient,
+		authenticator:     tokenInterceptor,
+		decryptor:         decryptor,
+		secrets:           secrets,
+		stateStore:        stateStore,
+		locker:            locker,
+		lockKey:           config.AdminUrl,
+		pageSize:          config.PageSize,
+		pageConcurrency:   config.PageConcurrency,
+		lookupDefinitions: lookupDefinitions,
+		guardrails: Guardrails{
+			MaxCreates:       config.MaxCreates,
+			MaxChangePercent: config.MaxChangePercent,
+		},
+		definitionGuardrails: Guardrails{
+			MaxCreates:       config.DefinitionMaxCreates,
+			MaxChangePercent: config.DefinitionMaxChangePercent,
+		},
 	}, nil
 }
 
-func (l *LoaderImpl) LoadAll(sourceContentPath string) (*LoaderStats, error) {
+// CheckAuthentication verifies the token authenticator, if any, is able to obtain a token
+// without sending a request to the Admin API
+func (l *LoaderImpl) CheckAuthentication() error {
+	if l.authenticator == nil {
+		return nil
+	}
+
+	req, err := http.NewRequest("GET", l.restClient.BaseUrl.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to build probe request: %w", err)
+	}
+	_, err = l.authenticator(req, func(req *http.Request) (*http.Response, error) {
+		// short-circuit the actual request
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+	return nil
+}
+
+// CheckAdminApi verifies the Admin API answers an authenticated request
+func (l *LoaderImpl) CheckAdminApi() error {
+	query := make(url.Values)
+	query.Set("size", "1")
+
+	var pagedContent PagedContent
+	err := l.restClient.Exchange("GET", loaderDefinitions[0].ApiPath, query,
+		nil, restclient.NewJsonEntity(&pagedContent))
+	if err != nil {
+		return fmt.Errorf("failed to query Admin API: %w", err)
+	}
+	return nil
+}
+
+func (l *LoaderImpl) LoadAll(ctx context.Context, sourceContentPath string, options LoadOptions) (*LoaderStats, error) {
+
+	// planning alone doesn't change the target
+	if l.locker != nil && !options.PlanOnly {
+		lockedCtx, unlock, err := l.locker.Lock(ctx, l.lockKey)
+		if err != nil {
+			return newLoaderStats(), fmt.Errorf("failed to lock target: %w", err)
+		}
+		defer unlock()
+		ctx = lockedCtx
+	}
 
-	stats := &LoaderStats{}
+	stats := newLoaderStats()
+	filter, err := newContentFilter(sourceContentPath, options.Paths)
+	if err != nil {
+		return stats, err
+	}
+	run := &loadRun{
+		stats:             stats,
+		entities:          make(entityIndex),
+		sourceContentPath: sourceContentPath,
+		filter:            filter,
+		definitions:       make(map[string]*definitionRun),
+		onFileResult:      options.OnFileResult,
+	}
+	if l.stateStore != nil {
+		previous, err := l.stateStore.Load(ctx)
+		if err != nil {
+			return stats, fmt.Errorf("failed to load state: %w", err)
+		}
+		run.state = newStateTracker(previous, options.Revision)
+	}
 	var err1 error
 
+	// plan all definitions before making any changes so the guardrails cover the whole load
+	var prepared []*definitionRun
+	plan := newLoadPlan()
 	for _, definition := range loaderDefinitions {
-		err := l.load(definition, sourceContentPath, stats)
+		definition = l.withLookup(definition)
+		if ctx.Err() != nil {
+			l.log.Warnw("loading cancelled", "err", ctx.Err(), "stats", stats)
+			return stats, fmt.Errorf("loading cancelled before %s: %w", definition.Name, ctx.Err())
+		}
+
+		if !options.includes(definition) {
+			l.log.Debugw("skipping excluded definition", "definition", definition)
+			continue
+		}
+
+		defRun, err := l.prepare(ctx, definition, sourceContentPath, run)
 		if err != nil {
 			l.log.Warnw("failed to process loader definition",
 				"err", err,
 				"definition", definition)
+			stats.forDefinition(definition).Error = err.Error()
 			//but continue with other definitions
 			err1 = err
+			continue
 		}
-	}
-
-	l.log.Infow("loaded content", "stats", stats)
-
-	return stats, err1
-}
+		prepared = append(prepared, defRun)
 
-func (l *LoaderImpl) load(definition LoaderDefinition, sourceContentPath string, stats *LoaderStats) error {
+		plan.Definitions[definition.Name] = defRun.plan
+		if definition.Lookup == nil {
+			plan.Existing += defRun.plan.Existing
+		}
+		plan.Creates += defRun.plan.Creates
+		plan.Deletes += defRun.plan.Deletes
+	}
+	plan.Fingerprint = fingerprintExisting(prepared)
+	stats.Plan = plan
+	l.log.Infow("planned load", "plan", plan)
 
-	var content []interface{}
-	var err error
-	content, err = l.retrieveExistingPagedContent(definition)
-	if err != nil {
-		return fmt.Errorf("failed to load all pages: %w", err)
+	if !options.AllowLargeChange {
+		err := l.checkGuardrails(plan, prepared)
+		var guardrailErr *GuardrailError
+		if errors.As(err, &guardrailErr) {
+			plan.Violations = guardrailErr.Violations
+		}
+		// a plan is reported regardless since the guardrails only refuse applying it
+		if err != nil && !options.PlanOnly {
+			l.log.Warnw("refusing load", "err", err)
+			return stats, err
+		}
+	}
+	if options.ExpectedFingerprint != "" && options.ExpectedFingerprint != plan.Fingerprint {
+		l.log.Warnw("refusing load", "err", errExistingContentChanged,
+			"expectedFingerprint", options.ExpectedFingerprint, "fingerprint", plan.Fingerprint)
+		return stats, errExistingContentChanged
+	}
+	if options.PlanOnly {
+		return stats, err1
+	}
+	// only a load that applies its plan saves state, since only it holds the lock
+	if run.state != nil {
+		defer l.saveState(ctx, run.state)
 	}
 
-	l.log.Infof("Loaded %d existing entities for %s", len(content), definition.Name)
-	l.log.Debugw("Loaded existing content",
-		"content", content,
-		"definition", definition.Name)
+	for _, defRun := range prepared {
+		definition := defRun.definition
+		if ctx.Err() != nil {
+			l.log.Warnw("loading cancelled", "err", ctx.Err(), "stats", stats)
+			return stats, fmt.Errorf("loading cancelled before %s: %w", definition.Name, ctx.Err())
+		}
 
-	identifiers, err := l.identifyExistingContent(definition, content)
-	if err != nil {
-		return fmt.Errorf("failure while identifying existing content: %w", err)
+		err := l.processSourceContent(ctx, defRun, sourceContentPath, run)
+		if err != nil {
+			err = fmt.Errorf("failed to process source content: %w", err)
+			l.log.Warnw("failed to process loader definition",
+				"err", err,
+				"definition", definition)
+			stats.forDefinition(definition).Error = err.Error()
+			//but continue with other definitions
+			err1 = err
+		} else if run.state != nil && len(options.Paths) == 0 {
+			// files excluded by path patterns still exist, so their state is retained
+			run.state.complete(definition)
+		}
 	}
 
-	l.log.Debugw("Identified existing content",
-		"identifiers", identifiers,
-		"definition", definition)
+	l.log.Infow("loaded content", "stats", stats)
+
+	return stats, err1
+}
 
-	err = l.processSourceContent(definition, sourceContentPath, identifiers, stats)
+// saveState persists the state tracked during a load. A failure is only logged since the
+// entities were loaded regardless and the next load will record them again.
+func (l *LoaderImpl) saveState(ctx context.Context, state *stateTracker) {
+	err := l.stateStore.Save(ctx, state.merged())
 	if err != nil {
-		return fmt.Errorf("failed to process source content: %w", err)
+		l.log.Warnw("failed to save state", "err", err)
 	}
-
-	return nil
 }
 
-func (l *LoaderImpl) retrieveExistingPagedContent(definition LoaderDefinition) ([]interface{}, error) {
+func (l *LoaderImpl) retrieveExistingPagedContent(ctx context.Context, definition LoaderDefinition) ([]interface{}, error) {
 	l.log.Debugw("loading all pages for definition",
 		"definition", definition)
+	timer := prometheus.NewTimer(paginationDuration.WithLabelValues(definition.Name))
+	defer timer.ObserveDuration()
 
-	var content []interface{}
-
-	for page := 0; ; page++ {
-		query := make(url.Values)
-		query.Set("page", strconv.Itoa(page))
+	firstPage, err := l.retrievePage(ctx, definition, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	content := firstPage.Content
+	if firstPage.Last {
+		return content, nil
+	}
 
-		var pagedContent PagedContent
-		err := l.restClient.Exchange("GET", definition.ApiPath, query,
-			nil, restclient.NewJsonEntity(&pagedContent))
+	if firstPage.TotalPages > 1 && l.pageConcurrency > 1 {
+		remaining, err := l.retrievePagesConcurrently(ctx, definition, firstPage.TotalPages)
+		if err != nil {
+			return nil, err
+		}
+		return append(content, remaining...), nil
+	}
 
+	for page := 1; ; page++ {
+		pagedContent, err := l.retrievePage(ctx, definition, page, nil)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get page %d of %s: %w", page, definition.Name, err)
+			return nil, err
 		}
 
 		content = append(content, pagedContent.Content...)
@@ -188,6 +633,74 @@ func (l *LoaderImpl) retrieveExistingPagedContent(definition LoaderDefinition) (
 	return content, nil
 }
 
+// retrievePage retrieves the page of existing entities, which are narrowed by the filter
+// query parameters, if given
+func (l *LoaderImpl) retrievePage(ctx context.Context, definition LoaderDefinition, page int,
+	filter url.Values) (*PagedContent, error) {
+	query := make(url.Values)
+	for name, values := range filter {
+		query[name] = values
+	}
+	query.Set("page", strconv.Itoa(page))
+	if l.pageSize > 0 {
+		query.Set("size", strconv.Itoa(l.pageSize))
+	}
+
+	var pagedContent PagedContent
+	err := l.restClient.ExchangeWithContext(ctx, "GET", definition.ApiPath, query,
+		nil, restclient.NewJsonEntity(&pagedContent))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get page %d of %s: %w", page, definition.Name, err)
+	}
+	return &pagedContent, nil
+}
+
+// retrievePagesConcurrently retrieves pages 1 through totalPages-1, with up to pageConcurrency
+// requests at a time, and returns their content in page order
+func (l *LoaderImpl) retrievePagesConcurrently(ctx context.Context, definition LoaderDefinition, totalPages int) ([]interface{}, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pages := make([]*PagedContent, totalPages)
+	errs := make(chan error, totalPages)
+	slots := make(chan struct{}, l.pageConcurrency)
+	var wg sync.WaitGroup
+
+	for page := 1; page < totalPages; page++ {
+		wg.Add(1)
+		go func(page int) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+
+			pagedContent, err := l.retrievePage(ctx, definition, page, nil)
+			if err != nil {
+				errs <- err
+				cancel()
+				return
+			}
+			pages[page] = pagedContent
+		}(page)
+	}
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+
+	var content []interface{}
+	for _, pagedContent := range pages[1:] {
+		content = append(content, pagedContent.Content...)
+	}
+	return content, nil
+}
+
 type UniquenessTracker map[string]struct{}
 
 func (t UniquenessTracker) String() string {
@@ -203,18 +716,25 @@ func (t UniquenessTracker) Add(fieldValues []interface{}) {
 	t[key] = struct{}{}
 }
 
+func (t UniquenessTracker) Remove(fieldValues []interface{}) {
+	delete(t, t.formKey(fieldValues))
+}
+
 func (t UniquenessTracker) Contains(fieldValues []interface{}) bool {
 	_, exists := t[t.formKey(fieldValues)]
 	return exists
 }
 
+// formKey encodes the field values as a JSON array, which keeps the values distinct by type
+// and can't be confused by separators within the values. Object keys are encoded sorted, so
+// the encoding is canonical.
 func (UniquenessTracker) formKey(fieldValues []interface{}) string {
-	strValues := make([]string, len(fieldValues))
-	for i, v := range fieldValues {
-		strValues[i] = fmt.Sprintf("%v", v)
+	key, err := json.Marshal(fieldValues)
+	if err != nil {
+		// decoded JSON always encodes, so this is only reached by values built in code
+		return fmt.Sprintf("%#v", fieldValues)
 	}
-	key := strings.Join(strValues, ";")
-	return key
+	return string(key)
 }
 
 func (l *LoaderImpl) identifyExistingContent(definition LoaderDefinition, allContent []interface{}) (UniquenessTracker, error) {
@@ -228,7 +748,7 @@ func (l *LoaderImpl) identifyExistingContent(definition LoaderDefinition, allCon
 	tracker := make(UniquenessTracker)
 
 	for _, v := range allContent {
-		fieldValues, e := l.extractFieldValues(definition, v)
+		fieldValues, e := extractFieldValues(definition, v)
 		if e != nil {
 			return nil, e
 		}
@@ -239,34 +759,58 @@ func (l *LoaderImpl) identifyExistingContent(definition LoaderDefinition, allCon
 	return tracker, nil
 }
 
-func (l *LoaderImpl) extractFieldValues(definition LoaderDefinition, content interface{}) ([]interface{}, error) {
+func extractFieldValues(definition LoaderDefinition, content interface{}) ([]interface{}, error) {
 	fieldValues := make([]interface{}, 0, len(definition.UniqueFieldPaths))
 	for _, path := range definition.UniqueFieldPaths {
+		options := definition.UniqueFieldOptions[path]
 		fieldValue, err := jsonpath.Read(content, path)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read json path given content: %w", err)
+			if !(options.MissingAsNull && isMissingPathError(err)) {
+				return nil, fmt.Errorf("failed to read json path given content: %w", err)
+			}
+			fieldValue = nil
+		}
+		if strValue, ok := fieldValue.(string); ok {
+			for _, normalization := range options.Normalizations {
+				strValue = normalization.apply(strValue)
+			}
+			fieldValue = strValue
 		}
 		fieldValues = append(fieldValues, fieldValue)
 	}
 	return fieldValues, nil
 }
 
-func (l *LoaderImpl) processSourceContent(definition LoaderDefinition, sourceContentPath string,
-	existing UniquenessTracker, stats *LoaderStats) error {
+// isMissingPathError reports whether the jsonpath error is due to an absent object key rather
+// than a malformed path or content of an unexpected type. The jsonpath package doesn't export
+// error values, so its messages are matched.
+func isMissingPathError(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "not found in JSON object") || strings.HasPrefix(message, "no key ")
+}
+
+func (l *LoaderImpl) processSourceContent(ctx context.Context, defRun *definitionRun, sourceContentPath string,
+	run *loadRun) error {
 
-	err := filepath.Walk(filepath.Join(sourceContentPath, definition.Name),
-		func(path string, info os.FileInfo, err error) error {
+	definition := defRun.definition
+
+	definitionPath := filepath.Join(sourceContentPath, definition.Name)
+	if _, err := os.Stat(definitionPath); os.IsNotExist(err) {
+		l.log.Debugw("no source content for definition",
+			"definition", definition, "path", definitionPath)
+		return nil
+	}
+
+	err := walkContentFiles(sourceContentPath, definitionPath, run.filter,
+		func(path string, _ string) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			err := l.processSourceContentFile(ctx, defRun, path, run)
 			if err != nil {
-				return err
+				run.recordResult(defRun.definition, path, fileResultInvalid, err)
+				return fmt.Errorf("failed to process source content file %s: %w", path, err)
 			}
-			if !info.IsDir() && filepath.Ext(path) == ".json" {
-				err := l.processSourceContentFile(definition, existing, path, stats)
-				if err != nil {
-					return fmt.Errorf("failed to process source content file %s: %w", path, err)
-				}
-			} else if !info.IsDir() {
-				l.log.Debugw("skipping non-JSON file", "path", path)
-			} // else ignore directories
 			return nil
 		})
 	if err != nil {
@@ -276,49 +820,234 @@ func (l *LoaderImpl) processSourceContent(definition LoaderDefinition, sourceCon
 	return nil
 }
 
-func (l *LoaderImpl) processSourceContentFile(definition LoaderDefinition, existing UniquenessTracker,
-	path string, stats *LoaderStats) error {
-	file, err := os.Open(path)
+func (l *LoaderImpl) processSourceContentFile(ctx context.Context, defRun *definitionRun, path string, run *loadRun) error {
+	definition := defRun.definition
+	existing := defRun.existing
+	if previous := l.unchangedState(defRun, path, run); previous != nil {
+		l.log.Debugw("skipping unchanged content file", "path", path, "previousPath", previous.Path)
+		run.recordResult(definition, path, entityResultSkipped, nil)
+		run.state.carry(previous, run.relPath(path))
+		return nil
+	}
+	decoded, err := l.decryptor.readContentFile(path)
+	if err != nil {
+		return err
+	}
+	sourceContent := decoded.content
+
+	// sourceContent retains any secret references, so only it may be logged unless decrypted
+	var loggableContent interface{} = sourceContent
+	if decoded.encrypted {
+		loggableContent = redactedValue
+	}
+	resolvedContent, err := l.secrets.resolveSecrets(sourceContent)
 	if err != nil {
-		return fmt.Errorf("failed to open source content file: %w", err)
+		return fmt.Errorf("failed to resolve secrets: %w", err)
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	var sourceContent interface{}
-	err = decoder.Decode(&sourceContent)
+	resolvedContent, err = resolveEntityRefs(resolvedContent, func(ref entityRef) (interface{}, error) {
+		return l.resolveEntityRef(ctx, ref, run)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to decode source content: %w", err)
+		return fmt.Errorf("failed to resolve references: %w", err)
 	}
 
-	fieldValues, err := l.extractFieldValues(definition, sourceContent)
+	fieldValues, err := extractFieldValues(definition, resolvedContent)
 	if err != nil {
 		return fmt.Errorf("failed to extract unique fields values: %w", err)
 	}
 
-	if !existing.Contains(fieldValues) {
+	tombstone, err := isTombstone(resolvedContent)
+	if err != nil {
+		return err
+	}
+	exists, err := l.entityExists(ctx, defRun, resolvedContent, fieldValues, run)
+	if err != nil {
+		return err
+	}
+	if tombstone {
+		l.processTombstone(ctx, definition, existing, path, fieldValues, run)
+		return nil
+	}
+
+	if !exists {
 		l.log.Debugw("loading new entity from source content",
-			"content", sourceContent, "path", path)
-		err := l.loadEntity(definition, sourceContent)
+			"content", loggableContent, "path", path)
+		created, err := l.loadEntity(ctx, definition, resolvedContent)
 		if err != nil {
 			l.log.Errorw("failed to load new entity from source content",
 				"err", err, "path", path)
-			stats.FailedToCreate += 1
+			run.recordResult(definition, path, entityResultFailed, err)
 			// but continue with others since data loader can always be re-run to pick up missed ones
 		} else {
-			stats.Created += 1
+			run.recordResult(definition, path, entityResultCreated, nil)
+			existing.Add(fieldValues)
+			run.entities.add(definition, created)
+			l.recordState(definition, path, decoded, fieldValues, created, run)
 		}
 	} else {
-		stats.SkippedExisting += 1
+		run.recordResult(definition, path, entityResultSkipped, nil)
+		l.recordState(definition, path, decoded, fieldValues, nil, run)
 	}
 
 	return nil
 }
 
-func (l *LoaderImpl) loadEntity(definition LoaderDefinition, sourceContent interface{}) error {
-	err := l.restClient.Exchange("POST", definition.ApiPath, nil, restclient.NewJsonEntity(sourceContent), nil)
+// recordState tracks the entity of a content file that was created or matched an existing
+// entity. The ID comes from the created entity or else the existing entity with the same key.
+func (l *LoaderImpl) recordState(definition LoaderDefinition, path string, decoded *decodedContent,
+	fieldValues []interface{}, created interface{}, run *loadRun) {
+	if run.state == nil {
+		return
+	}
+
+	entityState := &EntityState{
+		Definition:  definition.Name,
+		Path:        run.relPath(path),
+		UniqueKey:   stateKey(UniquenessTracker{}.formKey(fieldValues)),
+		ContentHash: decoded.hash,
+	}
+	if created != nil {
+		entityState.EntityId, _ = jsonpath.Read(created, entityIdPath)
+	}
+	if entityState.EntityId == nil {
+		entityState.EntityId, _ = run.entities.lookup(definition, fieldValues)
+	}
+
+	if renamedFrom := run.state.record(entityState); renamedFrom != "" {
+		l.log.Infow("content file renamed",
+			"definition", definition.Name, "path", entityState.Path, "previousPath", renamedFrom)
+	}
+}
+
+// unchangedState returns the previous state of a content file whose content is unchanged,
+// including when it was only renamed, and whose entity still exists, in which case the file
+// needn't be processed. The entity is confirmed by the existing entities of the definition,
+// but trusted to exist for definitions that look up entities individually since avoiding those
+// lookups is the point.
+func (l *LoaderImpl) unchangedState(defRun *definitionRun, path string, run *loadRun) *EntityState {
+	if run.state == nil {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		// processing reports the problem with the file
+		return nil
+	}
+
+	previous := run.state.unchanged(defRun.definition.Name, run.relPath(path), hashContent(raw), run.sourceContentPath)
+	if previous == nil {
+		return nil
+	}
+	if defRun.definition.Lookup == nil && !defRun.existingStateKeys()[previous.UniqueKey] {
+		l.log.Debugw("entity of unchanged content file no longer exists", "path", path)
+		return nil
+	}
+	return previous
+}
+
+// processTombstone deletes the existing entity that has the tombstone's unique field values.
+// A tombstone of an entity that doesn't exist has already been applied.
+func (l *LoaderImpl) processTombstone(ctx context.Context, definition LoaderDefinition, existing UniquenessTracker,
+	path string, fieldValues []interface{}, run *loadRun) {
+	if !existing.Contains(fieldValues) {
+		l.log.Debugw("entity of tombstone is already deleted", "path", path)
+		run.recordResult(definition, path, entityResultAlreadyDeleted, nil)
+		return
+	}
+
+	id, exists := run.entities.lookup(definition, fieldValues)
+	if !exists {
+		l.log.Errorw("unable to delete entity of tombstone since the existing entity has no ID",
+			"path", path, "definition", definition.Name)
+		run.recordResult(definition, path, entityResultDeleteFailed, fmt.Errorf("existing entity has no ID"))
+		return
+	}
+
+	l.log.Infow("deleting entity of tombstone", "path", path, "definition", definition.Name, "id", id)
+	err := l.deleteEntity(ctx, definition, id)
 	if err != nil {
-		return fmt.Errorf("failed to create entity: %w", err)
+		l.log.Errorw("failed to delete entity of tombstone",
+			"err", err, "path", path)
+		run.recordResult(definition, path, entityResultDeleteFailed, err)
+		// but continue with others like failed creates
+		return
+	}
+	run.recordResult(definition, path, entityResultDeleted, nil)
+	existing.Remove(fieldValues)
+	run.entities.remove(definition, fieldValues)
+}
+
+func (l *LoaderImpl) deleteEntity(ctx context.Context, definition LoaderDefinition, id interface{}) error {
+	err := l.restClient.ExchangeWithContext(ctx, "DELETE",
+		definition.ApiPath+"/"+url.PathEscape(formatEntityId(id)), nil, nil, nil)
+	var failedResponse *restclient.FailedResponseError
+	if errors.As(err, &failedResponse) && failedResponse.StatusCode == http.StatusNotFound {
+		// deleted since the existing content was retrieved
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to delete entity: %w", err)
 	}
 	return nil
 }
+
+// loadEntity creates the entity and returns the created entity conveyed by the response, which
+// is nil if the response has no JSON body
+func (l *LoaderImpl) loadEntity(ctx context.Context, definition LoaderDefinition, sourceContent interface{}) (interface{}, error) {
+	var body bytes.Buffer
+	err := l.restClient.ExchangeWithContext(ctx, "POST", definition.ApiPath, nil,
+		restclient.NewJsonEntity(sourceContent), restclient.NewJsonEntity(&body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create entity: %w", err)
+	}
+
+	var created interface{}
+	if body.Len() > 0 {
+		// the entity was created regardless, so an undecodable response is only logged
+		if err := json.Unmarshal(body.Bytes(), &created); err != nil {
+			l.log.Warnw("failed to decode created entity", "err", err, "definition", definition.Name)
+			return nil, nil
+		}
+	}
+	return created, nil
+}
+
+// resolveEntityRef finds the ID of the referenced entity amongst the entities that existed
+// before or were created during this run. Existing entities of a definition that hasn't been
+// loaded yet, such as one excluded by the load options, are retrieved on demand.
+func (l *LoaderImpl) resolveEntityRef(ctx context.Context, ref entityRef, run *loadRun) (interface{}, error) {
+	found := findLoaderDefinition(ref.Definition)
+	if found == nil {
+		return nil, fmt.Errorf("reference to %s: unknown definition", ref)
+	}
+	definition := l.withLookup(*found)
+
+	fieldValues, err := extractFieldValues(definition, ref.Key)
+	if err != nil {
+		return nil, fmt.Errorf("reference to %s: key is missing unique fields: %w", ref, err)
+	}
+
+	if definition.Lookup != nil {
+		if _, exists := run.entities.lookup(definition, fieldValues); !exists {
+			entity, err := l.lookupExisting(ctx, definition, ref.Key, fieldValues)
+			if err != nil {
+				return nil, fmt.Errorf("reference to %s: %w", ref, err)
+			}
+			if entity != nil {
+				run.entities.add(definition, entity)
+			}
+		}
+	} else if !run.entities.indexed(definition) {
+		content, err := l.retrieveExistingPagedContent(ctx, definition)
+		if err != nil {
+			return nil, fmt.Errorf("reference to %s: %w", ref, err)
+		}
+		run.entities.addAll(definition, content)
+	}
+
+	id, exists := run.entities.lookup(definition, fieldValues)
+	if !exists {
+		return nil, fmt.Errorf("reference to %s does not match an existing or created entity", ref)
+	}
+	return id, nil
+}
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/assert"
@@ -81,19 +82,27 @@ func TestLoaderImpl_LoadAll(t *testing.T) {
 		}
 	})
 
+	// the remaining definitions have no existing content and no source content
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+	})
+
 	ts := httptest.NewServer(mux)
 	defer ts.Close()
 
-	loader, err := NewLoader(zap.NewNop().Sugar(), nil, ts.URL)
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL})
 	require.NoError(t, err)
 
 	// Finally...execute method under test
 
-	stats, err := loader.LoadAll("testdata/content")
+	stats, err := loader.LoadAll(context.Background(), "testdata/content", LoadOptions{})
 	require.NoError(t, err)
 
 	assert.Len(t, requests, 5)
 
+	// all definitions are planned before any changes are made
+
 	// GET page 0 of agent releases
 	i := 0
 	assert.Equal(t, "GET", requests[i].Method)
@@ -104,16 +113,16 @@ func TestLoaderImpl_LoadAll(t *testing.T) {
 	assert.Equal(t, "GET", requests[i].Method)
 	assert.Equal(t, "/api/agent-releases?page=1", requests[i].URL.String())
 
-	// POST missing linux 1.11.0 agent release
-	i++
-	assert.Equal(t, "POST", requests[i].Method)
-	assert.Equal(t, "/api/agent-releases", requests[i].URL.String())
-
 	// GET monitor translations
 	i++
 	assert.Equal(t, "GET", requests[i].Method)
 	assert.Equal(t, "/api/monitor-translations?page=0", requests[i].URL.String())
 
+	// POST missing linux 1.11.0 agent release
+	i++
+	assert.Equal(t, "POST", requests[i].Method)
+	assert.Equal(t, "/api/agent-releases", requests[i].URL.String())
+
 	// POST missing monitor translation
 	i++
 	assert.Equal(t, "POST", requests[i].Method)
@@ -140,6 +149,57 @@ func TestLoaderDefinitions_validUniqueFieldPaths(t *testing.T) {
 	}
 }
 
+func TestLoaderDefinitions_validUniqueFieldOptions(t *testing.T) {
+	for _, definition := range loaderDefinitions {
+		for path := range definition.UniqueFieldOptions {
+			assert.Contains(t, definition.UniqueFieldPaths, path,
+				"%s has options for a path that isn't unique", definition.Name)
+		}
+	}
+}
+
+func TestUniquenessTracker_formKey(t *testing.T) {
+	tracker := make(UniquenessTracker)
+	tracker.Add([]interface{}{"a;b", "c"})
+	tracker.Add([]interface{}{nil})
+	tracker.Add([]interface{}{float64(1)})
+
+	assert.True(t, tracker.Contains([]interface{}{"a;b", "c"}))
+	assert.False(t, tracker.Contains([]interface{}{"a", "b;c"}))
+	assert.False(t, tracker.Contains([]interface{}{"<nil>"}))
+	assert.False(t, tracker.Contains([]interface{}{"1"}))
+	assert.True(t, tracker.Contains([]interface{}{float64(1)}))
+
+	// object keys are encoded in sorted order
+	assert.Equal(t,
+		UniquenessTracker{}.formKey([]interface{}{map[string]interface{}{"b": 1, "a": 2}}),
+		`[{"a":2,"b":1}]`)
+}
+
+func TestExtractFieldValues_options(t *testing.T) {
+	definition := LoaderDefinition{
+		Name:             "testing",
+		UniqueFieldPaths: []string{"$.name", "$.region", "$.labels.zone"},
+		UniqueFieldOptions: map[string]UniqueFieldOptions{
+			"$.name":        {Normalizations: []Normalization{NormalizeTrim, NormalizeCaseFold}},
+			"$.labels.zone": {MissingAsNull: true},
+		},
+	}
+
+	fieldValues, err := extractFieldValues(definition,
+		decodeTestContent(t, `{"name":" Public/DFW ","region":"us"}`))
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"public/dfw", "us", nil}, fieldValues)
+
+	fieldValues, err = extractFieldValues(definition,
+		decodeTestContent(t, `{"name":"public/dfw","region":"us","labels":{"zone":null}}`))
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"public/dfw", "us", nil}, fieldValues)
+
+	_, err = extractFieldValues(definition, decodeTestContent(t, `{"name":"public/dfw"}`))
+	assert.Error(t, err, "region is missing and not declared as null")
+}
+
 func TestLoaderImpl_identifyExistingContent_emptyUniqueFieldPaths(t *testing.T) {
 	loader := &LoaderImpl{}
 	content := make([]interface{}, 0)
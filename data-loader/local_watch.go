@@ -0,0 +1,210 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ContentChangeFunc reloads the loader definitions whose content changed, where nil
+// definitions means all of them
+type ContentChangeFunc func(ctx context.Context, definitions []string)
+
+// LocalContentWatcher watches a content directory and reports the loader definitions whose
+// directories changed once changes have settled for the debounce duration
+type LocalContentWatcher struct {
+	log      *zap.SugaredLogger
+	root     string
+	debounce time.Duration
+	onChange ContentChangeFunc
+}
+
+func NewLocalContentWatcher(log *zap.SugaredLogger, root string, debounce time.Duration,
+	onChange ContentChangeFunc) *LocalContentWatcher {
+	return &LocalContentWatcher{
+		log:      log.Named("watch"),
+		root:     root,
+		debounce: debounce,
+		onChange: onChange,
+	}
+}
+
+// Run watches until the context is done. It returns an error only if watching fails.
+func (w *LocalContentWatcher) Run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create filesystem watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	err = w.addDirs(watcher, w.root)
+	if err != nil {
+		return err
+	}
+	w.log.Infow("watching content directory for changes", "path", w.root, "debounce", w.debounce)
+
+	changed := newChangedDefinitions()
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			w.log.Debugw("content changed", "event", event)
+			if event.Op&fsnotify.Create != 0 {
+				if info, statErr := os.Stat(event.Name); statErr == nil && info.IsDir() {
+					// files created along with the directory are loaded by the change itself
+					if addErr := w.addDirs(watcher, event.Name); addErr != nil {
+						w.log.Warnw("unable to watch new directory", "err", addErr, "path", event.Name)
+					}
+				}
+			}
+			definition, all := changedDefinition(w.root, event.Name)
+			if all {
+				changed.addAll()
+			} else if definition != "" {
+				changed.add(definition)
+			} else {
+				continue
+			}
+			settled = time.After(w.debounce)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			w.log.Warnw("filesystem watch error", "err", err)
+
+		case <-settled:
+			settled = nil
+			definitions, all := changed.take()
+			if all {
+				definitions = nil
+			}
+			w.onChange(ctx, definitions)
+		}
+	}
+}
+
+// addDirs watches the directory and its subdirectories, other than hidden ones such as .git
+func (w *LocalContentWatcher) addDirs(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != w.root && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		err = watcher.Add(path)
+		if err != nil {
+			return fmt.Errorf("failed to watch %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+// changedDefinition maps a changed path to the loader definition whose directory contains it.
+// A change of the .loaderignore file affects all definitions and other paths affect none.
+func changedDefinition(root string, path string) (definition string, all bool) {
+	relPath, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", false
+	}
+	relPath = filepath.ToSlash(relPath)
+	if relPath == loaderIgnoreFile {
+		return "", true
+	}
+
+	name := strings.SplitN(relPath, "/", 2)[0]
+	if findLoaderDefinition(name) == nil {
+		return "", false
+	}
+	return name, false
+}
+
+// changedDefinitions accumulates the definitions changed since the last reload
+type changedDefinitions struct {
+	names map[string]bool
+	all   bool
+}
+
+func newChangedDefinitions() *changedDefinitions {
+	return &changedDefinitions{names: make(map[string]bool)}
+}
+
+func (c *changedDefinitions) add(name string) {
+	c.names[name] = true
+}
+
+func (c *changedDefinitions) addAll() {
+	c.all = true
+}
+
+// take returns the changed definitions in load order and resets the accumulation
+func (c *changedDefinitions) take() ([]string, bool) {
+	var definitions []string
+	for _, definition := range loaderDefinitions {
+		if c.names[definition.Name] {
+			definitions = append(definitions, definition.Name)
+		}
+	}
+	all := c.all
+	c.names = make(map[string]bool)
+	c.all = false
+	return definitions, all
+}
+
+// restrictOptions limits the options to the changed definitions, where nil changed means all.
+// It returns false when none of the changed definitions are included by the options.
+func restrictOptions(options LoadOptions, changed []string) (LoadOptions, bool) {
+	if changed == nil {
+		return options, true
+	}
+
+	var definitions []string
+	for _, name := range changed {
+		if options.includes(*findLoaderDefinition(name)) {
+			definitions = append(definitions, name)
+		}
+	}
+	options.Definitions = definitions
+	return options, len(definitions) > 0
+}
+
+// printFileResult writes a compact line describing the outcome of a content file
+func printFileResult(out io.Writer, result FileResult) {
+	if result.Err != nil {
+		_, _ = fmt.Fprintf(out, "%-15s %s: %s\n", result.Result, result.Path, result.Err)
+	} else {
+		_, _ = fmt.Fprintf(out, "%-15s %s\n", result.Result, result.Path)
+	}
+}
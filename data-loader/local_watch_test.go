@@ -0,0 +1,165 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChangedDefinition(t *testing.T) {
+	root := filepath.FromSlash("/content")
+
+	definition, all := changedDefinition(root, filepath.FromSlash("/content/zones/dfw.json"))
+	assert.Equal(t, "zones", definition)
+	assert.False(t, all)
+
+	definition, _ = changedDefinition(root, filepath.FromSlash("/content/monitor-templates/nested/cpu.json"))
+	assert.Equal(t, "monitor-templates", definition)
+
+	definition, all = changedDefinition(root, filepath.FromSlash("/content/.loaderignore"))
+	assert.Empty(t, definition)
+	assert.True(t, all)
+
+	definition, all = changedDefinition(root, filepath.FromSlash("/content/README.md"))
+	assert.Empty(t, definition)
+	assert.False(t, all)
+}
+
+func TestRestrictOptions(t *testing.T) {
+	options := LoadOptions{Exclude: []string{"zones"}, Paths: []string{"*.json"}}
+
+	restricted, included := restrictOptions(options, []string{"agent-releases", "zones"})
+	assert.True(t, included)
+	assert.Equal(t, LoadOptions{
+		Definitions: []string{"agent-releases"},
+		Exclude:     []string{"zones"},
+		Paths:       []string{"*.json"},
+	}, restricted)
+
+	_, included = restrictOptions(options, []string{"zones"})
+	assert.False(t, included)
+
+	restricted, included = restrictOptions(options, nil)
+	assert.True(t, included)
+	assert.Equal(t, options, restricted)
+}
+
+func TestLocalContentWatcher_Run(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-watch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "zones"), 0755))
+
+	changes := make(chan []string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	watcher := NewLocalContentWatcher(zap.NewNop().Sugar(), dir, 100*time.Millisecond,
+		func(_ context.Context, definitions []string) {
+			changes <- definitions
+		})
+	stopped := make(chan error)
+	go func() {
+		stopped <- watcher.Run(ctx)
+	}()
+	// allow the watches to be added
+	time.Sleep(100 * time.Millisecond)
+
+	writeTestContent(t, dir, "zones", "dfw.json", `{"name":"public/dfw"}`)
+	writeTestContent(t, dir, "zones", "ord.json", `{"name":"public/ord"}`)
+	writeTestContent(t, dir, "monitor-templates", "cpu.json", `{"name":"cpu"}`)
+
+	select {
+	case definitions := <-changes:
+		// the changes are debounced into one reload in load order
+		assert.Equal(t, []string{"zones", "monitor-templates"}, definitions)
+	case <-time.After(5 * time.Second):
+		t.Fatal("changes were not reported")
+	}
+
+	// the new directory is watched too
+	writeTestContent(t, dir, "monitor-templates", "mem.json", `{"name":"mem"}`)
+	select {
+	case definitions := <-changes:
+		assert.Equal(t, []string{"monitor-templates"}, definitions)
+	case <-time.After(5 * time.Second):
+		t.Fatal("change in new directory was not reported")
+	}
+
+	cancel()
+	assert.NoError(t, <-stopped)
+}
+
+func TestLoaderImpl_LoadAll_OnFileResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-results")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTestContent(t, dir, "zones", "dfw.json", `{"name":"public/dfw"}`)
+	writeTestContent(t, dir, "zones", "ord.json", `{"name":"public/ord"}`)
+	writeTestContent(t, dir, "monitor-templates", "broken.json", `{"name":`)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "POST":
+			_, _ = w.Write([]byte(`{"id":"z-2","name":"public/ord"}`))
+		case r.URL.Path == "/api/zones":
+			_, _ = w.Write([]byte(`{"content":[{"id":"z-1","name":"public/dfw"}],"last":true}`))
+		default:
+			_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+		}
+	}))
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL})
+	require.NoError(t, err)
+
+	var results []FileResult
+	_, err = loader.LoadAll(context.Background(), dir, LoadOptions{
+		OnFileResult: func(result FileResult) {
+			results = append(results, result)
+		},
+	})
+	require.Error(t, err)
+
+	// in the order of the loader definitions
+	require.Len(t, results, 3)
+	assert.Equal(t, FileResult{Definition: "zones", Path: "zones/dfw.json", Result: entityResultSkipped}, results[0])
+	assert.Equal(t, FileResult{Definition: "zones", Path: "zones/ord.json", Result: entityResultCreated}, results[1])
+	assert.Equal(t, "monitor-templates/broken.json", results[2].Path)
+	assert.Equal(t, fileResultInvalid, results[2].Result)
+	assert.Error(t, results[2].Err)
+}
+
+func TestPrintFileResult(t *testing.T) {
+	var out bytes.Buffer
+	printFileResult(&out, FileResult{Path: "zones/dfw.json", Result: entityResultCreated})
+	printFileResult(&out, FileResult{Path: "zones/ord.json", Result: entityResultFailed, Err: errors.New("400 Bad Request")})
+
+	assert.Equal(t, "created         zones/dfw.json\nfailed          zones/ord.json: 400 Bad Request\n", out.String())
+}
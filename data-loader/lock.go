@@ -0,0 +1,277 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-redis/redis"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	redisLockScheme    = "redis://"
+	redisLockKeyPrefix = "data-loader:lock:"
+	lockRetryInterval  = 500 * time.Millisecond
+)
+
+var lockFilenameUnsafe = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// releaseLockScript deletes the lock only while held by the given holder
+var releaseLockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// renewLockScript extends the lease of the lock only while held by the given holder
+var renewLockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// LoadLocker serializes the loads of each Admin API target across processes
+type LoadLocker interface {
+	// Lock blocks until the lock of the key is held, the lock timeout elapses, or the context
+	// is done. The returned context is cancelled if the lock is lost and the returned function
+	// releases the lock.
+	Lock(ctx context.Context, key string) (context.Context, func(), error)
+}
+
+// LockTimeoutError conveys that another holder kept the lock for longer than the lock timeout
+type LockTimeoutError struct {
+	Key     string
+	Holder  string
+	Timeout time.Duration
+}
+
+func (e *LockTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s waiting for load lock of %s held by %s", e.Timeout, e.Key, e.Holder)
+}
+
+// NewLoadLocker creates a locker of the given redis:// URL or else local directory
+func NewLoadLocker(log *zap.SugaredLogger, location string, timeout time.Duration, lease time.Duration) (LoadLocker, error) {
+	ourLogger := log.Named("lock")
+	if strings.HasPrefix(location, redisLockScheme) {
+		options, err := redis.ParseURL(location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis lock URL: %w", err)
+		}
+		return &redisLoadLocker{
+			log:     ourLogger,
+			client:  redis.NewClient(options),
+			timeout: timeout,
+			lease:   lease,
+		}, nil
+	}
+
+	err := os.MkdirAll(location, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	return &fileLoadLocker{
+		log:     ourLogger,
+		dir:     location,
+		timeout: timeout,
+	}, nil
+}
+
+// newLockHolder describes this process along with a nonce that distinguishes concurrent
+// loads within it
+func newLockHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	nonce := make([]byte, 4)
+	_, _ = rand.Read(nonce)
+	return fmt.Sprintf("%s pid %d load %s", hostname, os.Getpid(), hex.EncodeToString(nonce))
+}
+
+// waitForLock attempts to acquire a lock until it succeeds, the timeout elapses, or the
+// context is done. Each attempt reports the current holder when the lock wasn't acquired.
+func waitForLock(ctx context.Context, log *zap.SugaredLogger, key string, timeout time.Duration,
+	attempt func() (acquired bool, holder string, err error)) error {
+
+	deadline := time.Now().Add(timeout)
+	var lastHolder string
+	for {
+		acquired, holder, err := attempt()
+		if err != nil {
+			return fmt.Errorf("failed to acquire load lock of %s: %w", key, err)
+		}
+		if acquired {
+			return nil
+		}
+
+		if holder != lastHolder {
+			log.Infow("waiting for load lock", "key", key, "holder", holder)
+			lastHolder = holder
+		}
+		if time.Now().After(deadline) {
+			return &LockTimeoutError{Key: key, Holder: holder, Timeout: timeout}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// fileLoadLocker takes an exclusive flock of a file per key, which the operating system
+// releases if the process exits. The file conveys the holder while locked.
+type fileLoadLocker struct {
+	log     *zap.SugaredLogger
+	dir     string
+	timeout time.Duration
+}
+
+func (l *fileLoadLocker) Lock(ctx context.Context, key string) (context.Context, func(), error) {
+	path := filepath.Join(l.dir, lockFilenameUnsafe.ReplaceAllString(key, "_")+".lock")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	err = waitForLock(ctx, l.log, key, l.timeout, func() (bool, string, error) {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == syscall.EWOULDBLOCK {
+			holder, _ := ioutil.ReadFile(path)
+			return false, string(holder), nil
+		}
+		return err == nil, "", err
+	})
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+
+	holder := newLockHolder()
+	if err := file.Truncate(0); err == nil {
+		_, _ = file.WriteAt([]byte(holder), 0)
+	}
+	l.log.Infow("acquired load lock", "key", key, "holder", holder, "path", path)
+
+	lockedCtx, cancel := context.WithCancel(ctx)
+	unlock := func() {
+		cancel()
+		_ = file.Truncate(0)
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		_ = file.Close()
+		l.log.Infow("released load lock", "key", key, "holder", holder)
+	}
+	return lockedCtx, unlock, nil
+}
+
+// redisLoadLocker holds a key with a lease that is renewed while loading, so that a lock
+// of a crashed process expires
+type redisLoadLocker struct {
+	log     *zap.SugaredLogger
+	client  *redis.Client
+	timeout time.Duration
+	lease   time.Duration
+}
+
+func (l *redisLoadLocker) Lock(ctx context.Context, key string) (context.Context, func(), error) {
+	redisKey := redisLockKeyPrefix + key
+	holder := newLockHolder()
+
+	err := waitForLock(ctx, l.log, key, l.timeout, func() (bool, string, error) {
+		acquired, err := l.client.SetNX(redisKey, holder, l.lease).Result()
+		if err != nil || acquired {
+			return acquired, "", err
+		}
+		current, err := l.client.Get(redisKey).Result()
+		if err == redis.Nil {
+			// released since the attempt
+			return false, "", nil
+		}
+		return false, current, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	l.log.Infow("acquired load lock", "key", key, "holder", holder, "lease", l.lease)
+
+	lockedCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	var renewals sync.WaitGroup
+	renewals.Add(1)
+	go func() {
+		defer renewals.Done()
+		l.renew(redisKey, key, holder, done, cancel)
+	}()
+
+	unlock := func() {
+		close(done)
+		renewals.Wait()
+		cancel()
+		err := releaseLockScript.Run(l.client, []string{redisKey}, holder).Err()
+		if err != nil {
+			// the lease expires the lock regardless
+			l.log.Warnw("failed to release load lock", "err", err, "key", key, "holder", holder)
+			return
+		}
+		l.log.Infow("released load lock", "key", key, "holder", holder)
+	}
+	return lockedCtx, unlock, nil
+}
+
+// renew extends the lease a few times per lease until done. If the lock is held by another
+// or can't be renewed before the lease expires, the lock is lost and the load is cancelled.
+func (l *redisLoadLocker) renew(redisKey string, key string, holder string, done <-chan struct{}, lost context.CancelFunc) {
+	ticker := time.NewTicker(l.lease / 3)
+	defer ticker.Stop()
+	renewedAt := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		renewed, err := renewLockScript.Run(l.client, []string{redisKey}, holder, l.lease.Milliseconds()).Int64()
+		switch {
+		case err == nil && renewed == 1:
+			renewedAt = time.Now()
+		case err == nil:
+			l.log.Errorw("lost load lock to another holder, cancelling load", "key", key, "holder", holder)
+			lost()
+			return
+		case time.Since(renewedAt) >= l.lease:
+			l.log.Errorw("lost load lock since its lease expired, cancelling load",
+				"err", err, "key", key, "holder", holder)
+			lost()
+			return
+		default:
+			l.log.Warnw("failed to renew load lock", "err", err, "key", key, "holder", holder)
+		}
+	}
+}
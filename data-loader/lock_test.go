@@ -0,0 +1,169 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileLoadLocker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-lock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	locker, err := NewLoadLocker(zap.NewNop().Sugar(), dir, 100*time.Millisecond, time.Minute)
+	require.NoError(t, err)
+
+	lockedCtx, unlock, err := locker.Lock(context.Background(), "https://admin.example.com")
+	require.NoError(t, err)
+	assert.NoError(t, lockedCtx.Err())
+
+	_, _, err = locker.Lock(context.Background(), "https://admin.example.com")
+	var timeoutErr *LockTimeoutError
+	require.True(t, errors.As(err, &timeoutErr), "expected lock timeout but got %v", err)
+	assert.Contains(t, timeoutErr.Holder, "pid")
+
+	// other targets are locked independently
+	_, unlockOther, err := locker.Lock(context.Background(), "https://admin.other.example.com")
+	require.NoError(t, err)
+	unlockOther()
+
+	unlock()
+	assert.Error(t, lockedCtx.Err())
+
+	_, unlock, err = locker.Lock(context.Background(), "https://admin.example.com")
+	require.NoError(t, err)
+	unlock()
+}
+
+func TestRedisLoadLocker(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	locker, err := NewLoadLocker(zap.NewNop().Sugar(), "redis://"+server.Addr()+"/0", 100*time.Millisecond, time.Minute)
+	require.NoError(t, err)
+
+	_, unlock, err := locker.Lock(context.Background(), "https://admin.example.com")
+	require.NoError(t, err)
+	holder, err := server.Get(redisLockKeyPrefix + "https://admin.example.com")
+	require.NoError(t, err)
+	assert.Contains(t, holder, "pid")
+	assert.Equal(t, time.Minute, server.TTL(redisLockKeyPrefix+"https://admin.example.com"))
+
+	_, _, err = locker.Lock(context.Background(), "https://admin.example.com")
+	var timeoutErr *LockTimeoutError
+	require.True(t, errors.As(err, &timeoutErr), "expected lock timeout but got %v", err)
+	assert.Equal(t, holder, timeoutErr.Holder)
+
+	unlock()
+	assert.False(t, server.Exists(redisLockKeyPrefix+"https://admin.example.com"))
+}
+
+func TestRedisLoadLocker_RenewsLease(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	lease := 300 * time.Millisecond
+	locker, err := NewLoadLocker(zap.NewNop().Sugar(), "redis://"+server.Addr()+"/0", time.Second, lease)
+	require.NoError(t, err)
+
+	lockedCtx, unlock, err := locker.Lock(context.Background(), "target")
+	require.NoError(t, err)
+	defer unlock()
+
+	// miniredis only ages keys when fast forwarded
+	server.FastForward(250 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return server.TTL(redisLockKeyPrefix+"target") > 250*time.Millisecond
+	}, time.Second, 20*time.Millisecond)
+	assert.NoError(t, lockedCtx.Err())
+}
+
+func TestRedisLoadLocker_LostLockCancels(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	locker, err := NewLoadLocker(zap.NewNop().Sugar(), "redis://"+server.Addr()+"/0", time.Second, 150*time.Millisecond)
+	require.NoError(t, err)
+
+	lockedCtx, unlock, err := locker.Lock(context.Background(), "target")
+	require.NoError(t, err)
+
+	require.NoError(t, server.Set(redisLockKeyPrefix+"target", "another holder"))
+	select {
+	case <-lockedCtx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("load was not cancelled after losing the lock")
+	}
+
+	// the other holder's lock is retained
+	unlock()
+	holder, err := server.Get(redisLockKeyPrefix + "target")
+	require.NoError(t, err)
+	assert.Equal(t, "another holder", holder)
+}
+
+func TestLoaderImpl_LoadAll_Locked(t *testing.T) {
+	lockDir, err := ioutil.TempDir("", "data-loader-lock")
+	require.NoError(t, err)
+	defer os.RemoveAll(lockDir)
+	contentDir, err := ioutil.TempDir("", "data-loader-content")
+	require.NoError(t, err)
+	defer os.RemoveAll(contentDir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+	}))
+	defer ts.Close()
+
+	config := &Config{AdminUrl: ts.URL, LockLocation: lockDir, LockTimeout: 100 * time.Millisecond}
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, config)
+	require.NoError(t, err)
+
+	// held by another replica loading the same target
+	otherReplica, err := NewLoadLocker(zap.NewNop().Sugar(), lockDir, time.Second, time.Minute)
+	require.NoError(t, err)
+	_, unlock, err := otherReplica.Lock(context.Background(), ts.URL)
+	require.NoError(t, err)
+
+	_, err = loader.LoadAll(context.Background(), contentDir, LoadOptions{})
+	var timeoutErr *LockTimeoutError
+	assert.True(t, errors.As(err, &timeoutErr), "expected lock timeout but got %v", err)
+
+	// planning doesn't change the target, so isn't serialized
+	_, err = loader.LoadAll(context.Background(), contentDir, LoadOptions{PlanOnly: true})
+	assert.NoError(t, err)
+
+	unlock()
+	_, err = loader.LoadAll(context.Background(), contentDir, LoadOptions{})
+	assert.NoError(t, err)
+}
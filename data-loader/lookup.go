@@ -0,0 +1,159 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/racker/go-restclient"
+	"github.com/yalp/jsonpath"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// LookupStrategy declares how the existing entity of one source content entity is retrieved
+// by its unique fields, which avoids retrieving all existing entities of a definition. Values
+// are selected from the source content by JSON paths.
+type LookupStrategy struct {
+	// UrlTemplate is an Admin API path where each {jsonpath}, such as in
+	// "/api/tenant-metadata/{$.tenantId}", is replaced by the escaped value. The response is
+	// the entity or a 404 when it doesn't exist. A response without the unique field values
+	// is also treated as not existing.
+	UrlTemplate string
+	// QueryParams maps query parameter names to JSON paths of a GET of the definition's API
+	// path, which responds with a page of entities that is searched for the unique fields.
+	QueryParams map[string]string
+}
+
+// newLookupDefinitions verifies each of the named definitions declares a lookup strategy
+func newLookupDefinitions(names []string) (map[string]bool, error) {
+	lookupDefinitions := make(map[string]bool)
+	for _, name := range names {
+		definition := findLoaderDefinition(name)
+		if definition == nil {
+			return nil, fmt.Errorf("unknown lookup definition: %s", name)
+		}
+		if definition.Lookup == nil {
+			return nil, fmt.Errorf("loader definition %s doesn't declare a lookup strategy", name)
+		}
+		lookupDefinitions[name] = true
+	}
+	return lookupDefinitions, nil
+}
+
+// withLookup drops the lookup strategy of the definition unless it was opted in to, so all of
+// its existing entities are listed
+func (l *LoaderImpl) withLookup(definition LoaderDefinition) LoaderDefinition {
+	if !l.lookupDefinitions[definition.Name] {
+		definition.Lookup = nil
+	}
+	return definition
+}
+
+var lookupTemplateParam = regexp.MustCompile(`{([^}]+)}`)
+
+// expandUrl replaces the JSON paths of the URL template with the values from the content
+func (s *LookupStrategy) expandUrl(content interface{}) (string, error) {
+	var err error
+	expanded := lookupTemplateParam.ReplaceAllStringFunc(s.UrlTemplate, func(param string) string {
+		path := param[1 : len(param)-1]
+		value, readErr := jsonpath.Read(content, path)
+		if readErr != nil {
+			err = fmt.Errorf("failed to read %s for lookup: %w", path, readErr)
+			return ""
+		}
+		return url.PathEscape(formatEntityId(value))
+	})
+	return expanded, err
+}
+
+// query builds the query parameters from the content
+func (s *LookupStrategy) query(content interface{}) (url.Values, error) {
+	query := make(url.Values)
+	for name, path := range s.QueryParams {
+		value, err := jsonpath.Read(content, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s for lookup: %w", path, err)
+		}
+		query.Set(name, formatEntityId(value))
+	}
+	return query, nil
+}
+
+// lookupExisting retrieves the existing entity with the unique field values of the given
+// content, which is nil when there is none
+func (l *LoaderImpl) lookupExisting(ctx context.Context, definition LoaderDefinition,
+	content interface{}, fieldValues []interface{}) (interface{}, error) {
+
+	lookup := definition.Lookup
+	if lookup.UrlTemplate != "" {
+		path, err := lookup.expandUrl(content)
+		if err != nil {
+			return nil, err
+		}
+
+		var body bytes.Buffer
+		err = l.restClient.ExchangeWithContext(ctx, "GET", path, nil, nil, restclient.NewJsonEntity(&body))
+		var failedResponse *restclient.FailedResponseError
+		if errors.As(err, &failedResponse) && failedResponse.StatusCode == http.StatusNotFound {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to look up existing entity: %w", err)
+		}
+
+		var entity interface{}
+		err = json.Unmarshal(body.Bytes(), &entity)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode existing entity: %w", err)
+		}
+		return matchingEntity(definition, []interface{}{entity}, fieldValues), nil
+	}
+
+	query, err := lookup.query(content)
+	if err != nil {
+		return nil, err
+	}
+	// the filters may be broader than the unique fields, so the match may be on any page
+	for page := 0; ; page++ {
+		pagedContent, err := l.retrievePage(ctx, definition, page, query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up existing entity: %w", err)
+		}
+		if entity := matchingEntity(definition, pagedContent.Content, fieldValues); entity != nil {
+			return entity, nil
+		}
+		if pagedContent.Last || len(pagedContent.Content) == 0 {
+			return nil, nil
+		}
+	}
+}
+
+// matchingEntity returns the first of the entities with the unique field values or nil if none
+func matchingEntity(definition LoaderDefinition, entities []interface{}, fieldValues []interface{}) interface{} {
+	key := UniquenessTracker{}.formKey(fieldValues)
+	for _, entity := range entities {
+		entityValues, err := extractFieldValues(definition, entity)
+		if err == nil && (UniquenessTracker{}).formKey(entityValues) == key {
+			return entity
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestLookupStrategy_expandUrl(t *testing.T) {
+	strategy := &LookupStrategy{UrlTemplate: "/api/zones/{$.name}/{$.id}"}
+
+	expanded, err := strategy.expandUrl(decodeTestContent(t, `{"name":"public/dfw","id":1234567}`))
+	require.NoError(t, err)
+	assert.Equal(t, "/api/zones/public%2Fdfw/1234567", expanded)
+
+	_, err = strategy.expandUrl(decodeTestContent(t, `{"name":"public/dfw"}`))
+	assert.Error(t, err)
+}
+
+func TestLoaderImpl_LoadAll_UrlTemplateLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-lookup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTestContent(t, dir, "tenant-metadata", "t-1.json", `{"tenantId":"t-1","key":"k","value":"v"}`)
+	writeTestContent(t, dir, "tenant-metadata", "t-2.json", `{"tenantId":"t-2","key":"k","value":"v"}`)
+
+	var posted []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/tenant-metadata":
+			t.Errorf("existing tenant metadata should not be listed")
+		case r.Method == "GET" && r.URL.Path == "/api/tenant-metadata/t-1":
+			_, _ = w.Write([]byte(`{"id":"m-1","tenantId":"t-1","key":"k","value":"v"}`))
+		case r.Method == "GET" && r.URL.Path == "/api/tenant-metadata/t-2":
+			http.NotFound(w, r)
+		case r.Method == "POST":
+			posted = append(posted, r.URL.Path)
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil,
+		&Config{AdminUrl: ts.URL, LookupDefinitions: []string{"tenant-metadata"}})
+	require.NoError(t, err)
+
+	stats, err := loader.LoadAll(context.Background(), dir, LoadOptions{Definitions: []string{"tenant-metadata"}})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"/api/tenant-metadata"}, posted)
+	assert.Equal(t, 1, stats.Created)
+	assert.Equal(t, 1, stats.SkippedExisting)
+}
+
+func TestLoaderImpl_LoadAll_LookupNotOptedIn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-lookup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTestContent(t, dir, "tenant-metadata", "t-1.json", `{"tenantId":"t-1","key":"k","value":"v"}`)
+	writeTestContent(t, dir, "tenant-metadata", "t-2.json", `{"tenantId":"t-2","key":"k","value":"v"}`)
+
+	var posted []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/tenant-metadata":
+			_, _ = w.Write([]byte(`{"content":[{"id":"m-1","tenantId":"t-1","key":"k","value":"v"}],"last":true}`))
+		case r.Method == "POST":
+			posted = append(posted, r.URL.Path)
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL})
+	require.NoError(t, err)
+
+	stats, err := loader.LoadAll(context.Background(), dir, LoadOptions{Definitions: []string{"tenant-metadata"}})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"/api/tenant-metadata"}, posted)
+	assert.Equal(t, 1, stats.Created)
+	assert.Equal(t, 1, stats.SkippedExisting)
+}
+
+func TestNewLoader_InvalidLookupDefinitions(t *testing.T) {
+	_, err := NewLoader(zap.NewNop().Sugar(), nil,
+		&Config{AdminUrl: "http://localhost", LookupDefinitions: []string{"unknown"}})
+	assert.EqualError(t, err, "unknown lookup definition: unknown")
+
+	_, err = NewLoader(zap.NewNop().Sugar(), nil,
+		&Config{AdminUrl: "http://localhost", LookupDefinitions: []string{"zones"}})
+	assert.EqualError(t, err, "loader definition zones doesn't declare a lookup strategy")
+}
+
+func TestLoaderImpl_lookupExisting_QueryParams(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/testing", r.URL.Path)
+		assert.Equal(t, "cpu", r.URL.Query().Get("search"))
+		w.Header().Set("Content-Type", "application/json")
+		// the filter also matches other entities
+		_, _ = w.Write([]byte(`{"content":[{"id":1,"name":"cpu-2"},{"id":2,"name":"cpu"}],"last":true}`))
+	}))
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL})
+	require.NoError(t, err)
+
+	definition := LoaderDefinition{
+		Name:             "testing",
+		ApiPath:          "/api/testing",
+		UniqueFieldPaths: []string{"$.name"},
+		Lookup:           &LookupStrategy{QueryParams: map[string]string{"search": "$.name"}},
+	}
+
+	entity, err := loader.(*LoaderImpl).lookupExisting(context.Background(), definition,
+		decodeTestContent(t, `{"name":"cpu"}`), []interface{}{"cpu"})
+	require.NoError(t, err)
+	assert.Equal(t, decodeTestContent(t, `{"id":2,"name":"cpu"}`), entity)
+
+	entity, err = loader.(*LoaderImpl).lookupExisting(context.Background(), definition,
+		decodeTestContent(t, `{"name":"cpu"}`), []interface{}{"mem"})
+	require.NoError(t, err)
+	assert.Nil(t, entity)
+}
+
+func TestLoaderImpl_lookupExisting_QueryParamsPaged(t *testing.T) {
+	var pages []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "cpu", r.URL.Query().Get("search"))
+		pages = append(pages, r.URL.Query().Get("page"))
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("page") {
+		case "0":
+			_, _ = w.Write([]byte(`{"content":[{"id":1,"name":"cpu-1"},{"id":2,"name":"cpu-2"}],"last":false}`))
+		case "1":
+			_, _ = w.Write([]byte(`{"content":[{"id":3,"name":"cpu"}],"last":false}`))
+		default:
+			_, _ = w.Write([]byte(`{"content":[{"id":4,"name":"cpu-4"}],"last":true}`))
+		}
+	}))
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL, PageSize: 2})
+	require.NoError(t, err)
+
+	definition := LoaderDefinition{
+		Name:             "testing",
+		ApiPath:          "/api/testing",
+		UniqueFieldPaths: []string{"$.name"},
+		Lookup:           &LookupStrategy{QueryParams: map[string]string{"search": "$.name"}},
+	}
+
+	entity, err := loader.(*LoaderImpl).lookupExisting(context.Background(), definition,
+		decodeTestContent(t, `{"name":"cpu"}`), []interface{}{"cpu"})
+	require.NoError(t, err)
+	assert.Equal(t, decodeTestContent(t, `{"id":3,"name":"cpu"}`), entity)
+	assert.Equal(t, []string{"0", "1"}, pages)
+
+	// every page is searched before concluding it doesn't exist
+	pages = nil
+	entity, err = loader.(*LoaderImpl).lookupExisting(context.Background(), definition,
+		decodeTestContent(t, `{"name":"cpu"}`), []interface{}{"mem"})
+	require.NoError(t, err)
+	assert.Nil(t, entity)
+	assert.Equal(t, []string{"0", "1", "2"}, pages)
+}
+
+func TestLoaderImpl_retrieveExistingPagedContent_Concurrent(t *testing.T) {
+	var mu sync.Mutex
+	var requested []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		require.NoError(t, err)
+		mu.Lock()
+		requested = append(requested, r.URL.Query().Get("page"))
+		mu.Unlock()
+		assert.Equal(t, "2", r.URL.Query().Get("size"))
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"content":[{"name":"z-%d-a"},{"name":"z-%d-b"}],"totalPages":4,"last":%t}`,
+			page, page, page == 3)
+	}))
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil,
+		&Config{AdminUrl: ts.URL, PageSize: 2, PageConcurrency: 3})
+	require.NoError(t, err)
+
+	content, err := loader.(*LoaderImpl).retrieveExistingPagedContent(context.Background(),
+		*findLoaderDefinition("zones"))
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []string{"0", "1", "2", "3"}, requested)
+	require.Len(t, content, 8)
+	for i, entity := range content {
+		assertJsonPath(t, entity, "$.name", fmt.Sprintf("z-%d-%c", i/2, 'a'+i%2))
+	}
+}
+
+func TestLoaderImpl_retrieveExistingPagedContent_ConcurrentFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[],"totalPages":4,"last":false}`))
+	}))
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL, PageConcurrency: 2})
+	require.NoError(t, err)
+
+	_, err = loader.(*LoaderImpl).retrieveExistingPagedContent(context.Background(),
+		*findLoaderDefinition("zones"))
+	assert.Error(t, err)
+}
@@ -18,43 +18,143 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"github.com/google/subcommands"
 	"github.com/itzg/go-flagsfiller"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 type Config struct {
+	ConfigFile string `flag:"config" usage:"a YAML or JSON [file] of option settings, which are overridden by DATA_LOADER_* environment variables and then by flags"`
+
 	IdentityUrl      string `default:"https://identity.api.rackspacecloud.com" usage:"The base URL of the Identity endpoint to use for authentication"`
 	IdentityUsername string `usage:"username of a user in Identity that has access to the Salus Admin API"`
-	IdentityPassword string `usage:"if apikey is not provided, the password for the given user"`
-	IdentityApikey   string `usage:"if password is not provided, the apikey for the given user"`
+	IdentityPassword string `secret:"true" usage:"if apikey is not provided, the password for the given user"`
+	IdentityApikey   string `secret:"true" usage:"if password is not provided, the apikey for the given user"`
+
+	AuthMode string `default:"auto" usage:"how Admin API requests are authenticated: auto, none, identity-v2, keystone-v3, bearer, mtls, or oauth2. auto uses identity-v2 unless the admin URL is a localhost one"`
+
+	IdentityUserDomain    string `default:"Default" usage:"for keystone-v3, the domain of the given user"`
+	IdentityProject       string `usage:"for keystone-v3, if given, the project to scope the token"`
+	IdentityProjectDomain string `default:"Default" usage:"for keystone-v3, the domain of the given project"`
+
+	BearerToken     string `secret:"true" usage:"for bearer, the static [token] to present"`
+	BearerTokenFile string `usage:"for bearer, a [file] containing the token to present, which is re-read for each request"`
+
+	ClientCertFile string `usage:"for mtls, the PEM client certificate [file]"`
+	ClientKeyFile  string `usage:"for mtls, the PEM client key [file]"`
+	ServerCaFile   string `usage:"for mtls, if given, the PEM CA [file] used to verify the Admin API server"`
+
+	Oauth2TokenUrl     string   `flag:"oauth2-token-url" usage:"for oauth2, the token endpoint [URL] of the client credentials flow"`
+	Oauth2ClientId     string   `flag:"oauth2-client-id" usage:"for oauth2, the client ID"`
+	Oauth2ClientSecret string   `flag:"oauth2-client-secret" secret:"true" usage:"for oauth2, the client secret"`
+	Oauth2Scopes       []string `flag:"oauth2-scopes" usage:"for oauth2, the scopes to request"`
+
+	AgeKeyFile string `usage:"a [file] of age identities used to decrypt encrypted content files"`
+	AgeKey     string `secret:"true" usage:"an age identity used to decrypt encrypted content files, typically given by its environment variable"`
+
+	SecretEnvPrefix string   `usage:"if given, the [prefix] of the environment variables that secret references in content may resolve, such as CONTENT_SECRET_"`
+	SecretDirs      []string `usage:"the [directories] containing the files that secret references in content may resolve"`
 
 	AdminUrl string `usage:"The base URL of the Salus Admin API endpoint to use"`
 
+	PageSize        int `usage:"if given, the number of existing entities requested per page"`
+	PageConcurrency int `default:"4" usage:"the number of pages of existing entities requested at a time when the total number of pages is known"`
+	// LookupDefinitions opt in to the lookup strategy declared by each named definition
+	LookupDefinitions []string `usage:"the loader [definitions] whose existing entities are retrieved individually by their declared lookup strategy rather than all listed, such as tenant-metadata"`
+
+	MaxCreates                 int     `usage:"if given, the most entities a load may create across all loader definitions"`
+	MaxChangePercent           float64 `usage:"if given, the most entities a load may create or delete as a percent of the existing entities across all loader definitions"`
+	DefinitionMaxCreates       int     `usage:"if given, the most entities a load may create for each loader definition that doesn't declare its own guardrails"`
+	DefinitionMaxChangePercent float64 `usage:"if given, the most entities a load may create or delete as a percent of the existing entities of each loader definition that doesn't declare its own guardrails"`
+
+	PushgatewayUrl string `usage:"if given, the [URL] of a Pushgateway compatible endpoint where loading commands push metrics"`
+
+	DataDir string `usage:"if given, the [directory] where the history of loads is persisted"`
+
+	StateLocation string `usage:"if given, the local [file] or gs://bucket/object where the entity of each content file is tracked. {target} is replaced by the routing target name"`
+
+	LockLocation string        `secret:"true" usage:"if given, a local [directory] or redis://host:port/db URL where each load takes a lock of its Admin API target, which serializes loads across processes"`
+	LockTimeout  time.Duration `default:"10m" usage:"how long a load waits for the lock of its Admin API target"`
+	LockLease    time.Duration `default:"30s" usage:"for a redis lock, how long the lock outlives a holder that stops renewing it"`
+
 	Debug bool `usage:"Enables debug level logging"`
 }
 
+// ForTarget creates a copy of this config that uses the target's Admin URL and any Identity
+// settings declared by the target
+func (c *Config) ForTarget(target TargetConfig) *Config {
+	targetConfig := *c
+	targetConfig.AdminUrl = target.AdminUrl
+	if target.IdentityUrl != "" {
+		targetConfig.IdentityUrl = target.IdentityUrl
+	}
+	if target.IdentityUsername != "" {
+		targetConfig.IdentityUsername = target.IdentityUsername
+		targetConfig.IdentityPassword = target.IdentityPassword
+		targetConfig.IdentityApikey = target.IdentityApikey
+	}
+	targetConfig.StateLocation = stateLocationForTarget(c.StateLocation, target.Name)
+	return &targetConfig
+}
+
 func main() {
 
+	loadingCommands := []*layeredCommand{
+		{Command: &loadFromGitCmd{}, legacyEnv: githubTokenLegacyEnv},
+		{Command: &loadFromLocalDirCmd{}},
+		{Command: &watchGitCmd{}, legacyEnv: githubTokenLegacyEnv},
+		{Command: &validateCmd{}},
+	}
+	webhookServerCommand := &layeredCommand{Command: &webhookServerCmd{}, legacyEnv: legacyEnvOriginal}
+	commands := append(loadingCommands, webhookServerCommand)
+
 	subcommands.Register(subcommands.HelpCommand(), "")
 	subcommands.Register(subcommands.FlagsCommand(), "")
-	subcommands.Register(&loadFromGitCmd{}, "loading")
-	subcommands.Register(&loadFromLocalDirCmd{}, "loading")
-	subcommands.Register(&webhookServerCmd{}, "")
+	for _, command := range loadingCommands {
+		subcommands.Register(command, "loading")
+	}
+	subcommands.Register(webhookServerCommand, "")
+	subcommands.Register(&configCmd{commands: commands}, "")
 
 	var config Config
 
-	err := flagsfiller.Parse(&config, flagsfiller.WithEnv(""))
+	filler := flagsfiller.New()
+	err := filler.Fill(flag.CommandLine, &config)
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "internal error: %s", err)
 		os.Exit(3)
 	}
+	describeEnv(flag.CommandLine)
+	flag.Parse()
+
+	commandNames := make([]string, 0, len(commands))
+	for _, command := range commands {
+		commandNames = append(commandNames, command.Name())
+	}
+	configFile, err := setupGlobalConfig(flag.CommandLine, commandNames)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "invalid config: %s\n", err)
+		os.Exit(int(subcommands.ExitUsageError))
+	}
 
 	SetupLogger(config.Debug)
 	defer CloseLogger()
 
 	log := CreateLogger("main")
 
-	os.Exit(int(subcommands.Execute(context.Background(), log, &config)))
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Infow("received signal, stopping", "signal", sig)
+		cancel()
+	}()
+
+	os.Exit(int(subcommands.Execute(ctx, log, &config, configFile)))
 }
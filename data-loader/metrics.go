@@ -0,0 +1,171 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/racker/go-restclient"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const metricsNamespace = "data_loader"
+
+const (
+	entityResultCreated = "created"
+	entityResultSkipped = "skipped"
+	entityResultFailed  = "failed"
+	// results of tombstone files
+	entityResultDeleted        = "deleted"
+	entityResultAlreadyDeleted = "already_deleted"
+	entityResultDeleteFailed   = "delete_failed"
+)
+
+const (
+	deliveryOutcomeLoaded       = "loaded"
+	deliveryOutcomeIgnored      = "ignored"
+	deliveryOutcomeFailed       = "failed"
+	deliveryOutcomeUnauthorized = "unauthorized"
+	deliveryOutcomeInvalid      = "invalid"
+	deliveryOutcomeRejected     = "rejected"
+	deliveryOutcomeRefused      = "refused"
+	deliveryOutcomePending      = "pending"
+	deliveryOutcomeDuplicate    = "duplicate"
+)
+
+var (
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Github webhook deliveries by event type and outcome",
+	}, []string{"event", "outcome"})
+
+	loadedEntities = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "entities_total",
+		Help:      "Source content entities processed by loader definition and result",
+	}, []string{"definition", "result"})
+
+	cloneDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "clone_duration_seconds",
+		Help:      "Duration of cloning and checking out source content from git",
+		Buckets:   prometheus.ExponentialBuckets(0.25, 2, 10),
+	})
+
+	paginationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "pagination_duration_seconds",
+		Help:      "Duration of retrieving all pages of existing content by loader definition",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"definition"})
+
+	adminApiDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "admin_api_duration_seconds",
+		Help:      "Latency of Admin API calls by method and response status",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "status"})
+
+	driftChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "drift_checks_total",
+		Help:      "Periodic drift checks by target and outcome",
+	}, []string{"target", "outcome"})
+
+	driftEntities = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "drift_entities",
+		Help:      "Entities the content would create or delete by target as of the last drift check",
+	}, []string{"target", "change"})
+
+	watchPolls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "watch_polls_total",
+		Help:      "Polls of the watched git ref by outcome",
+	}, []string{"outcome"})
+
+	lastSuccessfulLoad = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_successful_load_timestamp_seconds",
+		Help:      "Unix time of the last successful load by target along with the loaded SHA",
+	}, []string{"target", "sha"})
+
+	// lastLoadedShas tracks the sha label currently reported per target so that it can be
+	// replaced rather than accumulated
+	lastLoadedShas      = make(map[string]string)
+	lastLoadedShasMutex sync.Mutex
+)
+
+// recordSuccessfulLoad sets the last successful load gauge of the target to now
+func recordSuccessfulLoad(target string, sha string) {
+	lastLoadedShasMutex.Lock()
+	defer lastLoadedShasMutex.Unlock()
+
+	if previous, exists := lastLoadedShas[target]; exists && previous != sha {
+		lastSuccessfulLoad.DeleteLabelValues(target, previous)
+	}
+	lastLoadedShas[target] = sha
+	lastSuccessfulLoad.WithLabelValues(target, sha).SetToCurrentTime()
+}
+
+// recordDriftCheck counts the drift check and, when it planned the load, sets the drift
+// gauges of its target
+func recordDriftCheck(status *DriftStatus) {
+	driftChecks.WithLabelValues(status.Target, status.Outcome).Inc()
+	if status.Plan != nil {
+		driftEntities.WithLabelValues(status.Target, "create").Set(float64(status.Plan.Creates))
+		driftEntities.WithLabelValues(status.Target, "delete").Set(float64(status.Plan.Deletes))
+	}
+}
+
+// adminApiMetricsInterceptor observes the latency of each Admin API call. It should be added
+// after any authentication interceptor so that only the Admin API call itself is observed.
+func adminApiMetricsInterceptor(req *http.Request, next restclient.NextCallback) (*http.Response, error) {
+	start := time.Now()
+	resp, err := next(req)
+
+	status := "error"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	adminApiDuration.WithLabelValues(req.Method, status).Observe(time.Since(start).Seconds())
+
+	return resp, err
+}
+
+// pushMetrics sends all metrics to a Pushgateway compatible endpoint, if configured.
+// Since this is used at the end of CLI runs, failures are only logged.
+func pushMetrics(log *zap.SugaredLogger, pushgatewayUrl string) {
+	if pushgatewayUrl == "" {
+		return
+	}
+
+	err := push.New(pushgatewayUrl, metricsNamespace).
+		Gatherer(prometheus.DefaultGatherer).
+		Push()
+	if err != nil {
+		log.Warnw("failed to push metrics", "err", err, "url", pushgatewayUrl)
+	} else {
+		log.Debugw("pushed metrics", "url", pushgatewayUrl)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecordSuccessfulLoad_ReplacesSha(t *testing.T) {
+	recordSuccessfulLoad("metrics-test", "sha-1")
+	recordSuccessfulLoad("metrics-test", "sha-2")
+
+	assert.Greater(t, testutil.ToFloat64(lastSuccessfulLoad.WithLabelValues("metrics-test", "sha-2")), float64(0))
+	assert.False(t, lastSuccessfulLoad.DeleteLabelValues("metrics-test", "sha-1"),
+		"previous sha should have been removed")
+}
+
+func TestAdminApiMetricsInterceptor(t *testing.T) {
+	before := testutil.CollectAndCount(adminApiDuration)
+
+	req := httptest.NewRequest("DELETE", "/api/testing", nil)
+	_, err := adminApiMetricsInterceptor(req, func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 418}, nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, before+1, testutil.CollectAndCount(adminApiDuration))
+}
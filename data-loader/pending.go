@@ -0,0 +1,483 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pendingPath                 = "/pending"
+	pendingActionApprove        = "approve"
+	pendingActionReject         = "reject"
+	allowLargeChangeParam       = "allowLargeChange"
+	pendingFilename             = "pending.json"
+	redisPendingKeyPrefix       = "data-loader:pending:"
+	redisPendingTargetKeyPrefix = "data-loader:pending-target:"
+)
+
+// addPendingScript stores a pending load and its target's reference to it, deleting the
+// pending load the target referenced before
+var addPendingScript = redis.NewScript(`
+local previous = redis.call("get", KEYS[2])
+if previous then
+	redis.call("del", ARGV[4] .. previous)
+end
+redis.call("set", KEYS[1], ARGV[1], "px", ARGV[2])
+redis.call("set", KEYS[2], ARGV[3], "px", ARGV[2])
+return 1`)
+
+// PendingLoad is a plan computed for a push event to a target that requires approval, which
+// is applied only once approved
+type PendingLoad struct {
+	Id         string    `json:"id"`
+	Target     string    `json:"target"`
+	DeliveryId string    `json:"deliveryId,omitempty"`
+	Repository string    `json:"repository"`
+	Ref        string    `json:"ref,omitempty"`
+	Sha        string    `json:"sha"`
+	Plan       *LoadPlan `json:"plan"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// pendingStore keeps the pending loads where each target has at most one, since a newer push
+// supersedes the content of an earlier one
+type pendingStore interface {
+	// add stores a pending load for the record's plan, replacing any pending load of the target
+	add(record *LoadRecord, plan *LoadPlan) (*PendingLoad, error)
+	// list returns the unexpired pending loads, oldest first
+	list() ([]*PendingLoad, error)
+	// take removes and returns the pending load, which is nil if it doesn't exist or expired
+	take(id string) (*PendingLoad, error)
+}
+
+// newPendingStore creates a store of the given redis:// URL, which is shared by replicas, or
+// else a local directory. Without a location the pending loads are only kept in memory.
+func newPendingStore(location string, expiry time.Duration) (pendingStore, error) {
+	if strings.HasPrefix(location, redisLockScheme) {
+		options, err := redis.ParseURL(location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis pending URL: %w", err)
+		}
+		return &redisPendingLoads{
+			client: redis.NewClient(options),
+			expiry: expiry,
+		}, nil
+	}
+
+	if location == "" {
+		return newPendingLoads(expiry, ""), nil
+	}
+	return openPendingLoads(filepath.Join(location, pendingFilename), expiry)
+}
+
+func newPendingLoad(record *LoadRecord, plan *LoadPlan, expiry time.Duration) (*PendingLoad, error) {
+	id, err := newPendingId()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &PendingLoad{
+		Id:         id,
+		Target:     record.Target,
+		DeliveryId: record.DeliveryId,
+		Repository: record.Repository,
+		Ref:        record.Ref,
+		Sha:        record.Sha,
+		Plan:       plan,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(expiry),
+	}, nil
+}
+
+func sortPendingLoads(loads []*PendingLoad) {
+	sort.Slice(loads, func(i, j int) bool {
+		return loads[i].CreatedAt.Before(loads[j].CreatedAt)
+	})
+}
+
+// pendingLoads holds the pending loads in memory and, if given a path, persists them so they
+// survive restarts
+type pendingLoads struct {
+	expiry time.Duration
+	path   string
+	mutex  sync.Mutex
+	loads  map[string]*PendingLoad
+}
+
+func newPendingLoads(expiry time.Duration, path string) *pendingLoads {
+	return &pendingLoads{
+		expiry: expiry,
+		path:   path,
+		loads:  make(map[string]*PendingLoad),
+	}
+}
+
+// openPendingLoads reads the pending loads persisted at the path, if any
+func openPendingLoads(path string, expiry time.Duration) (*pendingLoads, error) {
+	p := newPendingLoads(expiry, path)
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read pending loads file: %w", err)
+	}
+	if err == nil {
+		var loads []*PendingLoad
+		err = json.Unmarshal(content, &loads)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pending loads file: %w", err)
+		}
+		for _, pending := range loads {
+			p.loads[pending.Id] = pending
+		}
+	}
+	return p, nil
+}
+
+func (p *pendingLoads) add(record *LoadRecord, plan *LoadPlan) (*PendingLoad, error) {
+	pending, err := newPendingLoad(record, plan, p.expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	err = p.update(func(loads map[string]*PendingLoad) {
+		for existingId, existing := range loads {
+			if existing.Target == pending.Target {
+				delete(loads, existingId)
+			}
+		}
+		loads[pending.Id] = pending
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+func (p *pendingLoads) list() ([]*PendingLoad, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	loads := make([]*PendingLoad, 0, len(p.loads))
+	for _, pending := range p.loads {
+		if !now.After(pending.ExpiresAt) {
+			loads = append(loads, pending)
+		}
+	}
+	sortPendingLoads(loads)
+	return loads, nil
+}
+
+func (p *pendingLoads) take(id string) (*PendingLoad, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	pending := p.loads[id]
+	if pending == nil || time.Now().After(pending.ExpiresAt) {
+		return nil, nil
+	}
+	err := p.update(func(loads map[string]*PendingLoad) {
+		delete(loads, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// update applies the change, and removes expired loads, from a copy of the pending loads that
+// replaces them once persisted. The mutex must be held.
+func (p *pendingLoads) update(change func(loads map[string]*PendingLoad)) error {
+	loads := make(map[string]*PendingLoad, len(p.loads))
+	for id, pending := range p.loads {
+		loads[id] = pending
+	}
+	change(loads)
+	now := time.Now()
+	for id, pending := range loads {
+		if now.After(pending.ExpiresAt) {
+			delete(loads, id)
+		}
+	}
+
+	if p.path != "" {
+		persisted := make([]*PendingLoad, 0, len(loads))
+		for _, pending := range loads {
+			persisted = append(persisted, pending)
+		}
+		sortPendingLoads(persisted)
+		content, err := json.Marshal(persisted)
+		if err == nil {
+			err = writeFileAtomically(p.path, content)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to persist pending loads: %w", err)
+		}
+	}
+
+	p.loads = loads
+	return nil
+}
+
+// redisPendingLoads keeps each pending load under its own key that expires with it, along with
+// a key of its target referencing the ID of the target's pending load
+type redisPendingLoads struct {
+	client *redis.Client
+	expiry time.Duration
+}
+
+func (p *redisPendingLoads) add(record *LoadRecord, plan *LoadPlan) (*PendingLoad, error) {
+	pending, err := newPendingLoad(record, plan, p.expiry)
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(pending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode pending load: %w", err)
+	}
+
+	// an expired load is stored only briefly since redis requires a positive expiry
+	ttl := time.Until(pending.ExpiresAt)
+	if ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+	err = addPendingScript.Run(p.client,
+		[]string{redisPendingKeyPrefix + pending.Id, redisPendingTargetKeyPrefix + pending.Target},
+		string(content), ttl.Milliseconds(), pending.Id, redisPendingKeyPrefix).Err()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to store pending load: %w", err)
+	}
+	return pending, nil
+}
+
+func (p *redisPendingLoads) list() ([]*PendingLoad, error) {
+	now := time.Now()
+	loads := make([]*PendingLoad, 0)
+	iter := p.client.Scan(0, redisPendingKeyPrefix+"*", 0).Iterator()
+	for iter.Next() {
+		content, err := p.client.Get(iter.Val()).Bytes()
+		if err == redis.Nil {
+			// expired or taken since scanned
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to retrieve pending load: %w", err)
+		}
+
+		var pending PendingLoad
+		err = json.Unmarshal(content, &pending)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode pending load: %w", err)
+		}
+		if !now.After(pending.ExpiresAt) {
+			loads = append(loads, &pending)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list pending loads: %w", err)
+	}
+
+	sortPendingLoads(loads)
+	return loads, nil
+}
+
+func (p *redisPendingLoads) take(id string) (*PendingLoad, error) {
+	// retrieved and deleted together so that only one replica takes it
+	var get *redis.StringCmd
+	_, err := p.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		get = pipe.Get(redisPendingKeyPrefix + id)
+		pipe.Del(redisPendingKeyPrefix + id)
+		return nil
+	})
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to take pending load: %w", err)
+	}
+
+	var pending PendingLoad
+	err = json.Unmarshal([]byte(get.Val()), &pending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode pending load: %w", err)
+	}
+	if time.Now().After(pending.ExpiresAt) {
+		return nil, nil
+	}
+	return &pending, nil
+}
+
+func newPendingId() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate pending load ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// planFromGit prepares the content at the record's repository and SHA and stores the plan of
+// loading it into the target as a pending load
+func (s *WebhookServer) planFromGit(target *LoadTarget, record *LoadRecord) (*PendingLoad, error) {
+	stats, err := s.planLoad(target, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.pendingLoads.add(record, stats.Plan)
+}
+
+// pendingViolations returns the guardrails exceeded by the plan of the pending load, if any
+func (s *WebhookServer) pendingViolations(id string) ([]string, error) {
+	loads, err := s.pendingLoads.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, pending := range loads {
+		if pending.Id == id {
+			return pending.Plan.Violations, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *WebhookServer) handlePendingList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.isAuthorizedCaller(r) {
+		s.log.Warnw("unauthorized pending request", "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	loads, err := s.pendingLoads.list()
+	if err != nil {
+		s.log.Warnw("failed to list pending loads", "err", err)
+		s.writeErrResponse(http.StatusInternalServerError, w, err)
+		return
+	}
+	s.writeJsonResponse(w, loads)
+}
+
+// handlePendingAction approves or rejects the pending load at /pending/{id}/{action}
+func (s *WebhookServer) handlePendingAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.isAuthorizedCaller(r) {
+		s.log.Warnw("unauthorized pending request", "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, pendingPath+"/"), "/")
+	if len(parts) != 2 || (parts[1] != pendingActionApprove && parts[1] != pendingActionReject) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id, action := parts[0], parts[1]
+	allowLargeChange, _ := strconv.ParseBool(r.URL.Query().Get(allowLargeChangeParam))
+
+	if action == pendingActionApprove && !allowLargeChange {
+		// refused without taking it, so that it may be approved again allowing the large change
+		violations, err := s.pendingViolations(id)
+		if err != nil {
+			s.log.Warnw("failed to list pending loads", "err", err)
+			s.writeErrResponse(http.StatusInternalServerError, w, err)
+			return
+		} else if len(violations) > 0 {
+			s.log.Warnw("refused approval of pending load that exceeds change guardrails",
+				"id", id, "violations", violations, "remote", r.RemoteAddr)
+			s.writeErrResponse(http.StatusConflict, w, &GuardrailError{Violations: violations})
+			return
+		}
+	}
+
+	pending, err := s.pendingLoads.take(id)
+	if err != nil {
+		s.log.Warnw("failed to take pending load", "err", err, "id", id)
+		s.writeErrResponse(http.StatusInternalServerError, w, err)
+		return
+	} else if pending == nil {
+		s.writeErrResponse(http.StatusNotFound, w, fmt.Errorf("no pending load %s, it may have expired", id))
+		return
+	}
+
+	if action == pendingActionReject {
+		s.log.Infow("rejected pending load", "pending", pending, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	target := s.router.Target(pending.Target)
+	if target == nil {
+		s.writeErrResponse(http.StatusInternalServerError, w, fmt.Errorf("unknown target: %s", pending.Target))
+		return
+	}
+
+	s.log.Infow("loading source content for approved pending load",
+		"pending", pending, "remote", r.RemoteAddr)
+	stats, err := s.loadFromGit(target, &LoadRecord{
+		Trigger:    triggerApproval,
+		DeliveryId: pending.DeliveryId,
+		Repository: pending.Repository,
+		Ref:        pending.Ref,
+		Sha:        pending.Sha,
+	}, LoadOptions{ExpectedFingerprint: pending.Plan.Fingerprint, AllowLargeChange: allowLargeChange})
+	var guardrailErr *GuardrailError
+	if errors.Is(err, errShuttingDown) {
+		s.writeErrResponse(http.StatusServiceUnavailable, w, err)
+		return
+	} else if errors.Is(err, errExistingContentChanged) || errors.As(err, &guardrailErr) {
+		// the content needs to be planned again by a push or manual reload
+		s.log.Warnw("refused approved pending load", "err", err, "target", target.Name)
+		s.writeErrResponse(http.StatusConflict, w, err)
+		return
+	} else if err != nil {
+		s.log.Warnw("failed to apply approved pending load", "err", err, "target", target.Name)
+		s.writeErrResponse(http.StatusInternalServerError, w, err)
+		return
+	}
+
+	s.writeResultResponse(w, &LoadResult{
+		Target: target.Name,
+		Ref:    pending.Ref,
+		Sha:    pending.Sha,
+		Stats:  stats,
+	})
+}
@@ -0,0 +1,359 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// planningLoader plans creates against existing content with the given fingerprint and
+// records the options of each load
+type planningLoader struct {
+	creates     int
+	fingerprint string
+	// violations are reported by the plan and refuse the load unless large changes are allowed
+	violations []string
+	loads      []LoadOptions
+}
+
+func (l *planningLoader) LoadAll(ctx context.Context, sourceContentPath string, options LoadOptions) (*LoaderStats, error) {
+	l.loads = append(l.loads, options)
+	stats := newLoaderStats()
+	stats.Plan = &LoadPlan{Creates: l.creates, Fingerprint: l.fingerprint, Violations: l.violations}
+	if options.ExpectedFingerprint != "" && options.ExpectedFingerprint != l.fingerprint {
+		return stats, errExistingContentChanged
+	}
+	if len(l.violations) > 0 && !options.PlanOnly && !options.AllowLargeChange {
+		return stats, &GuardrailError{Violations: l.violations}
+	}
+	if !options.PlanOnly {
+		stats.Created = l.creates
+	}
+	return stats, nil
+}
+
+func TestWebhookServer_PendingApproval(t *testing.T) {
+	server, loader := createTestApprovalServer(t, time.Hour)
+
+	result := pushForApproval(t, server)
+	require.NotEmpty(t, result.PendingId)
+	assert.Equal(t, "mock-revision", result.Sha)
+	assert.Equal(t, 1, result.Stats.Plan.Creates)
+	require.Len(t, loader.loads, 1)
+	assert.True(t, loader.loads[0].PlanOnly)
+
+	resp := httptest.NewRecorder()
+	server.handlePendingList(resp, createPendingReq("GET", "/pending", "reload-token"))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var pending []*PendingLoad
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &pending))
+	require.Len(t, pending, 1)
+	assert.Equal(t, result.PendingId, pending[0].Id)
+	assert.Equal(t, "default", pending[0].Target)
+	assert.Equal(t, "id-1", pending[0].DeliveryId)
+	assert.Equal(t, "refs/heads/master", pending[0].Ref)
+	assert.Equal(t, "mock-revision", pending[0].Sha)
+
+	resp = httptest.NewRecorder()
+	server.handlePendingAction(resp, createPendingReq("POST", "/pending/"+result.PendingId+"/approve", "reload-token"))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var applied LoadResult
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &applied))
+	assert.Equal(t, 1, applied.Stats.Created)
+	require.Len(t, loader.loads, 2)
+	assert.Equal(t, LoadOptions{Revision: "mock-revision", ExpectedFingerprint: "fp-1"}, loader.loads[1])
+
+	// an approved load is no longer pending
+	resp = httptest.NewRecorder()
+	server.handlePendingAction(resp, createPendingReq("POST", "/pending/"+result.PendingId+"/approve", "reload-token"))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestWebhookServer_PendingApproval_ExistingContentChanged(t *testing.T) {
+	server, loader := createTestApprovalServer(t, time.Hour)
+
+	result := pushForApproval(t, server)
+	loader.fingerprint = "fp-2"
+
+	resp := httptest.NewRecorder()
+	server.handlePendingAction(resp, createPendingReq("POST", "/pending/"+result.PendingId+"/approve", "reload-token"))
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "existing content changed")
+}
+
+func TestWebhookServer_PendingApproval_LargeChange(t *testing.T) {
+	server, loader := createTestApprovalServer(t, time.Hour)
+	loader.violations = []string{"the load would create 1 entities, more than the limit of 0"}
+
+	// the plan is still pending along with the guardrails it exceeds
+	result := pushForApproval(t, server)
+	require.NotEmpty(t, result.PendingId)
+	assert.Equal(t, loader.violations, result.Stats.Plan.Violations)
+
+	resp := httptest.NewRecorder()
+	server.handlePendingAction(resp, createPendingReq("POST", "/pending/"+result.PendingId+"/approve", "reload-token"))
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "more than the limit of 0")
+	assert.Len(t, loader.loads, 1)
+
+	resp = httptest.NewRecorder()
+	server.handlePendingAction(resp, createPendingReq("POST",
+		"/pending/"+result.PendingId+"/approve?allowLargeChange=true", "reload-token"))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	require.Len(t, loader.loads, 2)
+	assert.Equal(t, LoadOptions{Revision: "mock-revision", ExpectedFingerprint: "fp-1", AllowLargeChange: true},
+		loader.loads[1])
+}
+
+func TestWebhookServer_PendingApproval_Reject(t *testing.T) {
+	server, loader := createTestApprovalServer(t, time.Hour)
+
+	result := pushForApproval(t, server)
+
+	resp := httptest.NewRecorder()
+	server.handlePendingAction(resp, createPendingReq("POST", "/pending/"+result.PendingId+"/reject", "reload-token"))
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+
+	resp = httptest.NewRecorder()
+	server.handlePendingList(resp, createPendingReq("GET", "/pending", "reload-token"))
+	assert.Equal(t, "[]", resp.Body.String())
+	// only planned
+	assert.Len(t, loader.loads, 1)
+}
+
+func TestWebhookServer_PendingApproval_Expired(t *testing.T) {
+	server, loader := createTestApprovalServer(t, -time.Second)
+
+	result := pushForApproval(t, server)
+
+	resp := httptest.NewRecorder()
+	server.handlePendingAction(resp, createPendingReq("POST", "/pending/"+result.PendingId+"/approve", "reload-token"))
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Len(t, loader.loads, 1)
+}
+
+func TestWebhookServer_PendingApproval_Unauthorized(t *testing.T) {
+	server, loader := createTestApprovalServer(t, time.Hour)
+
+	result := pushForApproval(t, server)
+
+	resp := httptest.NewRecorder()
+	server.handlePendingList(resp, createPendingReq("GET", "/pending", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	resp = httptest.NewRecorder()
+	server.handlePendingAction(resp, createPendingReq("POST", "/pending/"+result.PendingId+"/approve", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Len(t, loader.loads, 1)
+}
+
+func TestPendingStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-pending")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	redisServer, err := miniredis.Run()
+	require.NoError(t, err)
+	defer redisServer.Close()
+
+	for _, location := range []string{"", dir, "redis://" + redisServer.Addr() + "/0"} {
+		t.Run(location, func(t *testing.T) {
+			pendingLoads, err := newPendingStore(location, time.Hour)
+			require.NoError(t, err)
+
+			first, err := pendingLoads.add(&LoadRecord{Target: "prod", Sha: "sha-1"}, &LoadPlan{})
+			require.NoError(t, err)
+			_, err = pendingLoads.add(&LoadRecord{Target: "staging", Sha: "sha-1"}, &LoadPlan{})
+			require.NoError(t, err)
+			second, err := pendingLoads.add(&LoadRecord{Target: "prod", Sha: "sha-2"}, &LoadPlan{Creates: 2})
+			require.NoError(t, err)
+
+			loads, err := pendingLoads.list()
+			require.NoError(t, err)
+			require.Len(t, loads, 2)
+			assert.Equal(t, "staging", loads[0].Target)
+			assert.Equal(t, second.Id, loads[1].Id)
+			assert.Equal(t, 2, loads[1].Plan.Creates)
+
+			taken, err := pendingLoads.take(first.Id)
+			require.NoError(t, err)
+			assert.Nil(t, taken)
+			taken, err = pendingLoads.take(second.Id)
+			require.NoError(t, err)
+			require.NotNil(t, taken)
+			assert.Equal(t, "sha-2", taken.Sha)
+			taken, err = pendingLoads.take(second.Id)
+			require.NoError(t, err)
+			assert.Nil(t, taken)
+
+			expiring, err := newPendingStore(location, -time.Second)
+			require.NoError(t, err)
+			expired, err := expiring.add(&LoadRecord{Target: "dev", Sha: "sha-1"}, &LoadPlan{})
+			require.NoError(t, err)
+			taken, err = expiring.take(expired.Id)
+			require.NoError(t, err)
+			assert.Nil(t, taken)
+		})
+	}
+}
+
+func TestPendingStore_SurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-pending")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pendingLoads, err := newPendingStore(dir, time.Hour)
+	require.NoError(t, err)
+	pending, err := pendingLoads.add(&LoadRecord{Target: "prod", Sha: "sha-1"}, &LoadPlan{Fingerprint: "fp-1"})
+	require.NoError(t, err)
+
+	restarted, err := newPendingStore(dir, time.Hour)
+	require.NoError(t, err)
+	taken, err := restarted.take(pending.Id)
+	require.NoError(t, err)
+	require.NotNil(t, taken)
+	assert.Equal(t, "fp-1", taken.Plan.Fingerprint)
+
+	restarted, err = newPendingStore(dir, time.Hour)
+	require.NoError(t, err)
+	loads, err := restarted.list()
+	require.NoError(t, err)
+	assert.Empty(t, loads)
+}
+
+func TestPendingStore_SharedByReplicas(t *testing.T) {
+	redisServer, err := miniredis.Run()
+	require.NoError(t, err)
+	defer redisServer.Close()
+
+	location := "redis://" + redisServer.Addr() + "/0"
+	replica1, err := newPendingStore(location, time.Hour)
+	require.NoError(t, err)
+	replica2, err := newPendingStore(location, time.Hour)
+	require.NoError(t, err)
+
+	pending, err := replica1.add(&LoadRecord{Target: "prod", Sha: "sha-1"}, &LoadPlan{})
+	require.NoError(t, err)
+
+	loads, err := replica2.list()
+	require.NoError(t, err)
+	require.Len(t, loads, 1)
+	assert.Equal(t, pending.Id, loads[0].Id)
+
+	taken, err := replica2.take(pending.Id)
+	require.NoError(t, err)
+	assert.NotNil(t, taken)
+	// only taken once
+	taken, err = replica1.take(pending.Id)
+	require.NoError(t, err)
+	assert.Nil(t, taken)
+}
+
+func TestLoaderImpl_LoadAll_ExpectedFingerprint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-fingerprint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTestContent(t, dir, "zones", "ord.json", `{"name":"public/ord"}`)
+
+	existing := `{"content":[{"id":"z-1","name":"public/dfw"}],"last":true}`
+	var posted int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "POST":
+			posted++
+			_, _ = w.Write([]byte(`{"id":"z-2","name":"public/ord"}`))
+		case r.URL.Path == "/api/zones":
+			_, _ = w.Write([]byte(existing))
+		default:
+			_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+		}
+	}))
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL})
+	require.NoError(t, err)
+
+	stats, err := loader.LoadAll(context.Background(), dir, LoadOptions{PlanOnly: true})
+	require.NoError(t, err)
+	assert.Equal(t, 0, posted)
+	assert.Equal(t, 1, stats.Plan.Creates)
+	fingerprint := stats.Plan.Fingerprint
+	require.NotEmpty(t, fingerprint)
+
+	existing = `{"content":[{"id":"z-1","name":"public/dfw"},{"id":"z-3","name":"public/iad"}],"last":true}`
+	_, err = loader.LoadAll(context.Background(), dir, LoadOptions{ExpectedFingerprint: fingerprint})
+	assert.Equal(t, errExistingContentChanged, err)
+	assert.Equal(t, 0, posted)
+
+	existing = `{"content":[{"id":"z-1","name":"public/dfw"}],"last":true}`
+	stats, err = loader.LoadAll(context.Background(), dir, LoadOptions{ExpectedFingerprint: fingerprint})
+	require.NoError(t, err)
+	assert.Equal(t, 1, posted)
+	assert.Equal(t, 1, stats.Created)
+}
+
+func pushForApproval(t *testing.T, server *WebhookServer) *LoadResult {
+	reqBody, err := os.Open("testdata/webhook_push_req.json")
+	require.NoError(t, err)
+	defer reqBody.Close()
+
+	resp := httptest.NewRecorder()
+	server.handleWebhook(resp, createWebhookReq(reqBody, "push", ""))
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	var result LoadResult
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &result))
+	return &result
+}
+
+func createPendingReq(method string, target string, token string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func createTestApprovalServer(t *testing.T, expiry time.Duration) (*WebhookServer, *planningLoader) {
+	loader := &planningLoader{creates: 1, fingerprint: "fp-1"}
+	router, err := NewSingleTargetRouter(loader, nil)
+	require.NoError(t, err)
+	router.Targets()[0].RequireApproval = true
+
+	sourceContent := new(MockSourceContent)
+	sourceContent.On("Prepare").Return(mockContentPath, nil)
+	sourceContent.On("Cleanup").Return()
+	builder := &MockGitContentBuilder{sourceContent: sourceContent}
+	builder.On("build", mock.Anything, mock.Anything).Return(sourceContent)
+
+	server := NewWebhookServer(zap.NewNop().Sugar(), router, 8080, builder.build, "")
+	server.SetupReload("reload-token", nil)
+	require.NoError(t, server.SetupApproval(expiry, ""))
+	return server, loader
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// plannedRefPrefix stands in for the ID of a referenced entity that the load plans to create
+const plannedRefPrefix = "$planned "
+
+// errExistingContentChanged conveys that the existing entities no longer match those of the
+// plan that a load was expected to apply
+var errExistingContentChanged = errors.New("existing content changed since the plan was computed")
+
+// definitionRun holds the state of loading one definition within a load
+type definitionRun struct {
+	definition LoaderDefinition
+	existing   UniquenessTracker
+	// lookedUp are the unique keys already looked up by the definition's lookup strategy
+	lookedUp UniquenessTracker
+	// planned are the unique keys of the entities the plan creates
+	planned UniquenessTracker
+	plan    *DefinitionPlan
+	// existingDigests fingerprint each existing entity and each unique key that a lookup
+	// didn't find
+	existingDigests []string
+	// stateKeys are the state keys of the existing entities, computed when first needed
+	stateKeys map[string]bool
+}
+
+// existingStateKeys returns the state keys of the entities that existed when the definition
+// was prepared
+func (r *definitionRun) existingStateKeys() map[string]bool {
+	if r.stateKeys == nil {
+		r.stateKeys = make(map[string]bool, len(r.existing))
+		for key := range r.existing {
+			r.stateKeys[stateKey(key)] = true
+		}
+	}
+	return r.stateKeys
+}
+
+// prepare retrieves the existing entities of the definition and plans the changes that
+// loading its source content would make
+func (l *LoaderImpl) prepare(ctx context.Context, definition LoaderDefinition, sourceContentPath string,
+	run *loadRun) (*definitionRun, error) {
+
+	// otherwise each of the files would be created
+	duplicates, err := findDuplicateKeys(definition, sourceContentPath, run.filter, l.decryptor, l.secrets)
+	if err != nil {
+		return nil, err
+	}
+	if len(duplicates) > 0 {
+		return nil, duplicateKeysError(duplicates)
+	}
+
+	var content []interface{}
+	if definition.Lookup == nil {
+		content, err = l.retrieveExistingPagedContent(ctx, definition)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load all pages: %w", err)
+		}
+
+		// existing content isn't logged since it can include resolved secrets
+		l.log.Infof("Loaded %d existing entities for %s", len(content), definition.Name)
+		run.entities.addAll(definition, content)
+	} else {
+		l.log.Debugw("existing entities will be looked up individually", "definition", definition)
+	}
+
+	identifiers, err := l.identifyExistingContent(definition, content)
+	if err != nil {
+		return nil, fmt.Errorf("failure while identifying existing content: %w", err)
+	}
+
+	l.log.Debugw("Identified existing content",
+		"identifiers", identifiers,
+		"definition", definition)
+
+	defRun := &definitionRun{
+		definition: definition,
+		existing:   identifiers,
+		lookedUp:   make(UniquenessTracker),
+		planned:    make(UniquenessTracker),
+		plan:       &DefinitionPlan{},
+	}
+	for _, entity := range content {
+		defRun.existingDigests = append(defRun.existingDigests, digestJson(entity))
+	}
+	run.definitions[definition.Name] = defRun
+
+	err = l.planSourceContent(ctx, defRun, sourceContentPath, run)
+	if err != nil {
+		return nil, fmt.Errorf("failed to plan source content: %w", err)
+	}
+	defRun.plan.Existing = len(defRun.existing)
+
+	return defRun, nil
+}
+
+func (l *LoaderImpl) planSourceContent(ctx context.Context, defRun *definitionRun, sourceContentPath string,
+	run *loadRun) error {
+
+	definitionPath := filepath.Join(sourceContentPath, defRun.definition.Name)
+	if _, err := os.Stat(definitionPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	return walkContentFiles(sourceContentPath, definitionPath, run.filter,
+		func(path string, _ string) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			err := l.planSourceContentFile(ctx, defRun, path, run)
+			if err != nil {
+				// loading reports the problem with the file
+				l.log.Debugw("unable to plan source content file", "err", err, "path", path)
+			}
+			return nil
+		})
+}
+
+func (l *LoaderImpl) planSourceContentFile(ctx context.Context, defRun *definitionRun, path string, run *loadRun) error {
+	if l.unchangedState(defRun, path, run) != nil {
+		return nil
+	}
+	decoded, err := l.decryptor.readContentFile(path)
+	if err != nil {
+		return err
+	}
+	resolvedContent, err := l.secrets.resolveSecrets(decoded.content)
+	if err != nil {
+		return err
+	}
+	resolvedContent, err = resolveEntityRefs(resolvedContent, func(ref entityRef) (interface{}, error) {
+		return l.planEntityRef(ctx, ref, run)
+	})
+	if err != nil {
+		return err
+	}
+
+	fieldValues, err := extractFieldValues(defRun.definition, resolvedContent)
+	if err != nil {
+		return err
+	}
+	tombstone, err := isTombstone(resolvedContent)
+	if err != nil {
+		return err
+	}
+	exists, err := l.entityExists(ctx, defRun, resolvedContent, fieldValues, run)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case tombstone && exists:
+		defRun.plan.Deletes++
+	case !tombstone && !exists && !defRun.planned.Contains(fieldValues):
+		defRun.plan.Creates++
+		defRun.planned.Add(fieldValues)
+	}
+	return nil
+}
+
+// planEntityRef resolves a reference to an entity that exists or, since the entity isn't
+// created while planning, to a placeholder when the plan creates it
+func (l *LoaderImpl) planEntityRef(ctx context.Context, ref entityRef, run *loadRun) (interface{}, error) {
+	id, err := l.resolveEntityRef(ctx, ref, run)
+	if err == nil {
+		return id, nil
+	}
+
+	if defRun, exists := run.definitions[ref.Definition]; exists {
+		fieldValues, keyErr := extractFieldValues(defRun.definition, ref.Key)
+		if keyErr == nil && defRun.planned.Contains(fieldValues) {
+			return plannedRefPrefix + ref.String(), nil
+		}
+	}
+	return nil, err
+}
+
+// entityExists reports whether an existing entity has the unique field values, looking it up
+// when the definition has a lookup strategy
+func (l *LoaderImpl) entityExists(ctx context.Context, defRun *definitionRun, content interface{},
+	fieldValues []interface{}, run *loadRun) (bool, error) {
+
+	definition := defRun.definition
+	if definition.Lookup != nil && !defRun.existing.Contains(fieldValues) && !defRun.lookedUp.Contains(fieldValues) {
+		entity, err := l.lookupExisting(ctx, definition, content, fieldValues)
+		if err != nil {
+			return false, err
+		}
+		defRun.lookedUp.Add(fieldValues)
+		if entity != nil {
+			defRun.existing.Add(fieldValues)
+			run.entities.add(definition, entity)
+			defRun.existingDigests = append(defRun.existingDigests, digestJson(entity))
+		} else {
+			// a later create of the entity also changes what the plan would do
+			defRun.existingDigests = append(defRun.existingDigests,
+				digestJson([]interface{}{"absent", fieldValues}))
+		}
+	}
+	return defRun.existing.Contains(fieldValues), nil
+}
+
+// fingerprintExisting digests the existing entities seen while planning the definitions, so
+// that a load can confirm they are unchanged before applying an earlier plan
+func fingerprintExisting(runs []*definitionRun) string {
+	h := sha256.New()
+	for _, defRun := range runs {
+		digests := append([]string(nil), defRun.existingDigests...)
+		// pages and lookups aren't guaranteed to be in a consistent order
+		sort.Strings(digests)
+		_, _ = fmt.Fprintf(h, "%s\n", defRun.definition.Name)
+		for _, digest := range digests {
+			_, _ = fmt.Fprintf(h, "%s\n", digest)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// digestJson hashes the JSON encoding of the value, which sorts the keys of objects
+func digestJson(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		// decoded JSON always encodes, but any other value is digested by its formatting
+		encoded = []byte(fmt.Sprintf("%#v", value))
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
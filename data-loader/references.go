@@ -0,0 +1,173 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/yalp/jsonpath"
+	"strconv"
+)
+
+const (
+	entityRefKey = "$ref"
+	entityIdPath = "$.id"
+)
+
+// entityRef is the target of a reference object, such as
+// {"$ref": {"definition": "monitor-templates", "key": {"name": "cpu"}}}, where key holds the
+// unique fields of the referenced entity in the same structure as its content
+type entityRef struct {
+	Definition string      `json:"definition"`
+	Key        interface{} `json:"key"`
+}
+
+func (r entityRef) String() string {
+	key, _ := json.Marshal(r.Key)
+	return fmt.Sprintf("%s %s", r.Definition, key)
+}
+
+// entityRefResolver returns the ID of the referenced entity
+type entityRefResolver func(ref entityRef) (interface{}, error)
+
+// entityIndex tracks the IDs of the entities of each definition by unique key during a load
+type entityIndex map[string]map[string]interface{}
+
+// indexed reports whether the existing entities of the definition have been added
+func (x entityIndex) indexed(definition LoaderDefinition) bool {
+	_, exists := x[definition.Name]
+	return exists
+}
+
+// addAll adds the existing entities of a definition, marking the definition as indexed
+func (x entityIndex) addAll(definition LoaderDefinition, entities []interface{}) {
+	if !x.indexed(definition) {
+		x[definition.Name] = make(map[string]interface{})
+	}
+	for _, entity := range entities {
+		x.add(definition, entity)
+	}
+}
+
+// add indexes an existing or created entity. Entities without an ID or unique fields can't be
+// referenced, so they're ignored.
+func (x entityIndex) add(definition LoaderDefinition, entity interface{}) {
+	id, err := jsonpath.Read(entity, entityIdPath)
+	if err != nil || id == nil {
+		return
+	}
+	fieldValues, err := extractFieldValues(definition, entity)
+	if err != nil {
+		return
+	}
+
+	ids, exists := x[definition.Name]
+	if !exists {
+		ids = make(map[string]interface{})
+		x[definition.Name] = ids
+	}
+	ids[UniquenessTracker{}.formKey(fieldValues)] = id
+}
+
+func (x entityIndex) remove(definition LoaderDefinition, fieldValues []interface{}) {
+	delete(x[definition.Name], UniquenessTracker{}.formKey(fieldValues))
+}
+
+func (x entityIndex) lookup(definition LoaderDefinition, fieldValues []interface{}) (interface{}, bool) {
+	id, exists := x[definition.Name][UniquenessTracker{}.formKey(fieldValues)]
+	return id, exists
+}
+
+// formatEntityId renders an entity ID for use in a URL path. JSON numbers decode as float64,
+// which would otherwise format large IDs with an exponent.
+func formatEntityId(id interface{}) string {
+	if number, ok := id.(float64); ok {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", id)
+}
+
+// isEntityRef reports whether the decoded value is a reference object
+func isEntityRef(value interface{}) bool {
+	v, ok := value.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, isRef := v[entityRefKey]
+	return isRef
+}
+
+// resolveEntityRefs returns a copy of the decoded content where each reference object is
+// replaced by the ID of the entity it references
+func resolveEntityRefs(content interface{}, resolver entityRefResolver) (interface{}, error) {
+	switch v := content.(type) {
+	case map[string]interface{}:
+		if refValue, isRef := v[entityRefKey]; isRef {
+			if len(v) != 1 {
+				return nil, fmt.Errorf("reference must not have fields other than %s", entityRefKey)
+			}
+			ref, err := parseEntityRef(refValue)
+			if err != nil {
+				return nil, err
+			}
+			return resolver(ref)
+		}
+
+		resolved := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			resolvedValue, err := resolveEntityRefs(value, resolver)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			resolved[key] = resolvedValue
+		}
+		return resolved, nil
+
+	case []interface{}:
+		resolved := make([]interface{}, len(v))
+		for i, value := range v {
+			resolvedValue, err := resolveEntityRefs(value, resolver)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			resolved[i] = resolvedValue
+		}
+		return resolved, nil
+
+	default:
+		return content, nil
+	}
+}
+
+func parseEntityRef(value interface{}) (entityRef, error) {
+	var ref entityRef
+	// round trip through JSON to pick out the fields
+	encoded, err := json.Marshal(value)
+	if err == nil {
+		err = json.Unmarshal(encoded, &ref)
+	}
+	if err != nil {
+		return entityRef{}, fmt.Errorf("reference must be an object with definition and key: %w", err)
+	}
+	if ref.Definition == "" {
+		return entityRef{}, fmt.Errorf("reference is missing definition")
+	}
+	if _, ok := ref.Key.(map[string]interface{}); !ok {
+		return entityRef{}, fmt.Errorf("reference key must be an object of unique fields")
+	}
+	return ref, nil
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestResolveEntityRefs(t *testing.T) {
+	templates := *findLoaderDefinition("monitor-templates")
+	index := make(entityIndex)
+	index.addAll(templates, []interface{}{
+		map[string]interface{}{"id": "t-1", "name": "cpu"},
+		// can't be referenced without an ID
+		map[string]interface{}{"name": "mem"},
+	})
+
+	resolver := func(ref entityRef) (interface{}, error) {
+		definition := findLoaderDefinition(ref.Definition)
+		fieldValues, err := extractFieldValues(*definition, ref.Key)
+		require.NoError(t, err)
+		id, exists := index.lookup(*definition, fieldValues)
+		if !exists {
+			return nil, assert.AnError
+		}
+		return id, nil
+	}
+
+	resolved, err := resolveEntityRefs(decodeTestContent(t, `{
+  "key": "template",
+  "values": [{"$ref": {"definition": "monitor-templates", "key": {"name": "cpu"}}}]
+}`), resolver)
+	require.NoError(t, err)
+	assert.Equal(t, decodeTestContent(t, `{"key": "template", "values": ["t-1"]}`), resolved)
+
+	_, err = resolveEntityRefs(decodeTestContent(t,
+		`{"value": {"$ref": {"definition": "monitor-templates", "key": {"name": "mem"}}}}`), resolver)
+	assert.Error(t, err)
+
+	_, err = resolveEntityRefs(decodeTestContent(t,
+		`{"value": {"$ref": {"definition": "monitor-templates", "key": "cpu"}}}`), resolver)
+	assert.EqualError(t, err, "value: reference key must be an object of unique fields")
+}
+
+func TestLoaderImpl_LoadAll_References(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-refs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTestContent(t, dir, "monitor-templates", "cpu.json", `{"name":"cpu"}`)
+	writeTestContent(t, dir, "monitor-metadata-policies", "policy.json", `{
+  "scope": "GLOBAL", "subscope": "cpu", "targetClassName": "Monitor", "valueType": "STRING",
+  "key": "templates",
+  "value": [
+    {"$ref": {"definition": "monitor-templates", "key": {"name": "cpu"}}},
+    {"$ref": {"definition": "monitor-templates", "key": {"name": "mem"}}}
+  ]
+}`)
+
+	var postedPolicies []interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/monitor-templates", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case "GET":
+			_, _ = w.Write([]byte(`{"content":[{"id":"existing-mem","name":"mem"}],"last":true}`))
+		case "POST":
+			_, _ = w.Write([]byte(`{"id":"created-cpu","name":"cpu"}`))
+		}
+	})
+	mux.HandleFunc("/api/policy/metadata/monitor", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case "GET":
+			_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+		case "POST":
+			var posted interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&posted))
+			postedPolicies = append(postedPolicies, posted)
+			_, _ = w.Write([]byte(`{"id":"policy-1"}`))
+		}
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL})
+	require.NoError(t, err)
+
+	stats, err := loader.LoadAll(context.Background(), dir, LoadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Created)
+
+	require.Len(t, postedPolicies, 1)
+	assertJsonPath(t, postedPolicies[0], "$.value[0]", "created-cpu")
+	assertJsonPath(t, postedPolicies[0], "$.value[1]", "existing-mem")
+}
+
+func TestLoaderImpl_LoadAll_DanglingReference(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-refs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTestContent(t, dir, "monitor-metadata-policies", "policy.json", `{
+  "scope": "GLOBAL", "subscope": "disk", "targetClassName": "Monitor", "valueType": "STRING",
+  "key": "template",
+  "value": {"$ref": {"definition": "monitor-templates", "key": {"name": "disk"}}}
+}`)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "GET", r.Method, "nothing should be created")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+	}))
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL})
+	require.NoError(t, err)
+
+	// only load the policies to also verify templates are retrieved on demand
+	stats, err := loader.LoadAll(context.Background(), dir, LoadOptions{
+		Definitions: []string{"monitor-metadata-policies"},
+	})
+	require.Error(t, err)
+	assert.Contains(t, stats.Definitions["monitor-metadata-policies"].Error,
+		`reference to monitor-templates {"name":"disk"} does not match an existing or created entity`)
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+)
+
+const defaultTargetName = "default"
+
+// RoutingConfig declares the Admin API targets a webhook server can load into and the
+// routes that select a target by repository and ref. Since JSON is a subset of YAML, the
+// routing file may be in either format.
+type RoutingConfig struct {
+	Targets []TargetConfig `yaml:"targets"`
+	Routes  []RouteConfig  `yaml:"routes"`
+}
+
+// TargetConfig declares an Admin API target, where Name is the environment name reported in
+// logs and responses
+type TargetConfig struct {
+	Name             string `yaml:"name"`
+	AdminUrl         string `yaml:"adminUrl"`
+	IdentityUrl      string `yaml:"identityUrl"`
+	IdentityUsername string `yaml:"identityUsername"`
+	IdentityPassword string `yaml:"identityPassword"`
+	IdentityApikey   string `yaml:"identityApikey"`
+	// RequireApproval only plans the loads of push events until they are approved
+	RequireApproval bool `yaml:"requireApproval"`
+}
+
+// RouteConfig selects a target for push events whose repository clone URL and ref both
+// regex-match. An empty Repository matches any repository and empty Refs matches any ref.
+type RouteConfig struct {
+	Repository string   `yaml:"repository"`
+	Refs       []string `yaml:"refs"`
+	Target     string   `yaml:"target"`
+}
+
+// LoadTarget is a named Admin API target along with the loader that populates it
+type LoadTarget struct {
+	Name   string
+	Loader Loader
+	// RequireApproval only plans the loads of push events until they are approved
+	RequireApproval bool
+}
+
+type route struct {
+	repository *regexp.Regexp
+	refs       []*regexp.Regexp
+	target     *LoadTarget
+}
+
+// Router selects the LoadTarget for a repository and ref where the first matching route wins
+type Router struct {
+	routes  []route
+	targets []*LoadTarget
+}
+
+// LoaderBuilder abstracts the creation of a Loader for a target to allow for mocking during
+// unit tests
+type LoaderBuilder func(target TargetConfig) (Loader, error)
+
+// LoadRoutingConfig reads a YAML or JSON routing file
+func LoadRoutingConfig(path string) (*RoutingConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing config: %w", err)
+	}
+
+	var routingConfig RoutingConfig
+	err = yaml.UnmarshalStrict(content, &routingConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse routing config: %w", err)
+	}
+
+	return &routingConfig, nil
+}
+
+// NewRouter validates the routing config and builds a loader for each declared target
+func NewRouter(routingConfig *RoutingConfig, loaderBuilder LoaderBuilder) (*Router, error) {
+	if len(routingConfig.Targets) == 0 {
+		return nil, fmt.Errorf("routing config must declare at least one target")
+	}
+
+	router := &Router{}
+
+	for _, targetConfig := range routingConfig.Targets {
+		if targetConfig.Name == "" {
+			return nil, fmt.Errorf("routing target is missing a name")
+		}
+		if targetConfig.AdminUrl == "" {
+			return nil, fmt.Errorf("routing target %s is missing adminUrl", targetConfig.Name)
+		}
+		if router.Target(targetConfig.Name) != nil {
+			return nil, fmt.Errorf("routing target %s is declared more than once", targetConfig.Name)
+		}
+
+		loader, err := loaderBuilder(targetConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create loader for target %s: %w", targetConfig.Name, err)
+		}
+		router.targets = append(router.targets, &LoadTarget{
+			Name:            targetConfig.Name,
+			Loader:          loader,
+			RequireApproval: targetConfig.RequireApproval,
+		})
+	}
+
+	for i, routeConfig := range routingConfig.Routes {
+		target := router.Target(routeConfig.Target)
+		if target == nil {
+			return nil, fmt.Errorf("route %d references unknown target %s", i, routeConfig.Target)
+		}
+
+		r, err := compileRoute(routeConfig.Repository, routeConfig.Refs, target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %d: %w", i, err)
+		}
+		router.routes = append(router.routes, r)
+	}
+
+	return router, nil
+}
+
+// NewSingleTargetRouter creates a router with one target that accepts any repository and,
+// if non-empty, the refs that regex-match any of matchingRefs
+func NewSingleTargetRouter(loader Loader, matchingRefs []string) (*Router, error) {
+	target := &LoadTarget{
+		Name:   defaultTargetName,
+		Loader: loader,
+	}
+
+	r, err := compileRoute("", matchingRefs, target)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Router{
+		routes:  []route{r},
+		targets: []*LoadTarget{target},
+	}, nil
+}
+
+func compileRoute(repository string, refs []string, target *LoadTarget) (route, error) {
+	r := route{target: target}
+
+	if repository != "" {
+		var err error
+		r.repository, err = regexp.Compile(repository)
+		if err != nil {
+			return route{}, fmt.Errorf("invalid repository expression: %w", err)
+		}
+	}
+
+	for _, expr := range refs {
+		compiled, err := regexp.Compile(expr)
+		if err != nil {
+			return route{}, fmt.Errorf("invalid ref expression: %w", err)
+		}
+		r.refs = append(r.refs, compiled)
+	}
+
+	return r, nil
+}
+
+// Route returns the target of the first route matching the repository and ref or nil if
+// none match
+func (r *Router) Route(repository string, ref string) *LoadTarget {
+	for _, candidate := range r.routes {
+		if candidate.matches(repository, ref) {
+			return candidate.target
+		}
+	}
+	return nil
+}
+
+// Target returns the target with the given name or nil if not declared
+func (r *Router) Target(name string) *LoadTarget {
+	for _, target := range r.targets {
+		if target.Name == name {
+			return target
+		}
+	}
+	return nil
+}
+
+// Targets returns all declared targets in declaration order
+func (r *Router) Targets() []*LoadTarget {
+	return r.targets
+}
+
+func (r route) matches(repository string, ref string) bool {
+	if r.repository != nil && !r.repository.MatchString(repository) {
+		return false
+	}
+
+	if len(r.refs) == 0 {
+		return true
+	}
+	for _, expr := range r.refs {
+		if expr.MatchString(ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetLoaderBuilder creates a LoaderBuilder that authenticates each target with its own
+// Identity credentials, falling back to the global config for unset Identity fields
+func targetLoaderBuilder(log *zap.SugaredLogger, config *Config) LoaderBuilder {
+	return func(target TargetConfig) (Loader, error) {
+		targetConfig := config.ForTarget(target)
+
+		authenticator, err := NewAdminAuthenticator(log, targetConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup authenticator: %w", err)
+		}
+
+		return NewLoader(log.With("target", target.Name), authenticator, targetConfig)
+	}
+}
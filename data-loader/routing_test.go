@@ -0,0 +1,95 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestLoadRoutingConfig(t *testing.T) {
+	routingConfig, err := LoadRoutingConfig("testdata/routing.yml")
+	require.NoError(t, err)
+
+	require.Len(t, routingConfig.Targets, 2)
+	assert.Equal(t, "staging", routingConfig.Targets[0].Name)
+	assert.Equal(t, "https://staging.example.com", routingConfig.Targets[0].AdminUrl)
+	assert.Equal(t, "staging-user", routingConfig.Targets[0].IdentityUsername)
+	require.Len(t, routingConfig.Routes, 2)
+	assert.Equal(t, []string{"refs/heads/staging"}, routingConfig.Routes[0].Refs)
+	assert.Equal(t, "prod", routingConfig.Routes[1].Target)
+}
+
+func TestRouter_Route(t *testing.T) {
+	routingConfig, err := LoadRoutingConfig("testdata/routing.yml")
+	require.NoError(t, err)
+
+	router, err := NewRouter(routingConfig, func(target TargetConfig) (Loader, error) {
+		return new(MockLoader), nil
+	})
+	require.NoError(t, err)
+
+	const repo = "https://github.com/example/salus-data-loader-content.git"
+
+	target := router.Route(repo, "refs/heads/staging")
+	require.NotNil(t, target)
+	assert.Equal(t, "staging", target.Name)
+
+	target = router.Route(repo, "refs/tags/v1.2")
+	require.NotNil(t, target)
+	assert.Equal(t, "prod", target.Name)
+
+	assert.Nil(t, router.Route(repo, "refs/heads/feature"))
+	assert.Nil(t, router.Route("https://github.com/example/other.git", "refs/tags/v1.2"))
+}
+
+func TestNewRouter_UnknownTarget(t *testing.T) {
+	_, err := NewRouter(&RoutingConfig{
+		Targets: []TargetConfig{{Name: "staging", AdminUrl: "http://staging"}},
+		Routes:  []RouteConfig{{Target: "prod"}},
+	}, func(target TargetConfig) (Loader, error) {
+		return new(MockLoader), nil
+	})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown target prod")
+}
+
+func TestConfig_ForTarget(t *testing.T) {
+	config := &Config{
+		IdentityUrl:      "https://identity.example.com",
+		IdentityUsername: "global-user",
+		IdentityApikey:   "global-key",
+		AdminUrl:         "http://localhost:8888",
+	}
+
+	targetConfig := config.ForTarget(TargetConfig{
+		Name:             "prod",
+		AdminUrl:         "https://prod.example.com",
+		IdentityUsername: "prod-user",
+		IdentityPassword: "prod-password",
+	})
+
+	assert.Equal(t, "https://identity.example.com", targetConfig.IdentityUrl)
+	assert.Equal(t, "https://prod.example.com", targetConfig.AdminUrl)
+	assert.Equal(t, "prod-user", targetConfig.IdentityUsername)
+	assert.Equal(t, "prod-password", targetConfig.IdentityPassword)
+	assert.Equal(t, "", targetConfig.IdentityApikey)
+	// and the original is untouched
+	assert.Equal(t, "global-user", config.IdentityUsername)
+}
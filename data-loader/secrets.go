@@ -0,0 +1,201 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	secretRefKey     = "$secret"
+	secretSchemeEnv  = "env"
+	secretSchemeFile = "file"
+)
+
+// SecretSources allow secret references to resolve only environment variables with the
+// prefix and files within the directories, so that content can't reference the loader's own
+// credentials, which are also given by environment variables and files. A nil SecretSources
+// resolves no references.
+type SecretSources struct {
+	// envPrefix is required of referenced environment variables, none are allowed when empty
+	envPrefix string
+	// dirs are the absolute directories, with symlinks resolved, containing referenced files
+	dirs []string
+}
+
+// NewSecretSources validates the allowed environment variable prefix and secret directories
+func NewSecretSources(prefix string, dirs []string) (*SecretSources, error) {
+	if prefix != "" && (strings.HasPrefix(prefix, envPrefix) || strings.HasPrefix(envPrefix, prefix)) {
+		return nil, fmt.Errorf("secret environment prefix %s must not overlap the %s* settings", prefix, envPrefix)
+	}
+
+	sources := &SecretSources{envPrefix: prefix}
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("secret directory %s must be absolute", dir)
+		}
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret directory: %w", err)
+		}
+		sources.dirs = append(sources.dirs, resolved)
+	}
+	return sources, nil
+}
+
+// resolveSecrets returns a copy of the decoded content where each secret reference object,
+// such as {"$secret": "env:NAME"} or {"$secret": "file:/path#key"}, is replaced by the string
+// value it references. The given content is not modified so that it remains safe to log.
+// Errors never include resolved values.
+func (s *SecretSources) resolveSecrets(content interface{}) (interface{}, error) {
+	switch v := content.(type) {
+	case map[string]interface{}:
+		if ref, isRef := v[secretRefKey]; isRef {
+			if len(v) != 1 {
+				return nil, fmt.Errorf("secret reference must not have fields other than %s", secretRefKey)
+			}
+			refStr, ok := ref.(string)
+			if !ok {
+				return nil, fmt.Errorf("secret reference must be a string")
+			}
+			return s.resolveSecretRef(refStr)
+		}
+
+		resolved := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			resolvedValue, err := s.resolveSecrets(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			resolved[key] = resolvedValue
+		}
+		return resolved, nil
+
+	case []interface{}:
+		resolved := make([]interface{}, len(v))
+		for i, value := range v {
+			resolvedValue, err := s.resolveSecrets(value)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			resolved[i] = resolvedValue
+		}
+		return resolved, nil
+
+	default:
+		return content, nil
+	}
+}
+
+// isSecretRef reports whether the decoded value is a secret reference object
+func isSecretRef(value interface{}) bool {
+	v, ok := value.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, isRef := v[secretRefKey]
+	return isRef
+}
+
+func (s *SecretSources) resolveSecretRef(ref string) (string, error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", fmt.Errorf("secret reference %s must be of the form env:NAME or file:PATH[#KEY]", ref)
+	}
+
+	switch parts[0] {
+	case secretSchemeEnv:
+		name := parts[1]
+		if s == nil || s.envPrefix == "" || !strings.HasPrefix(name, s.envPrefix) {
+			return "", fmt.Errorf("secret reference %s must reference an environment variable allowed by secret-env-prefix", ref)
+		}
+		value, exists := os.LookupEnv(name)
+		if !exists {
+			return "", fmt.Errorf("secret reference %s: environment variable is not set", ref)
+		}
+		return value, nil
+
+	case secretSchemeFile:
+		path, key := parts[1], ""
+		if i := strings.LastIndex(path, "#"); i >= 0 {
+			path, key = path[:i], path[i+1:]
+		}
+		if err := s.checkSecretFile(ref, path); err != nil {
+			return "", err
+		}
+		return readSecretFile(ref, path, key)
+
+	default:
+		return "", fmt.Errorf("secret reference %s has unknown scheme %s", ref, parts[0])
+	}
+}
+
+// checkSecretFile confirms that the path, once its symlinks are resolved, is within one of
+// the secret directories
+func (s *SecretSources) checkSecretFile(ref string, path string) error {
+	notAllowed := fmt.Errorf("secret reference %s must reference a file within secret-dirs", ref)
+	if s == nil || !filepath.IsAbs(path) {
+		return notAllowed
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		// the underlying error only conveys the path and reason
+		return fmt.Errorf("secret reference %s: %w", ref, err)
+	}
+	for _, dir := range s.dirs {
+		rel, err := filepath.Rel(dir, resolved)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return notAllowed
+}
+
+// readSecretFile reads the whole file, minus trailing newlines, or the given key of a YAML or
+// JSON file
+func readSecretFile(ref string, path string, key string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		// the underlying error only conveys the path and reason
+		return "", fmt.Errorf("secret reference %s: %w", ref, err)
+	}
+
+	if key == "" {
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	var values map[string]interface{}
+	err = yaml.Unmarshal(content, &values)
+	if err != nil {
+		// yaml errors can quote content, so don't wrap
+		return "", fmt.Errorf("secret reference %s: file is not a YAML or JSON object", ref)
+	}
+	value, exists := values[key]
+	if !exists {
+		return "", fmt.Errorf("secret reference %s: key is not present", ref)
+	}
+	switch value.(type) {
+	case map[interface{}]interface{}, []interface{}, nil:
+		return "", fmt.Errorf("secret reference %s: key must have a scalar value", ref)
+	}
+	return fmt.Sprint(value), nil
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func decodeTestContent(t *testing.T, content string) interface{} {
+	var decoded interface{}
+	require.NoError(t, json.Unmarshal([]byte(content), &decoded))
+	return decoded
+}
+
+func TestResolveSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	passwordFile := filepath.Join(dir, "password")
+	require.NoError(t, ioutil.WriteFile(passwordFile, []byte("from-file\n"), 0600))
+	credentialsFile := filepath.Join(dir, "credentials.json")
+	require.NoError(t, ioutil.WriteFile(credentialsFile, []byte(`{"host":"db.internal","port":5432}`), 0600))
+
+	require.NoError(t, os.Setenv("TEST_SECRET_TOKEN", "from-env"))
+	defer os.Unsetenv("TEST_SECRET_TOKEN")
+
+	original := decodeTestContent(t, `{
+  "name": "db",
+  "token": {"$secret": "env:TEST_SECRET_TOKEN"},
+  "settings": [
+    {"password": {"$secret": "file:`+passwordFile+`"}},
+    {"host": {"$secret": "file:`+credentialsFile+`#host"}, "port": {"$secret": "file:`+credentialsFile+`#port"}}
+  ]
+}`)
+
+	sources, err := NewSecretSources("TEST_SECRET_", []string{dir})
+	require.NoError(t, err)
+	resolved, err := sources.resolveSecrets(original)
+	require.NoError(t, err)
+
+	assert.Equal(t, decodeTestContent(t, `{
+  "name": "db",
+  "token": "from-env",
+  "settings": [
+    {"password": "from-file"},
+    {"host": "db.internal", "port": "5432"}
+  ]
+}`), resolved)
+
+	// the original retains references so it can be logged
+	assert.Equal(t, map[string]interface{}{"$secret": "env:TEST_SECRET_TOKEN"},
+		original.(map[string]interface{})["token"])
+}
+
+func TestResolveSecrets_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-secrets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	secretsDir := filepath.Join(dir, "secrets")
+	require.NoError(t, os.Mkdir(secretsDir, 0700))
+	outsideFile := filepath.Join(dir, "age-key")
+	require.NoError(t, ioutil.WriteFile(outsideFile, []byte("AGE-SECRET-KEY"), 0600))
+	require.NoError(t, os.Symlink(outsideFile, filepath.Join(secretsDir, "link")))
+
+	require.NoError(t, os.Setenv("DATA_LOADER_TEST_SECRET", "setting"))
+	defer os.Unsetenv("DATA_LOADER_TEST_SECRET")
+	require.NoError(t, os.Setenv("TEST_UNPREFIXED", "setting"))
+	defer os.Unsetenv("TEST_UNPREFIXED")
+
+	sources, err := NewSecretSources("TEST_SECRET_", []string{secretsDir})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		sources *SecretSources
+		content string
+		err     string
+	}{
+		{
+			name:    "unset env",
+			sources: sources,
+			content: `{"token": {"$secret": "env:TEST_SECRET_NOT_SET"}}`,
+			err:     "token: secret reference env:TEST_SECRET_NOT_SET: environment variable is not set",
+		},
+		{
+			name:    "loader setting",
+			sources: sources,
+			content: `{"token": {"$secret": "env:DATA_LOADER_TEST_SECRET"}}`,
+			err:     "token: secret reference env:DATA_LOADER_TEST_SECRET must reference an environment variable allowed by secret-env-prefix",
+		},
+		{
+			name:    "unprefixed env",
+			sources: sources,
+			content: `{"token": {"$secret": "env:TEST_UNPREFIXED"}}`,
+			err:     "token: secret reference env:TEST_UNPREFIXED must reference an environment variable allowed by secret-env-prefix",
+		},
+		{
+			name:    "file outside secret dirs",
+			sources: sources,
+			content: `{"token": {"$secret": "file:` + outsideFile + `"}}`,
+			err:     "token: secret reference file:" + outsideFile + " must reference a file within secret-dirs",
+		},
+		{
+			name:    "symlink out of secret dirs",
+			sources: sources,
+			content: `{"token": {"$secret": "file:` + secretsDir + `/link"}}`,
+			err:     "token: secret reference file:" + secretsDir + "/link must reference a file within secret-dirs",
+		},
+		{
+			name:    "relative file",
+			sources: sources,
+			content: `{"token": {"$secret": "file:../age-key"}}`,
+			err:     "token: secret reference file:../age-key must reference a file within secret-dirs",
+		},
+		{
+			name:    "no sources",
+			content: `{"token": {"$secret": "env:TEST_SECRET_NOT_SET"}}`,
+			err:     "token: secret reference env:TEST_SECRET_NOT_SET must reference an environment variable allowed by secret-env-prefix",
+		},
+		{
+			name:    "unknown scheme",
+			sources: sources,
+			content: `{"token": {"$secret": "vault:secret/token"}}`,
+			err:     "token: secret reference vault:secret/token has unknown scheme vault",
+		},
+		{
+			name:    "malformed",
+			sources: sources,
+			content: `[{"$secret": "TOKEN"}]`,
+			err:     "[0]: secret reference TOKEN must be of the form env:NAME or file:PATH[#KEY]",
+		},
+		{
+			name:    "extra fields",
+			sources: sources,
+			content: `{"token": {"$secret": "env:TOKEN", "other": true}}`,
+			err:     "token: secret reference must not have fields other than $secret",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.sources.resolveSecrets(decodeTestContent(t, tt.content))
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestNewSecretSources_Invalid(t *testing.T) {
+	_, err := NewSecretSources("DATA_LOADER_SECRET_", nil)
+	assert.Error(t, err)
+	_, err = NewSecretSources("DATA_", nil)
+	assert.Error(t, err)
+	_, err = NewSecretSources("", []string{"relative/secrets"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ServingConfig declares how the webhook server accepts connections and requests
+type ServingConfig struct {
+	// TlsCertFile and TlsKeyFile, if given, are the PEM certificate and key of serving over
+	// TLS, which are reloaded when either file changes
+	TlsCertFile string
+	TlsKeyFile  string
+	// ClientCaFile, if given, is the PEM CA that verifies client certificates, which authorize
+	// callers of the manual and admin endpoints in place of the reload token
+	ClientCaFile string
+	// AdminPort, if not zero, moves the manual and admin endpoints, metrics, and readiness to
+	// their own listener, leaving the webhook and liveness endpoints on the public port
+	AdminPort int
+	// MaxRequestBytes limits the size of request bodies, unlimited when zero
+	MaxRequestBytes int64
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+}
+
+// SetupServing enables TLS, mTLS, a separate admin listener, and request limits as given.
+// It returns an error if the certificate, key, or client CA can't be loaded.
+func (s *WebhookServer) SetupServing(config ServingConfig) error {
+	if (config.TlsCertFile == "") != (config.TlsKeyFile == "") {
+		return fmt.Errorf("both a TLS certificate and key are required")
+	}
+	if config.ClientCaFile != "" && config.TlsCertFile == "" {
+		return fmt.Errorf("a client CA requires a TLS certificate and key")
+	}
+
+	s.serving = config
+	if config.TlsCertFile != "" {
+		certificates, err := newCertificateReloader(s.log, config.TlsCertFile, config.TlsKeyFile)
+		if err != nil {
+			return err
+		}
+		s.certificates = certificates
+	}
+	if config.ClientCaFile != "" {
+		caPem, err := ioutil.ReadFile(config.ClientCaFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return fmt.Errorf("no certificates found in client CA file %s", config.ClientCaFile)
+		}
+		s.clientCAs = pool
+	}
+	return nil
+}
+
+// tlsConfig creates the TLS config of a listener or returns nil when serving plain HTTP. When
+// given a client CA, a listener that doesn't accept webhook deliveries requires a certificate.
+func (s *WebhookServer) tlsConfig(requireClientCert bool) *tls.Config {
+	if s.certificates == nil {
+		return nil
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.certificates.getCertificate,
+	}
+	if s.clientCAs != nil {
+		// Github doesn't present a certificate, so webhook deliveries are still accepted and
+		// the endpoints requiring authorization check for a verified chain
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		config.ClientCAs = s.clientCAs
+	}
+	return config
+}
+
+// newServer creates a server of the handler on the port that applies the limits
+func (s *WebhookServer) newServer(port int, handler http.Handler, requireClientCert bool) *http.Server {
+	return &http.Server{
+		Addr:         fmt.Sprintf(":%d", port),
+		Handler:      limitRequestBodies(handler, s.serving.MaxRequestBytes),
+		TLSConfig:    s.tlsConfig(requireClientCert),
+		ReadTimeout:  s.serving.ReadTimeout,
+		WriteTimeout: s.serving.WriteTimeout,
+	}
+}
+
+// listenAndServe serves over TLS when the server has a TLS config
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		// the certificate is provided by the TLS config
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// limitRequestBodies rejects requests that declare a body larger than maxBytes and stops
+// reading bodies, such as chunked ones, beyond maxBytes
+func limitRequestBodies(handler http.Handler, maxBytes int64) http.Handler {
+	if maxBytes <= 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxBytes {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// certificateReloader serves the latest valid certificate and key from their files
+type certificateReloader struct {
+	log      *zap.SugaredLogger
+	certFile string
+	keyFile  string
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+}
+
+func newCertificateReloader(log *zap.SugaredLogger, certFile string, keyFile string) (*certificateReloader, error) {
+	c := &certificateReloader{
+		log:      log,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certificateReloader) load() error {
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.certificate = &certificate
+	return nil
+}
+
+func (c *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.certificate, nil
+}
+
+// watch reloads the certificate whenever the directories of its files change until the
+// context is done. The directories are watched, rather than the files, since mounted
+// secrets are replaced by swapping a symlink.
+func (c *certificateReloader) watch(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		c.log.Warnw("unable to watch TLS certificate for changes", "err", err)
+		return
+	}
+	defer watcher.Close()
+
+	for _, dir := range []string{filepath.Dir(c.certFile), filepath.Dir(c.keyFile)} {
+		if err := watcher.Add(dir); err != nil {
+			c.log.Warnw("unable to watch TLS certificate for changes", "err", err, "path", dir)
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			c.log.Debugw("TLS certificate directory changed", "event", event)
+			// the certificate and key may be written separately, so a failure is expected
+			// until both are
+			if err := c.load(); err != nil {
+				c.log.Warnw("keeping previous TLS certificate", "err", err)
+				continue
+			}
+			c.log.Infow("reloaded TLS certificate", "certFile", c.certFile)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			c.log.Warnw("TLS certificate watch error", "err", err)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const reloadReqBody = `{"repository":"https://github.com/example/content.git","sha":"abc123"}`
+
+func TestWebhookServer_handlers_SinglePort(t *testing.T) {
+	server, _, _, _ := createTestWebhookServer("", []string{}, true)
+	server.SetupReload("reload-token", nil)
+
+	public, admin := server.handlers()
+	assert.Nil(t, admin)
+
+	assert.Equal(t, http.StatusOK, serveTestRequest(public, createReloadReq(reloadReqBody, "reload-token")))
+	assert.Equal(t, http.StatusOK, serveTestRequest(public, httptest.NewRequest("GET", "/metrics", nil)))
+	assert.Equal(t, http.StatusMethodNotAllowed, serveTestRequest(public, httptest.NewRequest("GET", "/webhook", nil)))
+}
+
+func TestWebhookServer_handlers_AdminPort(t *testing.T) {
+	server, _, _, _ := createTestWebhookServer("", []string{}, true)
+	server.SetupReload("reload-token", nil)
+	require.NoError(t, server.SetupServing(ServingConfig{AdminPort: 9090}))
+
+	public, admin := server.handlers()
+	require.NotNil(t, admin)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, serveTestRequest(public, httptest.NewRequest("GET", "/webhook", nil)))
+	assert.Equal(t, http.StatusOK, serveTestRequest(public, httptest.NewRequest("GET", "/healthz", nil)))
+	assert.Equal(t, http.StatusOK, serveTestRequest(public, httptest.NewRequest("GET", "/", nil)))
+	assert.Equal(t, http.StatusNotFound, serveTestRequest(public, createReloadReq(reloadReqBody, "reload-token")))
+	assert.Equal(t, http.StatusNotFound, serveTestRequest(public, httptest.NewRequest("GET", "/metrics", nil)))
+
+	assert.Equal(t, http.StatusOK, serveTestRequest(admin, createReloadReq(reloadReqBody, "reload-token")))
+	assert.Equal(t, http.StatusOK, serveTestRequest(admin, httptest.NewRequest("GET", "/metrics", nil)))
+}
+
+func TestLimitRequestBodies(t *testing.T) {
+	var readErr error
+	handler := limitRequestBodies(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = ioutil.ReadAll(r.Body)
+	}), 10)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge,
+		serveTestRequest(handler, httptest.NewRequest("POST", "/webhook", strings.NewReader("0123456789a"))))
+
+	// such as a chunked body
+	req := httptest.NewRequest("POST", "/webhook", strings.NewReader("0123456789a"))
+	req.ContentLength = -1
+	serveTestRequest(handler, req)
+	assert.Error(t, readErr)
+
+	serveTestRequest(handler, httptest.NewRequest("POST", "/webhook", strings.NewReader("0123456789")))
+	assert.NoError(t, readErr)
+}
+
+func TestWebhookServer_SetupServing_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-serving")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir, "server", nil, nil)
+
+	server, _, _, _ := createTestWebhookServer("", []string{}, false)
+	assert.Error(t, server.SetupServing(ServingConfig{TlsCertFile: certFile}))
+	assert.Error(t, server.SetupServing(ServingConfig{ClientCaFile: certFile}))
+	assert.Error(t, server.SetupServing(ServingConfig{TlsCertFile: keyFile, TlsKeyFile: certFile}))
+	assert.Error(t, server.SetupServing(ServingConfig{TlsCertFile: certFile, TlsKeyFile: keyFile, ClientCaFile: keyFile}))
+	assert.NoError(t, server.SetupServing(ServingConfig{TlsCertFile: certFile, TlsKeyFile: keyFile, ClientCaFile: certFile}))
+}
+
+func TestWebhookServer_ClientCertificateAuthorizesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-serving")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, caKey := createTestCertificate(t, "ca", nil, nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, encodeTestCertificate(ca), 0600))
+	certFile, keyFile := writeTestCertificate(t, dir, "server", ca, caKey)
+	clientCertFile, clientKeyFile := writeTestCertificate(t, dir, "client", ca, caKey)
+
+	server, loader, _, _ := createTestWebhookServer("", []string{}, true)
+	// only client certificates authorize reloads
+	server.SetupReload("", nil)
+	require.NoError(t, server.SetupServing(ServingConfig{
+		TlsCertFile:  certFile,
+		TlsKeyFile:   keyFile,
+		ClientCaFile: caFile,
+	}))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	public, _ := server.handlers()
+	httpServer := server.newServer(0, public, false)
+	go httpServer.ServeTLS(listener, "", "")
+	defer httpServer.Close()
+	url := "https://" + listener.Addr().String() + "/reload"
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	require.NoError(t, err)
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := anonymous.Post(url, "application/json", strings.NewReader(reloadReqBody))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	loader.AssertNotCalled(t, "LoadAll")
+
+	authenticated := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert},
+	}}}
+	resp, err = authenticated.Post(url, "application/json", strings.NewReader(reloadReqBody))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	loader.AssertNumberOfCalls(t, "LoadAll", 1)
+}
+
+func TestWebhookServer_AdminListenerRequiresClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-serving")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, caKey := createTestCertificate(t, "ca", nil, nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, encodeTestCertificate(ca), 0600))
+	certFile, keyFile := writeTestCertificate(t, dir, "server", ca, caKey)
+	clientCertFile, clientKeyFile := writeTestCertificate(t, dir, "client", ca, caKey)
+
+	server, _, _, _ := createTestWebhookServer("", []string{}, true)
+	require.NoError(t, server.SetupServing(ServingConfig{
+		TlsCertFile:  certFile,
+		TlsKeyFile:   keyFile,
+		ClientCaFile: caFile,
+		AdminPort:    8081,
+	}))
+	assert.Equal(t, tls.VerifyClientCertIfGiven, server.tlsConfig(false).ClientAuth)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, admin := server.handlers()
+	require.NotNil(t, admin)
+	httpServer := server.newServer(0, admin, true)
+	go httpServer.ServeTLS(listener, "", "")
+	defer httpServer.Close()
+	url := "https://" + listener.Addr().String() + "/healthz"
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	require.NoError(t, err)
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	_, err = anonymous.Get(url)
+	assert.Error(t, err)
+
+	authenticated := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert},
+	}}}
+	resp, err := authenticated.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestCertificateReloader_watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-serving")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir, "server", nil, nil)
+
+	reloader, err := newCertificateReloader(zap.NewNop().Sugar(), certFile, keyFile)
+	require.NoError(t, err)
+	original, err := reloader.getCertificate(nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.watch(ctx)
+	// give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+
+	writeTestCertificate(t, dir, "server", nil, nil)
+
+	assert.Eventually(t, func() bool {
+		current, _ := reloader.getCertificate(nil)
+		return string(current.Certificate[0]) != string(original.Certificate[0])
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func serveTestRequest(handler http.Handler, req *http.Request) int {
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	return resp.Code
+}
+
+// writeTestCertificate writes the PEM certificate and key of a certificate for localhost
+// signed by the parent or, if nil, self-signed
+func writeTestCertificate(t *testing.T, dir string, name string, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (certFile string, keyFile string) {
+	cert, key := createTestCertificate(t, name, parent, parentKey)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+"-key.pem")
+	require.NoError(t, ioutil.WriteFile(certFile, encodeTestCertificate(cert), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func createTestCertificate(t *testing.T, name string, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func encodeTestCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
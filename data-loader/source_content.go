@@ -17,12 +17,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
 	"io/ioutil"
 	"os"
 )
@@ -30,7 +34,10 @@ import (
 type SourceContent interface {
 	// Prepare returns the path to the directory containing the prepared content or an error
 	// if something went wrong
-	Prepare() (string, error)
+	Prepare(ctx context.Context) (string, error)
+	// Revision returns the commit SHA of the prepared content or an empty string if the
+	// content is not versioned
+	Revision() string
 	Cleanup()
 }
 
@@ -46,13 +53,17 @@ type dirSourceContent struct {
 	log *zap.SugaredLogger
 }
 
-func (c *dirSourceContent) Prepare() (string, error) {
+func (c *dirSourceContent) Prepare(ctx context.Context) (string, error) {
 	c.log.Infow("using source content from local directory",
 		"dir", c.dir)
 	// just return the configured directory
 	return c.dir, nil
 }
 
+func (c *dirSourceContent) Revision() string {
+	return ""
+}
+
 func (c *dirSourceContent) Cleanup() {
 	// no cleanup needed
 }
@@ -78,44 +89,50 @@ type gitSourceContent struct {
 	githubToken string
 }
 
-func (c *gitSourceContent) Prepare() (string, error) {
+func (c *gitSourceContent) Prepare(ctx context.Context) (string, error) {
 	var err error
 	c.workingDir, err = ioutil.TempDir("", "data-loader")
 	if err != nil {
 		return "", fmt.Errorf("failed to create temp dir: %w", err)
 	}
 
-	var authMethod transport.AuthMethod = nil
-
-	if c.githubToken != "" {
-		authMethod = &http.BasicAuth{
-			Username: "git",
-			Password: c.githubToken,
-		}
+	err = c.clone(ctx)
+	if err != nil {
+		// callers only cleanup successfully prepared content, so don't leave a partial clone behind
+		c.Cleanup()
+		return "", err
 	}
 
-	repo, err := git.PlainClone(c.workingDir, false, &git.CloneOptions{
+	return c.workingDir, nil
+}
+
+func (c *gitSourceContent) clone(ctx context.Context) error {
+
+	timer := prometheus.NewTimer(cloneDuration)
+	defer timer.ObserveDuration()
+
+	repo, err := git.PlainCloneContext(ctx, c.workingDir, false, &git.CloneOptions{
 		URL:  c.repository,
-		Auth: authMethod,
+		Auth: githubAuth(c.githubToken),
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to clone repo: %w", err)
+		return fmt.Errorf("failed to clone repo: %w", err)
 	}
 
 	if c.sha != "" {
 		worktree, err := repo.Worktree()
 		if err != nil {
-			return "", fmt.Errorf("failed to access worktree: %w", err)
+			return fmt.Errorf("failed to access worktree: %w", err)
 		}
 
 		err = worktree.Checkout(&git.CheckoutOptions{Hash: plumbing.NewHash(c.sha)})
 		if err != nil {
-			return "", fmt.Errorf("failed to checkout specific commit: %w", err)
+			return fmt.Errorf("failed to checkout specific commit: %w", err)
 		}
 	} else {
 		headRef, err := repo.Head()
 		if err != nil {
-			return "", fmt.Errorf("failed to resolve HEAD: %w", err)
+			return fmt.Errorf("failed to resolve HEAD: %w", err)
 		}
 
 		c.sha = headRef.Hash().String()
@@ -125,10 +142,91 @@ func (c *gitSourceContent) Prepare() (string, error) {
 		"repo", c.repository,
 		"sha", c.sha)
 
-	return c.workingDir, nil
+	return nil
+}
+
+func (c *gitSourceContent) Revision() string {
+	return c.sha
 }
 
 func (c *gitSourceContent) Cleanup() {
 	//noinspection GoUnhandledErrorResult
 	os.RemoveAll(c.workingDir)
 }
+
+// GitRefResolver abstracts the resolution of a branch or tag to its full ref name and commit SHA
+// to allow for mocking during unit tests
+type GitRefResolver func(repository string, ref string) (refName string, sha string, err error)
+
+// NewGitRefResolver creates a GitRefResolver that queries the remote repository's refs,
+// much like "git ls-remote", without cloning it.
+func NewGitRefResolver(githubToken string) GitRefResolver {
+	return func(repository string, ref string) (string, string, error) {
+		return resolveGitRef(repository, ref, githubToken)
+	}
+}
+
+func resolveGitRef(repository string, ref string, githubToken string) (string, string, error) {
+	refs, err := listGitRefs(repository, githubToken)
+	if err != nil {
+		return "", "", err
+	}
+
+	// allow for full ref names or the short names of branches and tags
+	candidates := []plumbing.ReferenceName{
+		plumbing.ReferenceName(ref),
+		plumbing.NewBranchReferenceName(ref),
+		plumbing.NewTagReferenceName(ref),
+	}
+	for _, candidate := range candidates {
+		if found := findRef(refs, candidate); found != nil {
+			if found.Type() == plumbing.SymbolicReference {
+				found = findRef(refs, found.Target())
+				if found == nil {
+					break
+				}
+			}
+			return found.Name().String(), found.Hash().String(), nil
+		}
+	}
+
+	return "", "", fmt.Errorf("unable to find ref %s in %s", ref, repository)
+}
+
+// checkGitRemote verifies the repository's refs can be listed, much like "git ls-remote"
+func checkGitRemote(repository string, githubToken string) error {
+	_, err := listGitRefs(repository, githubToken)
+	return err
+}
+
+func listGitRefs(repository string, githubToken string) ([]*plumbing.Reference, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{repository},
+	})
+
+	refs, err := remote.List(&git.ListOptions{Auth: githubAuth(githubToken)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote refs of %s: %w", repository, err)
+	}
+	return refs, nil
+}
+
+func findRef(refs []*plumbing.Reference, name plumbing.ReferenceName) *plumbing.Reference {
+	for _, r := range refs {
+		if r.Name() == name {
+			return r
+		}
+	}
+	return nil
+}
+
+func githubAuth(githubToken string) transport.AuthMethod {
+	if githubToken == "" {
+		return nil
+	}
+	return &http.BasicAuth{
+		Username: "git",
+		Password: githubToken,
+	}
+}
@@ -0,0 +1,363 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/racker/go-restclient"
+	"golang.org/x/oauth2/google"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	gcsScheme         = "gs://"
+	gcsReadWriteScope = "https://www.googleapis.com/auth/devstorage.read_write"
+	stateTimeout      = 30 * time.Second
+	// stateTargetPlaceholder is replaced by the target name in a state location
+	stateTargetPlaceholder = "{target}"
+	// stateKeyPrefix identifies unique keys that are hashed, unlike those of earlier releases
+	stateKeyPrefix = "sha256:"
+)
+
+// gcsBaseUrl is a variable so that unit tests can use a fake server
+var gcsBaseUrl = "https://storage.googleapis.com"
+
+// EntityState records the Admin API entity that was created from or matched a source content
+// file
+type EntityState struct {
+	Definition string `json:"definition"`
+	// Path is relative to the root of the source content
+	Path string `json:"path"`
+	// UniqueKey is a hash of the unique field values, which may be resolved secrets or
+	// decrypted values that mustn't be stored
+	UniqueKey string `json:"uniqueKey"`
+	// EntityId is absent when the Admin API doesn't convey the ID of the entity
+	EntityId    interface{} `json:"entityId,omitempty"`
+	ContentHash string      `json:"contentHash"`
+	// Sha is the revision of the source content when the entity was last created or matched
+	Sha       string    `json:"sha,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// LoadState tracks the entity of each source content file across loads
+type LoadState struct {
+	Entities []*EntityState `json:"entities"`
+}
+
+// StateStore persists the LoadState of one Admin API target
+type StateStore interface {
+	// Load returns the persisted state or an empty state if none has been saved
+	Load(ctx context.Context) (*LoadState, error)
+	Save(ctx context.Context, state *LoadState) error
+}
+
+// NewStateStore creates a store for the given location, which is either a gs://bucket/object
+// URL or a local file path
+func NewStateStore(ctx context.Context, location string) (StateStore, error) {
+	if strings.HasPrefix(location, gcsScheme) {
+		parts := strings.SplitN(strings.TrimPrefix(location, gcsScheme), "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("state location %s must be of the form gs://bucket/object", location)
+		}
+
+		client, err := google.DefaultClient(ctx, gcsReadWriteScope)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup Google Cloud Storage credentials: %w", err)
+		}
+		return newGcsStateStore(client, parts[0], parts[1])
+	}
+
+	return &fileStateStore{path: location}, nil
+}
+
+// stateLocationForTarget replaces the target placeholder of a state location
+func stateLocationForTarget(location string, target string) string {
+	return strings.ReplaceAll(location, stateTargetPlaceholder, target)
+}
+
+type fileStateStore struct {
+	path string
+}
+
+func (s *fileStateStore) Load(context.Context) (*LoadState, error) {
+	content, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return &LoadState{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	return decodeLoadState(content)
+}
+
+// Save writes to a temporary file that replaces the state file so that a failure never leaves
+// a partially written state
+func (s *fileStateStore) Save(_ context.Context, state *LoadState) error {
+	content, err := encodeLoadState(state)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomically(s.path, content)
+	if err != nil {
+		return fmt.Errorf("failed to save state file: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomically writes to a temporary file that replaces the file at path, creating its
+// directory if needed
+func writeFileAtomically(path string, content []byte) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tempFile, err := ioutil.TempFile(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(content)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	err = os.Rename(tempFile.Name(), path)
+	if err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+	return nil
+}
+
+// gcsStateStore keeps the state in a Google Cloud Storage object using the JSON API
+type gcsStateStore struct {
+	restClient *restclient.Client
+	bucket     string
+	object     string
+}
+
+func newGcsStateStore(client *http.Client, bucket string, object string) (*gcsStateStore, error) {
+	restClient := restclient.NewClient()
+	err := restClient.SetBaseUrl(gcsBaseUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage URL: %w", err)
+	}
+	restClient.Timeout = stateTimeout
+	restClient.AddInterceptor(clientInterceptor(client))
+
+	return &gcsStateStore{
+		restClient: restClient,
+		bucket:     bucket,
+		object:     object,
+	}, nil
+}
+
+func (s *gcsStateStore) Load(ctx context.Context) (*LoadState, error) {
+	query := make(url.Values)
+	query.Set("alt", "media")
+
+	var content []byte
+	entity := &restclient.Entity{ContentType: restclient.JsonType, Content: content}
+	err := s.restClient.ExchangeWithContext(ctx, "GET",
+		fmt.Sprintf("/storage/v1/b/%s/o/%s", url.PathEscape(s.bucket), url.PathEscape(s.object)),
+		query, nil, entity)
+	var failedResponse *restclient.FailedResponseError
+	if errors.As(err, &failedResponse) && failedResponse.StatusCode == http.StatusNotFound {
+		return &LoadState{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to download state object: %w", err)
+	}
+
+	return decodeLoadState(entity.Content.([]byte))
+}
+
+func (s *gcsStateStore) Save(ctx context.Context, state *LoadState) error {
+	content, err := encodeLoadState(state)
+	if err != nil {
+		return err
+	}
+
+	query := make(url.Values)
+	query.Set("uploadType", "media")
+	query.Set("name", s.object)
+
+	err = s.restClient.ExchangeWithContext(ctx, "POST",
+		fmt.Sprintf("/upload/storage/v1/b/%s/o", url.PathEscape(s.bucket)),
+		query, &restclient.Entity{ContentType: restclient.JsonType, Content: content}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to upload state object: %w", err)
+	}
+	return nil
+}
+
+func decodeLoadState(content []byte) (*LoadState, error) {
+	var state LoadState
+	err := json.Unmarshal(content, &state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode state: %w", err)
+	}
+	// the plaintext keys of earlier releases are hashed when the state is next saved
+	for _, entityState := range state.Entities {
+		if !strings.HasPrefix(entityState.UniqueKey, stateKeyPrefix) {
+			entityState.UniqueKey = stateKey(entityState.UniqueKey)
+		}
+	}
+	return &state, nil
+}
+
+// stateKey hashes a unique key formed from unique field values
+func stateKey(uniqueKey string) string {
+	sum := sha256.Sum256([]byte(uniqueKey))
+	return stateKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+func encodeLoadState(state *LoadState) ([]byte, error) {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode state: %w", err)
+	}
+	return content, nil
+}
+
+// stateTracker accumulates the entity state of the files processed during one load
+type stateTracker struct {
+	previous *LoadState
+	// previousByKey indexes the previous entries by definition and unique key
+	previousByKey map[string]*EntityState
+	// previousByHash indexes the previous entries by definition and content hash
+	previousByHash map[string][]*EntityState
+	sha            string
+	// current is keyed by definition and then path
+	current map[string]map[string]*EntityState
+	// completed are the definitions whose source content was fully processed
+	completed map[string]bool
+}
+
+func newStateTracker(previous *LoadState, sha string) *stateTracker {
+	t := &stateTracker{
+		previous:       previous,
+		previousByKey:  make(map[string]*EntityState),
+		previousByHash: make(map[string][]*EntityState),
+		sha:            sha,
+		current:        make(map[string]map[string]*EntityState),
+		completed:      make(map[string]bool),
+	}
+	for _, entityState := range previous.Entities {
+		t.previousByKey[entityState.Definition+"\x00"+entityState.UniqueKey] = entityState
+		hashKey := entityState.Definition + "\x00" + entityState.ContentHash
+		t.previousByHash[hashKey] = append(t.previousByHash[hashKey], entityState)
+	}
+	return t
+}
+
+// unchanged returns the previous entry of a file with the same content, which is either the
+// entry of the same path or, when the file was renamed, of a path that no longer exists
+func (t *stateTracker) unchanged(definition string, relPath string, hash string, sourceContentPath string) *EntityState {
+	var renamed *EntityState
+	for _, previous := range t.previousByHash[definition+"\x00"+hash] {
+		if previous.Path == relPath {
+			return previous
+		}
+		_, err := os.Stat(filepath.Join(sourceContentPath, filepath.FromSlash(previous.Path)))
+		if os.IsNotExist(err) {
+			renamed = previous
+		}
+	}
+	return renamed
+}
+
+// carry records the previous entry of an unchanged file at its current path
+func (t *stateTracker) carry(previous *EntityState, relPath string) {
+	entityState := *previous
+	entityState.Path = relPath
+	t.record(&entityState)
+}
+
+// record tracks the entity of a processed file and returns the previous path of the same
+// entity if the file was renamed, in which case the previous entity ID is retained when the
+// ID is otherwise unknown
+func (t *stateTracker) record(entityState *EntityState) (renamedFrom string) {
+	entityState.Sha = t.sha
+	entityState.UpdatedAt = time.Now()
+
+	paths, exists := t.current[entityState.Definition]
+	if !exists {
+		paths = make(map[string]*EntityState)
+		t.current[entityState.Definition] = paths
+	}
+	paths[entityState.Path] = entityState
+
+	previous, exists := t.previousByKey[entityState.Definition+"\x00"+entityState.UniqueKey]
+	if !exists || previous.Path == entityState.Path {
+		return ""
+	}
+	if entityState.EntityId == nil {
+		entityState.EntityId = previous.EntityId
+	}
+	return previous.Path
+}
+
+// complete marks the definition as fully processed, so that entries of its files that no
+// longer exist can be dropped
+func (t *stateTracker) complete(definition LoaderDefinition) {
+	t.completed[definition.Name] = true
+}
+
+// merged combines the previous state with the current load. Previous entries are retained
+// unless replaced by the current load or their file is gone from a completed definition.
+func (t *stateTracker) merged() *LoadState {
+	state := &LoadState{}
+	for _, previous := range t.previous.Entities {
+		if t.completed[previous.Definition] {
+			continue
+		}
+		if _, replaced := t.current[previous.Definition][previous.Path]; replaced {
+			continue
+		}
+		state.Entities = append(state.Entities, previous)
+	}
+	for _, paths := range t.current {
+		for _, entityState := range paths {
+			state.Entities = append(state.Entities, entityState)
+		}
+	}
+
+	sort.Slice(state.Entities, func(i, j int) bool {
+		a, b := state.Entities[i], state.Entities[j]
+		if a.Definition != b.Definition {
+			return a.Definition < b.Definition
+		}
+		return a.Path < b.Path
+	})
+	return state
+}
@@ -0,0 +1,361 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFileStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewStateStore(context.Background(), filepath.Join(dir, "nested", "state.json"))
+	require.NoError(t, err)
+
+	state, err := store.Load(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, state.Entities)
+
+	saved := &LoadState{Entities: []*EntityState{
+		{Definition: "zones", Path: "zones/dfw.json", UniqueKey: stateKey(`["public/dfw"]`), EntityId: "z-1", ContentHash: "abc"},
+	}}
+	require.NoError(t, store.Save(context.Background(), saved))
+
+	state, err = store.Load(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, saved, state)
+}
+
+func TestGcsStateStore(t *testing.T) {
+	var stored []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/storage/v1/b/bucket/o/data-loader/prod.json":
+			assert.Equal(t, "media", r.URL.Query().Get("alt"))
+			if stored == nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(stored)
+		case r.Method == "POST" && r.URL.Path == "/upload/storage/v1/b/bucket/o":
+			assert.Equal(t, "media", r.URL.Query().Get("uploadType"))
+			assert.Equal(t, "data-loader/prod.json", r.URL.Query().Get("name"))
+			var err error
+			stored, err = ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	origBaseUrl := gcsBaseUrl
+	gcsBaseUrl = ts.URL
+	defer func() { gcsBaseUrl = origBaseUrl }()
+
+	store, err := newGcsStateStore(http.DefaultClient, "bucket", "data-loader/prod.json")
+	require.NoError(t, err)
+
+	state, err := store.Load(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, state.Entities)
+
+	saved := &LoadState{Entities: []*EntityState{
+		{Definition: "zones", Path: "zones/dfw.json", UniqueKey: stateKey(`["public/dfw"]`), EntityId: "z-1", ContentHash: "abc"},
+	}}
+	require.NoError(t, store.Save(context.Background(), saved))
+
+	state, err = store.Load(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, saved, state)
+}
+
+func TestStateTracker(t *testing.T) {
+	zones := *findLoaderDefinition("zones")
+	previous := &LoadState{Entities: []*EntityState{
+		{Definition: "zones", Path: "zones/old.json", UniqueKey: "public/dfw", EntityId: "z-1"},
+		{Definition: "zones", Path: "zones/removed.json", UniqueKey: "public/iad", EntityId: "z-2"},
+		{Definition: "monitor-templates", Path: "monitor-templates/cpu.json", UniqueKey: "cpu", EntityId: "t-1"},
+	}}
+
+	tracker := newStateTracker(previous, "sha-2")
+	renamedFrom := tracker.record(&EntityState{Definition: "zones", Path: "zones/dfw.json", UniqueKey: "public/dfw", EntityId: "z-1"})
+	assert.Equal(t, "zones/old.json", renamedFrom)
+	renamedFrom = tracker.record(&EntityState{Definition: "zones", Path: "zones/ord.json", UniqueKey: "public/ord", EntityId: "z-3"})
+	assert.Empty(t, renamedFrom)
+	tracker.complete(zones)
+
+	// the ID of a renamed file is retained when it's otherwise unknown
+	renamedFrom = tracker.record(&EntityState{Definition: "monitor-templates", Path: "monitor-templates/renamed.json", UniqueKey: "cpu"})
+	assert.Equal(t, "monitor-templates/cpu.json", renamedFrom)
+	assert.Equal(t, "t-1", tracker.current["monitor-templates"]["monitor-templates/renamed.json"].EntityId)
+
+	merged := tracker.merged()
+	require.Len(t, merged.Entities, 4)
+	// entries of definitions that weren't completed are retained
+	assert.Equal(t, "monitor-templates/cpu.json", merged.Entities[0].Path)
+	assert.Equal(t, "monitor-templates/renamed.json", merged.Entities[1].Path)
+	assert.Equal(t, "zones/dfw.json", merged.Entities[2].Path)
+	assert.Equal(t, "sha-2", merged.Entities[2].Sha)
+	assert.Equal(t, "zones/ord.json", merged.Entities[3].Path)
+}
+
+func TestLoaderImpl_LoadAll_State(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	contentDir := filepath.Join(dir, "content")
+	writeTestContent(t, contentDir, "zones", "dfw.json", `{"name":"public/dfw"}`)
+	writeTestContent(t, contentDir, "zones", "ord.json", `{"name":"public/ord"}`)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/zones":
+			_, _ = w.Write([]byte(`{"content":[{"id":"z-1","name":"public/dfw"}],"last":true}`))
+		case r.Method == "POST" && r.URL.Path == "/api/zones":
+			_, _ = w.Write([]byte(`{"id":"z-2","name":"public/ord"}`))
+		default:
+			_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+		}
+	}))
+	defer ts.Close()
+
+	statePath := filepath.Join(dir, "state.json")
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL, StateLocation: statePath})
+	require.NoError(t, err)
+
+	_, err = loader.LoadAll(context.Background(), contentDir, LoadOptions{Revision: "sha-1"})
+	require.NoError(t, err)
+
+	state, err := (&fileStateStore{path: statePath}).Load(context.Background())
+	require.NoError(t, err)
+	require.Len(t, state.Entities, 2)
+
+	assert.Equal(t, "zones/dfw.json", state.Entities[0].Path)
+	assert.Equal(t, stateKey(`["public/dfw"]`), state.Entities[0].UniqueKey)
+	assert.Equal(t, "z-1", state.Entities[0].EntityId)
+	assert.Equal(t, "sha-1", state.Entities[0].Sha)
+	assert.Equal(t, hashTestFile(t, filepath.Join(contentDir, "zones", "dfw.json")), state.Entities[0].ContentHash)
+
+	assert.Equal(t, "zones/ord.json", state.Entities[1].Path)
+	assert.Equal(t, "z-2", state.Entities[1].EntityId)
+}
+
+func TestDecodeLoadState_HashesLegacyKeys(t *testing.T) {
+	state, err := decodeLoadState([]byte(`{"entities":[
+		{"definition":"zones","path":"zones/dfw.json","uniqueKey":"[\"public/dfw\"]"},
+		{"definition":"zones","path":"zones/ord.json","uniqueKey":"` + stateKey(`["public/ord"]`) + `"}
+	]}`))
+	require.NoError(t, err)
+
+	assert.Equal(t, stateKey(`["public/dfw"]`), state.Entities[0].UniqueKey)
+	assert.Equal(t, stateKey(`["public/ord"]`), state.Entities[1].UniqueKey)
+}
+
+func TestLoaderImpl_LoadAll_StateSkipsUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(original []LoaderDefinition) { loaderDefinitions = original }(loaderDefinitions)
+	loaderDefinitions = []LoaderDefinition{{
+		Name:             "things",
+		ApiPath:          "/api/things",
+		UniqueFieldPaths: []string{"$.name"},
+		Lookup:           &LookupStrategy{UrlTemplate: "/api/things/{$.name}"},
+	}}
+
+	contentDir := filepath.Join(dir, "content")
+	writeTestContent(t, contentDir, "things", "a.json", `{"name":"a"}`)
+	writeTestContent(t, contentDir, "things", "b.json", `{"name":"b"}`)
+
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/things/a":
+			_, _ = w.Write([]byte(`{"id":"t-a","name":"a"}`))
+		case r.Method == "GET":
+			http.NotFound(w, r)
+		case r.Method == "POST":
+			_, _ = w.Write([]byte(`{"id":"t-b","name":"b"}`))
+		}
+	}))
+	defer ts.Close()
+
+	statePath := filepath.Join(dir, "state.json")
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil,
+		&Config{AdminUrl: ts.URL, StateLocation: statePath, LookupDefinitions: []string{"things"}})
+	require.NoError(t, err)
+
+	_, err = loader.LoadAll(context.Background(), contentDir, LoadOptions{Revision: "sha-1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"GET /api/things/a", "GET /api/things/b", "POST /api/things"}, requests)
+
+	// unchanged files aren't looked up again, even when renamed
+	requests = nil
+	require.NoError(t, os.Rename(filepath.Join(contentDir, "things", "a.json"), filepath.Join(contentDir, "things", "c.json")))
+	stats, err := loader.LoadAll(context.Background(), contentDir, LoadOptions{Revision: "sha-2"})
+	require.NoError(t, err)
+	assert.Empty(t, requests)
+	assert.Equal(t, 2, stats.SkippedExisting)
+
+	state, err := (&fileStateStore{path: statePath}).Load(context.Background())
+	require.NoError(t, err)
+	require.Len(t, state.Entities, 2)
+	assert.Equal(t, "things/b.json", state.Entities[0].Path)
+	assert.Equal(t, "things/c.json", state.Entities[1].Path)
+	assert.Equal(t, "t-a", state.Entities[1].EntityId)
+	assert.Equal(t, "sha-2", state.Entities[1].Sha)
+
+	// a changed file is processed again
+	requests = nil
+	writeTestContent(t, contentDir, "things", "b.json", `{"name":"b","changed":true}`)
+	_, err = loader.LoadAll(context.Background(), contentDir, LoadOptions{Revision: "sha-3"})
+	require.NoError(t, err)
+	assert.Contains(t, requests, "GET /api/things/b")
+
+	// the unique field values aren't stored in plaintext
+	stored, err := ioutil.ReadFile(statePath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(stored), `\"a\"`)
+}
+
+func TestLoaderImpl_LoadAll_StateRecreatesDeletedEntity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	contentDir := filepath.Join(dir, "content")
+	writeTestContent(t, contentDir, "zones", "dfw.json", `{"name":"public/dfw"}`)
+
+	existing := `{"content":[{"id":"z-1","name":"public/dfw"}],"last":true}`
+	posts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/zones":
+			_, _ = w.Write([]byte(existing))
+		case r.Method == "POST" && r.URL.Path == "/api/zones":
+			posts++
+			_, _ = w.Write([]byte(`{"id":"z-2","name":"public/dfw"}`))
+		default:
+			_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+		}
+	}))
+	defer ts.Close()
+
+	statePath := filepath.Join(dir, "state.json")
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL, StateLocation: statePath})
+	require.NoError(t, err)
+
+	_, err = loader.LoadAll(context.Background(), contentDir, LoadOptions{Revision: "sha-1"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, posts)
+
+	// the entity of the unchanged file was deleted from the Admin API
+	existing = `{"content":[],"last":true}`
+	_, err = loader.LoadAll(context.Background(), contentDir, LoadOptions{Revision: "sha-2"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, posts)
+
+	state, err := (&fileStateStore{path: statePath}).Load(context.Background())
+	require.NoError(t, err)
+	require.Len(t, state.Entities, 1)
+	assert.Equal(t, "z-2", state.Entities[0].EntityId)
+}
+
+func TestLoaderImpl_LoadAll_PlanDuringApplyKeepsState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	contentDir := filepath.Join(dir, "content")
+	writeTestContent(t, contentDir, "zones", "dfw.json", `{"name":"public/dfw"}`)
+
+	var holdPlan int32
+	posting := make(chan struct{})
+	releasePost := make(chan struct{})
+	planning := make(chan struct{}, 1)
+	releasePlan := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "POST":
+			close(posting)
+			<-releasePost
+			_, _ = w.Write([]byte(`{"id":"z-1","name":"public/dfw"}`))
+		default:
+			if atomic.LoadInt32(&holdPlan) == 1 {
+				select {
+				case planning <- struct{}{}:
+				default:
+				}
+				<-releasePlan
+			}
+			_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+		}
+	}))
+	defer ts.Close()
+
+	statePath := filepath.Join(dir, "state.json")
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL, StateLocation: statePath})
+	require.NoError(t, err)
+
+	applied := make(chan error, 1)
+	go func() {
+		_, err := loader.LoadAll(context.Background(), contentDir, LoadOptions{Revision: "sha-1"})
+		applied <- err
+	}()
+	<-posting
+
+	// the plan reads the state before the apply saves it and finishes after
+	atomic.StoreInt32(&holdPlan, 1)
+	planned := make(chan error, 1)
+	go func() {
+		_, err := loader.LoadAll(context.Background(), contentDir, LoadOptions{Revision: "sha-1", PlanOnly: true})
+		planned <- err
+	}()
+	<-planning
+	close(releasePost)
+	require.NoError(t, <-applied)
+	close(releasePlan)
+	require.NoError(t, <-planned)
+
+	state, err := (&fileStateStore{path: statePath}).Load(context.Background())
+	require.NoError(t, err)
+	require.Len(t, state.Entities, 1)
+	assert.Equal(t, "z-1", state.Entities[0].EntityId)
+}
@@ -0,0 +1,39 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import "fmt"
+
+// tombstoneKey marks a content file, such as {"name": "public/dfw", "$delete": true}, whose
+// unique fields identify an existing entity to delete
+const tombstoneKey = "$delete"
+
+// isTombstone reports whether the decoded content is a tombstone
+func isTombstone(content interface{}) (bool, error) {
+	contentMap, ok := content.(map[string]interface{})
+	if !ok {
+		return false, nil
+	}
+	marker, exists := contentMap[tombstoneKey]
+	if !exists {
+		return false, nil
+	}
+	if marker != true {
+		return false, fmt.Errorf("%s must be true", tombstoneKey)
+	}
+	return true, nil
+}
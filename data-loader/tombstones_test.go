@@ -0,0 +1,86 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestIsTombstone(t *testing.T) {
+	tombstone, err := isTombstone(decodeTestContent(t, `{"name":"public/dfw","$delete":true}`))
+	require.NoError(t, err)
+	assert.True(t, tombstone)
+
+	tombstone, err = isTombstone(decodeTestContent(t, `{"name":"public/dfw"}`))
+	require.NoError(t, err)
+	assert.False(t, tombstone)
+
+	_, err = isTombstone(decodeTestContent(t, `{"name":"public/dfw","$delete":"yes"}`))
+	assert.EqualError(t, err, "$delete must be true")
+}
+
+func TestLoaderImpl_LoadAll_Tombstones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-tombstones")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTestContent(t, dir, "monitor-templates", "cpu.json", `{"name":"cpu","$delete":true}`)
+	writeTestContent(t, dir, "monitor-templates", "mem.json", `{"name":"mem","$delete":true}`)
+	writeTestContent(t, dir, "monitor-templates", "disk.json", `{"name":"disk","$delete":true}`)
+
+	var deleted []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/monitor-templates":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"content":[{"id":1234567,"name":"cpu"},{"id":"t-2","name":"disk"}],"last":true}`))
+		case r.Method == "DELETE" && r.URL.Path == "/api/monitor-templates/t-2":
+			deleted = append(deleted, r.URL.Path)
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.Method == "DELETE":
+			deleted = append(deleted, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "GET":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"content":[],"last":true}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer ts.Close()
+
+	loader, err := NewLoader(zap.NewNop().Sugar(), nil, &Config{AdminUrl: ts.URL})
+	require.NoError(t, err)
+
+	stats, err := loader.LoadAll(context.Background(), dir, LoadOptions{})
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []string{"/api/monitor-templates/1234567", "/api/monitor-templates/t-2"}, deleted)
+	assert.Equal(t, 0, stats.Created)
+	assert.Equal(t, 1, stats.Deleted)
+	assert.Equal(t, 1, stats.AlreadyDeleted)
+	assert.Equal(t, 1, stats.FailedToDelete)
+	assert.Equal(t, 1, stats.Definitions["monitor-templates"].Deleted)
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ValidationIssue is a problem found in a content file or a reason it couldn't be fully checked
+type ValidationIssue struct {
+	Definition string `json:"definition"`
+	Path       string `json:"path"`
+	Message    string `json:"message"`
+}
+
+// ValidationReport is the outcome of validating source content
+type ValidationReport struct {
+	Checked  int               `json:"checked"`
+	Errors   []ValidationIssue `json:"errors,omitempty"`
+	Warnings []ValidationIssue `json:"warnings,omitempty"`
+}
+
+func (r *ValidationReport) Valid() bool {
+	return len(r.Errors) == 0
+}
+
+func (r *ValidationReport) addError(definition LoaderDefinition, path string, format string, args ...interface{}) {
+	r.Errors = append(r.Errors, ValidationIssue{
+		Definition: definition.Name,
+		Path:       path,
+		Message:    fmt.Sprintf(format, args...),
+	})
+}
+
+func (r *ValidationReport) addWarning(definition LoaderDefinition, path string, format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, ValidationIssue{
+		Definition: definition.Name,
+		Path:       path,
+		Message:    fmt.Sprintf(format, args...),
+	})
+}
+
+// declaredContent is a content file that declared a unique field key
+type declaredContent struct {
+	path      string
+	tombstone bool
+}
+
+// ValidateContent checks the source content of each loader definition without contacting
+// the Admin API. Each content file must decode into a JSON object that has the definition's
+// unique fields and no two files of a definition may have the same unique field values, except
+// for tombstones of the same entity.
+// Encrypted content that can't be decrypted is only checked where its values aren't encrypted.
+// Files ignored by the loader ignore file aren't checked.
+func ValidateContent(sourceContentPath string, decryptor *ContentDecryptor) (*ValidationReport, error) {
+	report := &ValidationReport{}
+	filter, err := newContentFilter(sourceContentPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, definition := range loaderDefinitions {
+		definitionPath := filepath.Join(sourceContentPath, definition.Name)
+		if _, err := os.Stat(definitionPath); os.IsNotExist(err) {
+			continue
+		}
+
+		// unique field key to the file that declared it
+		declared := make(map[string]declaredContent)
+
+		err := walkContentFiles(sourceContentPath, definitionPath, filter,
+			func(path string, _ string) error {
+				report.Checked++
+				validateContentFile(report, definition, decryptor, path, declared)
+				return nil
+			})
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk content of %s: %w", definition.Name, err)
+		}
+	}
+
+	return report, nil
+}
+
+func validateContentFile(report *ValidationReport, definition LoaderDefinition, decryptor *ContentDecryptor,
+	path string, declared map[string]declaredContent) {
+
+	decoded, err := decryptor.decodeContentFile(path)
+	if err != nil {
+		report.addError(definition, path, "%s", err)
+		return
+	}
+	if decoded.content == nil && decoded.locked {
+		report.addWarning(definition, path, "file is encrypted and no decryption key is configured, so it was not checked")
+		return
+	}
+
+	if _, ok := decoded.content.(map[string]interface{}); !ok {
+		report.addError(definition, path, "content must be a JSON object")
+		return
+	}
+
+	tombstone, err := isTombstone(decoded.content)
+	if err != nil {
+		report.addError(definition, path, "%s", err)
+		return
+	}
+
+	fieldValues, err := extractFieldValues(definition, decoded.content)
+	if err != nil {
+		report.addError(definition, path, "%s", err)
+		return
+	}
+
+	for _, value := range fieldValues {
+		if isSopsEncrypted(value) || isSecretRef(value) || isEntityRef(value) {
+			report.addWarning(definition, path, "unique fields are encrypted or references, so uniqueness was not checked")
+			return
+		}
+	}
+
+	key := UniquenessTracker{}.formKey(fieldValues)
+	if other, exists := declared[key]; exists {
+		switch {
+		case tombstone && other.tombstone:
+			// redundant, but deleting is idempotent
+		case tombstone:
+			report.addError(definition, path, "tombstone has the same unique field values as %s", other.path)
+		case other.tombstone:
+			report.addError(definition, path, "has the same unique field values as tombstone %s", other.path)
+		default:
+			report.addError(definition, path, "has the same unique field values as %s", other.path)
+		}
+		return
+	}
+	declared[key] = declaredContent{path: path, tombstone: tombstone}
+}
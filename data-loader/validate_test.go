@@ -0,0 +1,137 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestContent(t *testing.T, dir string, definition string, name string, content string) string {
+	path := filepath.Join(dir, definition, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestValidateContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	first := writeTestContent(t, dir, "zones", "a.json", `{"name":"public/dfw"}`)
+	duplicate := writeTestContent(t, dir, "zones", "b.json", `{"name":"public/dfw"}`)
+	writeTestContent(t, dir, "zones", "c.json", `{"name":"public/ord"}`)
+	missingField := writeTestContent(t, dir, "zones", "d.json", `{"provider":"rackspace"}`)
+	notObject := writeTestContent(t, dir, "zones", "e.json", `["public/iad"]`)
+	writeTestContent(t, dir, "zones", "README.md", `not content`)
+	secretRef := writeTestContent(t, dir, "tenant-metadata", "a.json",
+		`{"tenantId":{"$secret":"env:TENANT_ID"},"key":"k","value":"v"}`)
+
+	report, err := ValidateContent(dir, &ContentDecryptor{})
+	require.NoError(t, err)
+
+	assert.False(t, report.Valid())
+	assert.Equal(t, 6, report.Checked)
+	require.Len(t, report.Errors, 3)
+	assert.Equal(t, ValidationIssue{
+		Definition: "zones",
+		Path:       duplicate,
+		Message:    "has the same unique field values as " + first,
+	}, report.Errors[0])
+	assert.Equal(t, missingField, report.Errors[1].Path)
+	assert.Equal(t, ValidationIssue{
+		Definition: "zones",
+		Path:       notObject,
+		Message:    "content must be a JSON object",
+	}, report.Errors[2])
+
+	require.Len(t, report.Warnings, 1)
+	assert.Equal(t, secretRef, report.Warnings[0].Path)
+}
+
+func TestValidateContent_EncryptedWithoutKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "tenant-metadata"), 0755))
+	// unique fields of the SOPS file are not encrypted, so they're still checked
+	sops := filepath.Join(dir, "tenant-metadata", "a.json")
+	writeSopsContent(t, sops, identity)
+	duplicate := writeTestContent(t, dir, "tenant-metadata", "b.json",
+		`{"tenantId":"t-1","key":"db","value":"plain"}`)
+	wholeFile := filepath.Join(dir, "tenant-metadata", "c.json.age")
+	require.NoError(t, ioutil.WriteFile(wholeFile,
+		ageEncrypt(t, identity.Recipient(), []byte(`{}`), false), 0644))
+
+	report, err := ValidateContent(dir, &ContentDecryptor{})
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, report.Checked)
+	assert.Equal(t, []ValidationIssue{{
+		Definition: "tenant-metadata",
+		Path:       duplicate,
+		Message:    "has the same unique field values as " + sops,
+	}}, report.Errors)
+	require.Len(t, report.Warnings, 1)
+	assert.Equal(t, wholeFile, report.Warnings[0].Path)
+}
+
+func TestValidateContent_Tombstones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	live := writeTestContent(t, dir, "zones", "a.json", `{"name":"public/dfw"}`)
+	tombstone := writeTestContent(t, dir, "zones", "b.json", `{"name":"public/dfw","$delete":true}`)
+	writeTestContent(t, dir, "zones", "c.json", `{"name":"public/ord","$delete":true}`)
+	writeTestContent(t, dir, "zones", "d.json", `{"name":"public/ord","$delete":true}`)
+	invalid := writeTestContent(t, dir, "zones", "e.json", `{"name":"public/iad","$delete":false}`)
+
+	report, err := ValidateContent(dir, &ContentDecryptor{})
+	require.NoError(t, err)
+
+	assert.Equal(t, []ValidationIssue{
+		{Definition: "zones", Path: tombstone, Message: "tombstone has the same unique field values as " + live},
+		{Definition: "zones", Path: invalid, Message: "$delete must be true"},
+	}, report.Errors)
+}
+
+func TestValidateContent_LoaderIgnore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, loaderIgnoreFile), []byte("*.wip.json\n"), 0644))
+	writeTestContent(t, dir, "zones", "a.json", `{"name":"public/dfw"}`)
+	writeTestContent(t, dir, "zones", "a.wip.json", `{"name":"public/dfw"}`)
+
+	report, err := ValidateContent(dir, &ContentDecryptor{})
+	require.NoError(t, err)
+
+	assert.True(t, report.Valid())
+	assert.Equal(t, 1, report.Checked)
+}
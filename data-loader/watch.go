@@ -0,0 +1,293 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/google/subcommands"
+	"github.com/itzg/go-flagsfiller"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const appliedShaFilename = "watch-git-applied.json"
+
+const (
+	watchPollUnchanged = "unchanged"
+	watchPollLoaded    = "loaded"
+	watchPollFailed    = "failed"
+)
+
+// AppliedSha records the last SHA of a repository ref that was successfully loaded
+type AppliedSha struct {
+	Repository string    `json:"repository"`
+	Ref        string    `json:"ref"`
+	Sha        string    `json:"sha"`
+	AppliedAt  time.Time `json:"appliedAt"`
+}
+
+// GitLoadFunc loads the content of the repository at the SHA resolved from the ref name
+type GitLoadFunc func(ctx context.Context, refName string, sha string) error
+
+// GitWatcher polls a repository ref and loads its content each time the head SHA changes
+type GitWatcher struct {
+	log         *zap.SugaredLogger
+	repository  string
+	ref         string
+	interval    time.Duration
+	refResolver GitRefResolver
+	shaFile     string
+	load        GitLoadFunc
+}
+
+func NewGitWatcher(log *zap.SugaredLogger, repository string, ref string, interval time.Duration,
+	refResolver GitRefResolver, shaFile string, load GitLoadFunc) *GitWatcher {
+	return &GitWatcher{
+		log:         log.Named("watch"),
+		repository:  repository,
+		ref:         ref,
+		interval:    interval,
+		refResolver: refResolver,
+		shaFile:     shaFile,
+		load:        load,
+	}
+}
+
+// Run polls immediately and then at each interval until the context is done
+func (w *GitWatcher) Run(ctx context.Context) {
+	w.log.Infow("watching repository",
+		"repository", w.repository, "ref", w.ref, "interval", w.interval, "shaFile", w.shaFile)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		outcome, err := w.poll(ctx)
+		watchPolls.WithLabelValues(outcome).Inc()
+		if err != nil {
+			// the next poll retries since the applied SHA was not updated
+			w.log.Warnw("failed to poll repository", "err", err, "repository", w.repository, "ref", w.ref)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll resolves the ref and loads its head when it differs from the applied SHA
+func (w *GitWatcher) poll(ctx context.Context) (string, error) {
+	refName, sha, err := w.refResolver(w.repository, w.ref)
+	if err != nil {
+		return watchPollFailed, fmt.Errorf("failed to resolve ref: %w", err)
+	}
+
+	applied, err := w.appliedSha()
+	if err != nil {
+		return watchPollFailed, err
+	}
+	if applied == sha {
+		w.log.Debugw("head is unchanged", "ref", refName, "sha", sha)
+		return watchPollUnchanged, nil
+	}
+
+	w.log.Infow("loading changed head", "ref", refName, "sha", sha, "appliedSha", applied)
+	err = w.load(ctx, refName, sha)
+	if err != nil {
+		return watchPollFailed, fmt.Errorf("failed to load %s: %w", sha, err)
+	}
+
+	err = w.saveAppliedSha(sha)
+	if err != nil {
+		return watchPollFailed, err
+	}
+	return watchPollLoaded, nil
+}
+
+// appliedSha reads the applied SHA, which is empty when none was saved or it was saved for a
+// different repository or ref
+func (w *GitWatcher) appliedSha() (string, error) {
+	content, err := ioutil.ReadFile(w.shaFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read applied SHA file: %w", err)
+	}
+
+	var applied AppliedSha
+	err = json.Unmarshal(content, &applied)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse applied SHA file: %w", err)
+	}
+	if applied.Repository != w.repository || applied.Ref != w.ref {
+		return "", nil
+	}
+	return applied.Sha, nil
+}
+
+func (w *GitWatcher) saveAppliedSha(sha string) error {
+	content, err := json.Marshal(&AppliedSha{
+		Repository: w.repository,
+		Ref:        w.ref,
+		Sha:        sha,
+		AppliedAt:  time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode applied SHA: %w", err)
+	}
+
+	err = writeFileAtomically(w.shaFile, content)
+	if err != nil {
+		return fmt.Errorf("failed to save applied SHA file: %w", err)
+	}
+	return nil
+}
+
+type watchGitCmd struct {
+	GithubToken       string        `secret:"true" usage:"access [token] for private Github repos"`
+	Ref               string        `usage:"the branch or tag to watch, where HEAD is the default branch" default:"HEAD"`
+	PollInterval      time.Duration `usage:"how often the head of the ref is checked" default:"1m"`
+	ShaFile           string        `usage:"the [file] where the last applied SHA is kept. Defaults to a file within data-dir"`
+	Port              int           `usage:"the port where health and metrics endpoints are served, disabled when 0" default:"8080"`
+	ReadinessCacheTtl time.Duration `usage:"how long readiness check results are reused" default:"10s"`
+	Options           loadOptionFlags
+}
+
+func (c *watchGitCmd) Name() string {
+	return "watch-git"
+}
+
+func (c *watchGitCmd) Synopsis() string {
+	return "Polls a git repository and loads its content each time the ref changes"
+}
+
+func (c *watchGitCmd) Usage() string {
+	return `watch-git [flags] repositoryUrl
+Flags:
+`
+}
+
+func (c *watchGitCmd) SetFlags(f *flag.FlagSet) {
+	filler := flagsfiller.New()
+	err := filler.Fill(f, c)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (c *watchGitCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	logger := args[0].(*zap.SugaredLogger)
+	config := args[1].(*Config)
+
+	if f.NArg() < 1 {
+		_, _ = fmt.Fprintln(os.Stderr, "missing repository URL")
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+
+	options, err := c.Options.loadOptions()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return subcommands.ExitUsageError
+	}
+
+	shaFile := c.ShaFile
+	if shaFile == "" {
+		if config.DataDir == "" {
+			_, _ = fmt.Fprintln(os.Stderr, "sha-file or data-dir is required to keep the last applied SHA")
+			return subcommands.ExitUsageError
+		}
+		shaFile = filepath.Join(config.DataDir, appliedShaFilename)
+	}
+
+	repoUrl := f.Arg(0)
+	logger.Debugw("running watch-git",
+		"repo", repoUrl, "ref", c.Ref, "config", config, "options", options)
+
+	if c.Port != 0 {
+		readinessChecker, err := c.setupReadiness(logger, config, repoUrl)
+		if err != nil {
+			logger.Errorw("failed to setup readiness checks", "err", err)
+			return subcommands.ExitFailure
+		}
+		go c.serveHealth(ctx, logger, readinessChecker)
+	}
+
+	watcher := NewGitWatcher(logger, repoUrl, c.Ref, c.PollInterval, NewGitRefResolver(c.GithubToken), shaFile,
+		func(ctx context.Context, refName string, sha string) error {
+			sourceContent := NewSourceContentFromGit(logger, repoUrl, sha, c.GithubToken)
+			return setupAndLoad(ctx, config, logger, sourceContent, &LoadRecord{
+				Trigger:    triggerWatch,
+				Repository: repoUrl,
+				Ref:        refName,
+				Sha:        sha,
+			}, options)
+		})
+	// blocks until shutdown is signalled
+	watcher.Run(ctx)
+
+	return subcommands.ExitSuccess
+}
+
+func (c *watchGitCmd) setupReadiness(logger *zap.SugaredLogger, config *Config, repoUrl string) (*ReadinessChecker, error) {
+	authenticator, err := NewAdminAuthenticator(logger, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup authenticator: %w", err)
+	}
+	loader, err := NewLoader(logger, authenticator, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create loader: %w", err)
+	}
+	router, err := NewSingleTargetRouter(loader, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	checks := append(targetHealthChecks(router),
+		gitRemoteHealthCheck(repoUrl, c.GithubToken),
+		tempDirHealthCheck())
+	return NewReadinessChecker(logger, checks, c.ReadinessCacheTtl), nil
+}
+
+// serveHealth serves the health and metrics endpoints until the context is done
+func (c *watchGitCmd) serveHealth(ctx context.Context, logger *zap.SugaredLogger, readinessChecker *ReadinessChecker) {
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", c.Port),
+		Handler: newHealthMux(readinessChecker),
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), responseShutdownTimeout)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Infow("health server running", "port", c.Port)
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		logger.Errorw("health server failed", "err", err)
+	}
+}
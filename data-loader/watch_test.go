@@ -0,0 +1,121 @@
+/*
+ * Copyright 2020 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeGitRemote resolves every ref to its head and records the SHAs loaded
+type fakeGitRemote struct {
+	head    string
+	loadErr error
+	loaded  []string
+}
+
+func (r *fakeGitRemote) resolve(repository string, ref string) (string, string, error) {
+	return "refs/heads/" + ref, r.head, nil
+}
+
+func (r *fakeGitRemote) load(_ context.Context, refName string, sha string) error {
+	r.loaded = append(r.loaded, sha)
+	return r.loadErr
+}
+
+func TestGitWatcher_poll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-watch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	shaFile := filepath.Join(dir, "applied.json")
+
+	remote := &fakeGitRemote{head: "sha-1"}
+	watcher := NewGitWatcher(zap.NewNop().Sugar(), "https://github.com/example/content.git", "master",
+		time.Minute, remote.resolve, shaFile, remote.load)
+
+	outcome, err := watcher.poll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, watchPollLoaded, outcome)
+
+	outcome, err = watcher.poll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, watchPollUnchanged, outcome)
+
+	// the applied SHA survives a restart
+	restarted := NewGitWatcher(zap.NewNop().Sugar(), "https://github.com/example/content.git", "master",
+		time.Minute, remote.resolve, shaFile, remote.load)
+	outcome, err = restarted.poll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, watchPollUnchanged, outcome)
+
+	remote.head = "sha-2"
+	outcome, err = restarted.poll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, watchPollLoaded, outcome)
+
+	assert.Equal(t, []string{"sha-1", "sha-2"}, remote.loaded)
+}
+
+func TestGitWatcher_poll_RetriesFailedLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-watch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	shaFile := filepath.Join(dir, "applied.json")
+
+	remote := &fakeGitRemote{head: "sha-1", loadErr: errors.New("admin API unavailable")}
+	watcher := NewGitWatcher(zap.NewNop().Sugar(), "https://github.com/example/content.git", "master",
+		time.Minute, remote.resolve, shaFile, remote.load)
+
+	outcome, err := watcher.poll(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, watchPollFailed, outcome)
+	_, err = os.Stat(shaFile)
+	assert.True(t, os.IsNotExist(err), "applied SHA should not be saved")
+
+	remote.loadErr = nil
+	outcome, err = watcher.poll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, watchPollLoaded, outcome)
+	assert.Equal(t, []string{"sha-1", "sha-1"}, remote.loaded)
+}
+
+func TestGitWatcher_poll_IgnoresShaOfOtherRef(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-loader-watch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	shaFile := filepath.Join(dir, "applied.json")
+
+	remote := &fakeGitRemote{head: "sha-1"}
+	staging := NewGitWatcher(zap.NewNop().Sugar(), "https://github.com/example/content.git", "staging",
+		time.Minute, remote.resolve, shaFile, remote.load)
+	_, err = staging.poll(context.Background())
+	require.NoError(t, err)
+
+	master := NewGitWatcher(zap.NewNop().Sugar(), "https://github.com/example/content.git", "master",
+		time.Minute, remote.resolve, shaFile, remote.load)
+	outcome, err := master.poll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, watchPollLoaded, outcome)
+}
@@ -17,47 +17,256 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/go-github/v28/github"
 	"github.com/racker/go-restclient"
 	"go.uber.org/zap"
 	"net/http"
 	"reflect"
-	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
+// responseShutdownTimeout is how long handlers are given to write their responses after
+// their loads have completed or been cancelled
+const responseShutdownTimeout = 5 * time.Second
+
+var errShuttingDown = errors.New("server is shutting down")
+
 type WebhookServer struct {
 	log               *zap.SugaredLogger
-	loader            Loader
+	router            *Router
 	port              int
 	gitContentBuilder GitSourceContentBuilder
 	webhookSecret     []byte
-	matchingRefs      []string
+	reloadToken       []byte
+	reloadEnabled     bool
+	refResolver       GitRefResolver
+	readinessChecker  *ReadinessChecker
+	historyStore      HistoryStore
+	pendingLoads      pendingStore
+	deliveries        *deliveryCache
+	drift             *driftReconciler
+	shutdownTimeout   time.Duration
+	serving           ServingConfig
+	certificates      *certificateReloader
+	clientCAs         *x509.CertPool
+
+	// loadsCtx is used for loads rather than request contexts since Github abandons deliveries
+	// that take longer than 10 seconds
+	loadsCtx     context.Context
+	cancelLoads  context.CancelFunc
+	activeLoads  sync.WaitGroup
+	loadsMutex   sync.Mutex
+	shuttingDown bool
+}
+
+// ReloadRequest is the body of a manual reload request
+type ReloadRequest struct {
+	// Repository is the clone URL of the content repository
+	Repository string `json:"repository"`
+	// Ref is a branch or tag name to resolve and load. Mutually exclusive with Sha.
+	Ref string `json:"ref,omitempty"`
+	// Sha is a specific commit to load. Mutually exclusive with Ref.
+	Sha string `json:"sha,omitempty"`
+	// Target is the name of the routing target to load into. If not given, the target is
+	// routed by repository and ref or is the only declared target.
+	Target  string      `json:"target,omitempty"`
+	Options LoadOptions `json:"options"`
 }
 
-func NewWebhookServer(log *zap.SugaredLogger, loader Loader, port int, gitContentBuilder GitSourceContentBuilder, webhookSecret string, matchingRefs []string) *WebhookServer {
+// LoadResult is the response payload of push events and manual reloads
+type LoadResult struct {
+	Target string       `json:"target"`
+	Ref    string       `json:"ref,omitempty"`
+	Sha    string       `json:"sha,omitempty"`
+	Stats  *LoaderStats `json:"stats"`
+	// PendingId identifies the pending load when the target requires approval, in which case
+	// the stats only convey the plan
+	PendingId string `json:"pendingId,omitempty"`
+}
+
+func NewWebhookServer(log *zap.SugaredLogger, router *Router, port int, gitContentBuilder GitSourceContentBuilder, webhookSecret string) *WebhookServer {
 	ourLogger := log.Named("webhook")
+	loadsCtx, cancelLoads := context.WithCancel(context.Background())
 	return &WebhookServer{
 		log:               ourLogger,
-		loader:            loader,
+		router:            router,
 		port:              port,
 		gitContentBuilder: gitContentBuilder,
 		webhookSecret:     []byte(webhookSecret),
-		matchingRefs:      matchingRefs,
+		shutdownTimeout:   defaultShutdownTimeout,
+		loadsCtx:          loadsCtx,
+		cancelLoads:       cancelLoads,
+	}
+}
+
+// SetupShutdown sets how long running loads are allowed to finish after shutdown begins
+// before they are cancelled
+func (s *WebhookServer) SetupShutdown(timeout time.Duration) {
+	s.shutdownTimeout = timeout
+}
+
+// SetupReload enables the manual reload endpoint where callers must present the given
+// bearer token, if not empty, or a client certificate verified by the client CA of
+// SetupServing.
+func (s *WebhookServer) SetupReload(token string, refResolver GitRefResolver) {
+	s.reloadEnabled = true
+	s.reloadToken = []byte(token)
+	s.refResolver = refResolver
+}
+
+// SetupHistory enables recording of loads and the history query endpoint
+func (s *WebhookServer) SetupHistory(historyStore HistoryStore) {
+	s.historyStore = historyStore
+}
+
+// SetupApproval enables the pending load endpoints, where a push event to a target that
+// requires approval is only planned until approved. Pending loads expire after the given
+// duration. The pending loads are kept at the location, a redis:// URL shared by replicas or
+// else a directory, or only in memory when not given.
+func (s *WebhookServer) SetupApproval(expiry time.Duration, location string) error {
+	pendingLoads, err := newPendingStore(location, expiry)
+	if err != nil {
+		return fmt.Errorf("failed to setup pending loads: %w", err)
+	}
+	s.pendingLoads = pendingLoads
+	return nil
+}
+
+// SetupReadiness enables the readiness endpoint backed by the given checker
+func (s *WebhookServer) SetupReadiness(readinessChecker *ReadinessChecker) {
+	s.readinessChecker = readinessChecker
+}
+
+// Start serves requests until the given context is done, at which point it gracefully
+// shuts down. It returns an error only if the server fails to start or to serve.
+func (s *WebhookServer) Start(ctx context.Context) error {
+	publicHandler, adminHandler := s.handlers()
+	servers := []*http.Server{s.newServer(s.port, publicHandler, false)}
+	if adminHandler != nil {
+		servers = append(servers, s.newServer(s.serving.AdminPort, adminHandler, true))
 	}
+
+	serveErrs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			serveErrs <- listenAndServe(server)
+		}(server)
+	}
+	s.log.Infow("webhook server running",
+		"port", s.port, "adminPort", s.serving.AdminPort, "tls", s.certificates != nil)
+
+	if s.certificates != nil {
+		go s.certificates.watch(ctx)
+	}
+	if s.drift != nil {
+		go s.reconcileDrift(ctx)
+	}
+
+	select {
+	case err := <-serveErrs:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.log.Infow("shutting down webhook server", "timeout", s.shutdownTimeout)
+	s.drainLoads()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), responseShutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			s.log.Warnw("failed to gracefully shutdown webhook server", "err", err, "addr", server.Addr)
+		}
+	}
+
+	return nil
 }
 
-func (s *WebhookServer) Start() error {
-	http.HandleFunc("/webhook", s.handleWebhook)
+// handlers creates the handler of the public port and, when an admin port is configured, the
+// handler of the admin port. Otherwise the public handler serves all endpoints.
+func (s *WebhookServer) handlers() (public http.Handler, admin http.Handler) {
+	adminMux := newHealthMux(s.readinessChecker)
+	if s.reloadEnabled {
+		adminMux.HandleFunc("/reload", s.handleReload)
+	}
+	if s.historyStore != nil {
+		adminMux.HandleFunc("/history", s.handleHistory)
+	}
+	if s.pendingLoads != nil {
+		adminMux.HandleFunc(pendingPath, s.handlePendingList)
+		adminMux.HandleFunc(pendingPath+"/", s.handlePendingAction)
+	}
+	if s.drift != nil {
+		adminMux.HandleFunc("/drift", s.handleDrift)
+	}
 
-	// register healthcheck endpoint
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	if s.serving.AdminPort == 0 {
+		adminMux.HandleFunc("/webhook", s.handleWebhook)
+		return adminMux, nil
+	}
+
+	publicMux := http.NewServeMux()
+	publicMux.HandleFunc("/webhook", s.handleWebhook)
+	publicMux.HandleFunc("/healthz", handleLiveness)
+	// load balancers may only check the legacy healthcheck endpoint
+	publicMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 	})
+	return publicMux, adminMux
+}
+
+// drainLoads refuses new loads and waits for running loads to finish, cancelling any that
+// are still running after the shutdown timeout
+func (s *WebhookServer) drainLoads() {
+	s.loadsMutex.Lock()
+	s.shuttingDown = true
+	s.loadsMutex.Unlock()
 
-	s.log.Infow("webhook server running", "port", s.port)
-	return http.ListenAndServe(fmt.Sprintf(":%d", s.port), nil)
+	finished := make(chan struct{})
+	go func() {
+		s.activeLoads.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		s.log.Infow("running loads finished")
+	case <-time.After(s.shutdownTimeout):
+		s.log.Warnw("cancelling loads still running after shutdown timeout")
+		s.cancelLoads()
+		// cancelled loads still cleanup their source content before returning
+		<-finished
+	}
+
+	s.cancelLoads()
+}
+
+// beginLoad registers a running load unless the server is shutting down
+func (s *WebhookServer) beginLoad() bool {
+	s.loadsMutex.Lock()
+	defer s.loadsMutex.Unlock()
+
+	if s.shuttingDown {
+		return false
+	}
+	s.activeLoads.Add(1)
+	return true
 }
 
 func (s *WebhookServer) handleWebhook(w http.ResponseWriter, r *http.Request) {
@@ -68,16 +277,20 @@ func (s *WebhookServer) handleWebhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	eventType := github.WebHookType(r)
+
 	payload, err := github.ValidatePayload(r, s.webhookSecret)
 	if err != nil {
 		s.log.Warnw("failed to validate webhook payload", "err", err)
+		webhookDeliveries.WithLabelValues(eventType, deliveryOutcomeUnauthorized).Inc()
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	event, err := github.ParseWebHook(github.WebHookType(r), payload)
+	event, err := github.ParseWebHook(eventType, payload)
 	if err != nil {
 		s.log.Warnw("unable to parse webhook request", "err", err)
+		webhookDeliveries.WithLabelValues(eventType, deliveryOutcomeInvalid).Inc()
 		s.writeErrResponse(http.StatusBadRequest, w, err)
 		return
 	}
@@ -86,34 +299,50 @@ func (s *WebhookServer) handleWebhook(w http.ResponseWriter, r *http.Request) {
 
 	switch event := event.(type) {
 	case *github.PushEvent:
-		stats, err := s.handlePushEvent(github.DeliveryID(r), event)
+		deliveryId := github.DeliveryID(r)
+		if s.deliveries == nil || deliveryId == "" {
+			s.respondToPushEvent(w, eventType, deliveryId, event)
+			return
+		}
+
+		forced := isForced(r)
+		if forced && !s.isAuthorizedCaller(r) {
+			s.log.Warnw("unauthorized forced webhook delivery", "deliveryId", deliveryId, "remote", r.RemoteAddr)
+			webhookDeliveries.WithLabelValues(eventType, deliveryOutcomeUnauthorized).Inc()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// a concurrent redelivery waits for the result of the one already being processed
+		original, finish, err := s.deliveries.begin(r.Context(), deliveryId, forced)
 		if err != nil {
-			s.log.Warnw("failed to handle push event", "err", err)
-			s.writeErrResponse(http.StatusInternalServerError, w, err)
+			s.log.Warnw("abandoned waiting for duplicate webhook delivery", "err", err, "deliveryId", deliveryId)
+			webhookDeliveries.WithLabelValues(eventType, deliveryOutcomeRejected).Inc()
+			s.writeErrResponse(http.StatusServiceUnavailable, w, err)
+			return
+		} else if original != nil {
+			s.log.Infow("returning original result of duplicate webhook delivery",
+				"deliveryId", deliveryId, "processedAt", original.ProcessedAt)
+			webhookDeliveries.WithLabelValues(eventType, deliveryOutcomeDuplicate).Inc()
+			s.writeDeliveryResult(w, original)
 			return
 		}
 
-		if stats != nil {
-			statsJson, err := json.Marshal(stats)
-			if err != nil {
-				s.log.Warnw("failed marshal stats response",
-					"err", err, "stats", stats)
-			} else {
-				w.Header().Set("Content-Type", string(restclient.JsonType))
-				_, err = w.Write(statsJson)
-				if err != nil {
-					s.log.Warnw("failed to send stats json response", "err", err)
-				}
-			}
-		} else {
-			w.Header().Set("Content-Type", string(restclient.TextType))
-			_, err = w.Write([]byte("Ignoring github webhook request for unconfigured branch/tag"))
-			if err != nil {
-				s.log.Warnw("failed to send ref ignored response", "err", err)
+		recorder := &recordingResponseWriter{ResponseWriter: w}
+		defer func() {
+			result := recorder.result(deliveryId)
+			// releases the waiting requests even when processing panics, but as a failure
+			if p := recover(); p != nil {
+				result.StatusCode = http.StatusInternalServerError
+				finish(result)
+				panic(p)
 			}
-		}
+			finish(result)
+		}()
+		s.respondToPushEvent(recorder, eventType, deliveryId, event)
+		return
 
 	default:
+		webhookDeliveries.WithLabelValues(eventType, deliveryOutcomeIgnored).Inc()
 		s.log.Debugw("ignoring unsupported webhook event type",
 			"type", reflect.ValueOf(event).Type())
 	}
@@ -121,6 +350,228 @@ func (s *WebhookServer) handleWebhook(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// respondToPushEvent handles the push event and writes its result to the response
+func (s *WebhookServer) respondToPushEvent(w http.ResponseWriter, eventType string, deliveryId string,
+	event *github.PushEvent) {
+	result, err := s.handlePushEvent(deliveryId, event)
+	var guardrailErr *GuardrailError
+	if errors.Is(err, errShuttingDown) {
+		webhookDeliveries.WithLabelValues(eventType, deliveryOutcomeRejected).Inc()
+		s.writeErrResponse(http.StatusServiceUnavailable, w, err)
+		return
+	} else if errors.As(err, &guardrailErr) {
+		// a manual reload that allows large changes is needed to apply the content
+		s.log.Warnw("refused push event that exceeds change guardrails", "err", err)
+		webhookDeliveries.WithLabelValues(eventType, deliveryOutcomeRefused).Inc()
+		s.writeErrResponse(http.StatusConflict, w, err)
+		return
+	} else if err != nil {
+		s.log.Warnw("failed to handle push event", "err", err)
+		webhookDeliveries.WithLabelValues(eventType, deliveryOutcomeFailed).Inc()
+		s.writeErrResponse(http.StatusInternalServerError, w, err)
+		return
+	}
+
+	if result != nil && result.PendingId != "" {
+		webhookDeliveries.WithLabelValues(eventType, deliveryOutcomePending).Inc()
+		s.writeResultResponse(w, result)
+	} else if result != nil {
+		webhookDeliveries.WithLabelValues(eventType, deliveryOutcomeLoaded).Inc()
+		s.writeResultResponse(w, result)
+	} else {
+		webhookDeliveries.WithLabelValues(eventType, deliveryOutcomeIgnored).Inc()
+		w.Header().Set("Content-Type", string(restclient.TextType))
+		_, err = w.Write([]byte("Ignoring github webhook request for unconfigured branch/tag"))
+		if err != nil {
+			s.log.Warnw("failed to send ref ignored response", "err", err)
+		}
+	}
+}
+
+func (s *WebhookServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.log.Warnw("wrong method in reload request",
+			"method", r.Method, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.isAuthorizedCaller(r) {
+		s.log.Warnw("unauthorized reload request", "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var reloadReq ReloadRequest
+	err := json.NewDecoder(r.Body).Decode(&reloadReq)
+	if err != nil {
+		s.writeErrResponse(http.StatusBadRequest, w, fmt.Errorf("invalid reload request: %w", err))
+		return
+	}
+	if reloadReq.Repository == "" {
+		s.writeErrResponse(http.StatusBadRequest, w, fmt.Errorf("repository is required"))
+		return
+	}
+	if reloadReq.Ref != "" && reloadReq.Sha != "" {
+		s.writeErrResponse(http.StatusBadRequest, w, fmt.Errorf("only one of ref or sha can be given"))
+		return
+	}
+	err = reloadReq.Options.Validate()
+	if err != nil {
+		s.writeErrResponse(http.StatusBadRequest, w, err)
+		return
+	}
+
+	sha := reloadReq.Sha
+	var refName string
+	if reloadReq.Ref != "" {
+		refName, sha, err = s.refResolver(reloadReq.Repository, reloadReq.Ref)
+		if err != nil {
+			s.log.Warnw("failed to resolve ref for reload",
+				"err", err, "repository", reloadReq.Repository, "ref", reloadReq.Ref)
+			s.writeErrResponse(http.StatusBadRequest, w, err)
+			return
+		}
+	}
+
+	target, err := s.reloadTarget(reloadReq, refName)
+	if err != nil {
+		s.writeErrResponse(http.StatusBadRequest, w, err)
+		return
+	}
+
+	s.log.Infow("loading source content for manual reload",
+		"repository", reloadReq.Repository, "ref", refName, "sha", sha, "target", target.Name,
+		"options", reloadReq.Options, "remote", r.RemoteAddr)
+	stats, err := s.loadFromGit(target, &LoadRecord{
+		Trigger:    triggerManual,
+		Repository: reloadReq.Repository,
+		Ref:        refName,
+		Sha:        sha,
+	}, reloadReq.Options)
+	var guardrailErr *GuardrailError
+	if errors.Is(err, errShuttingDown) {
+		s.writeErrResponse(http.StatusServiceUnavailable, w, err)
+		return
+	} else if errors.As(err, &guardrailErr) {
+		s.log.Warnw("refused reload that exceeds change guardrails", "err", err, "target", target.Name)
+		s.writeErrResponse(http.StatusConflict, w, err)
+		return
+	} else if err != nil {
+		s.log.Warnw("failed to handle reload", "err", err, "target", target.Name)
+		s.writeErrResponse(http.StatusInternalServerError, w, err)
+		return
+	}
+
+	s.writeResultResponse(w, &LoadResult{
+		Target: target.Name,
+		Ref:    refName,
+		Sha:    sha,
+		Stats:  stats,
+	})
+}
+
+func (s *WebhookServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.isAuthorizedCaller(r) {
+		s.log.Warnw("unauthorized history request", "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := HistoryFilter{
+		Repository: query.Get("repository"),
+		Ref:        query.Get("ref"),
+		Outcome:    query.Get("outcome"),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			s.writeErrResponse(http.StatusBadRequest, w, fmt.Errorf("invalid limit: %w", err))
+			return
+		}
+	}
+
+	records, err := s.historyStore.Query(filter)
+	if err != nil {
+		s.log.Warnw("failed to query history", "err", err, "filter", filter)
+		s.writeErrResponse(http.StatusInternalServerError, w, err)
+		return
+	}
+
+	s.writeJsonResponse(w, records)
+}
+
+// reloadTarget picks the explicitly requested target, else routes by the resolved ref, else
+// falls back to the only declared target
+func (s *WebhookServer) reloadTarget(reloadReq ReloadRequest, refName string) (*LoadTarget, error) {
+	if reloadReq.Target != "" {
+		target := s.router.Target(reloadReq.Target)
+		if target == nil {
+			return nil, fmt.Errorf("unknown target: %s", reloadReq.Target)
+		}
+		return target, nil
+	}
+
+	if refName != "" {
+		target := s.router.Route(reloadReq.Repository, refName)
+		if target == nil {
+			return nil, fmt.Errorf("no route matches repository %s and ref %s",
+				reloadReq.Repository, refName)
+		}
+		return target, nil
+	}
+
+	targets := s.router.Targets()
+	if len(targets) != 1 {
+		return nil, fmt.Errorf("target or ref is required when more than one target is declared")
+	}
+	return targets[0], nil
+}
+
+// isAuthorizedCaller checks for a verified client certificate or the configured bearer token
+func (s *WebhookServer) isAuthorizedCaller(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	if len(s.reloadToken) == 0 {
+		return false
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	const bearerPrefix = "Bearer "
+	if !strings.HasPrefix(authHeader, bearerPrefix) {
+		return false
+	}
+	presented := []byte(strings.TrimPrefix(authHeader, bearerPrefix))
+	return subtle.ConstantTimeCompare(presented, s.reloadToken) == 1
+}
+
+func (s *WebhookServer) writeResultResponse(w http.ResponseWriter, result *LoadResult) {
+	s.writeJsonResponse(w, result)
+}
+
+func (s *WebhookServer) writeJsonResponse(w http.ResponseWriter, body interface{}) {
+	bodyJson, err := json.Marshal(body)
+	if err != nil {
+		s.log.Warnw("failed marshal json response",
+			"err", err, "body", body)
+		return
+	}
+
+	w.Header().Set("Content-Type", string(restclient.JsonType))
+	_, err = w.Write(bodyJson)
+	if err != nil {
+		s.log.Warnw("failed to send json response", "err", err)
+	}
+}
+
 func (s *WebhookServer) writeErrResponse(statusCode int, w http.ResponseWriter, err error) {
 	w.WriteHeader(statusCode)
 	_, writeErr := w.Write([]byte(err.Error()))
@@ -130,54 +581,114 @@ func (s *WebhookServer) writeErrResponse(statusCode int, w http.ResponseWriter,
 	}
 }
 
-func (s *WebhookServer) handlePushEvent(deliveryId string, event *github.PushEvent) (*LoaderStats, error) {
+func (s *WebhookServer) handlePushEvent(deliveryId string, event *github.PushEvent) (*LoadResult, error) {
 	ref := event.GetRef()
 	pusher := event.GetPusher().GetName()
 	cloneURL := event.GetRepo().GetCloneURL()
 	commitId := event.GetHeadCommit().GetID()
 
-	if !s.isApplicableRef(ref) {
+	target := s.router.Route(cloneURL, ref)
+	if target == nil {
 		s.log.Debugw("ignoring push event ref that does not match",
-			"ref", ref, "deliveryId", deliveryId)
+			"ref", ref, "cloneURL", cloneURL, "deliveryId", deliveryId)
 		return nil, nil
 	}
 
-	sourceContent := s.gitContentBuilder(cloneURL, commitId)
+	if target.RequireApproval && s.pendingLoads != nil {
+		s.log.Infow("planning source content for webhook push event pending approval",
+			"pusher", pusher, "ref", ref, "cloneURL", cloneURL, "commitId", commitId,
+			"deliveryId", deliveryId, "target", target.Name)
+		pending, err := s.planFromGit(target, &LoadRecord{
+			Trigger:    triggerWebhook,
+			DeliveryId: deliveryId,
+			Repository: cloneURL,
+			Ref:        ref,
+			Sha:        commitId,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to plan load into target %s: %w", target.Name, err)
+		}
+		s.log.Infow("stored pending load", "pending", pending)
 
-	sourceContentPath, err := sourceContent.Prepare()
-	if err != nil {
-		return nil, fmt.Errorf("failed to prepare source content from %s: %w", cloneURL, err)
+		return &LoadResult{
+			Target:    target.Name,
+			Ref:       ref,
+			Sha:       pending.Sha,
+			Stats:     &LoaderStats{Plan: pending.Plan},
+			PendingId: pending.Id,
+		}, nil
 	}
-	defer sourceContent.Cleanup()
 
 	s.log.Infow("loading source content for webhook push event",
 		"pusher", pusher, "ref", ref, "cloneURL", cloneURL, "commitId", commitId,
-		"deliveryId", deliveryId)
-	stats, err := s.loader.LoadAll(sourceContentPath)
+		"deliveryId", deliveryId, "target", target.Name)
+	stats, err := s.loadFromGit(target, &LoadRecord{
+		Trigger:    triggerWebhook,
+		DeliveryId: deliveryId,
+		Repository: cloneURL,
+		Ref:        ref,
+		Sha:        commitId,
+	}, LoadOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("failed load content: %w", err)
+		return nil, fmt.Errorf("failed to load into target %s: %w", target.Name, err)
+	}
+
+	return &LoadResult{
+		Target: target.Name,
+		Ref:    ref,
+		Sha:    commitId,
+		Stats:  stats,
+	}, nil
+}
+
+// loadFromGit prepares the content at the record's repository and SHA, loads it into the
+// target, and records the load in the history
+func (s *WebhookServer) loadFromGit(target *LoadTarget, record *LoadRecord, options LoadOptions) (*LoaderStats, error) {
+	if !s.beginLoad() {
+		return nil, errShuttingDown
 	}
+	defer s.activeLoads.Done()
 
+	record.Target = target.Name
+	record.StartedAt = time.Now()
+	stats, err := s.prepareAndLoad(target, record, options)
+	record.finish(stats, err)
+	recordLoad(s.log, s.historyStore, record)
+	if err != nil {
+		return nil, err
+	}
+
+	recordSuccessfulLoad(target.Name, record.Sha)
 	return stats, nil
 }
 
-func (s *WebhookServer) isApplicableRef(ref string) bool {
-	if len(s.matchingRefs) == 0 {
-		// non-configured, so match any
-		return true
+// planLoad prepares the content at the record's repository and SHA and only plans loading it
+// into the target
+func (s *WebhookServer) planLoad(target *LoadTarget, record *LoadRecord) (*LoaderStats, error) {
+	if !s.beginLoad() {
+		return nil, errShuttingDown
 	}
+	defer s.activeLoads.Done()
 
-	for _, expr := range s.matchingRefs {
-		matched, err := regexp.MatchString(expr, ref)
-		if err != nil {
-			s.log.Warnw("failed to process refs matching expression",
-				"expr", expr, "ref", ref, "err", err)
-			continue
-		}
-		if matched {
-			return true
-		}
+	record.Target = target.Name
+	return s.prepareAndLoad(target, record, LoadOptions{PlanOnly: true})
+}
+
+func (s *WebhookServer) prepareAndLoad(target *LoadTarget, record *LoadRecord, options LoadOptions) (*LoaderStats, error) {
+	sourceContent := s.gitContentBuilder(record.Repository, record.Sha)
+
+	sourceContentPath, err := sourceContent.Prepare(s.loadsCtx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare source content from %s: %w", record.Repository, err)
 	}
+	defer sourceContent.Cleanup()
+	record.Sha = sourceContent.Revision()
+	options.Revision = record.Sha
 
-	return false
+	stats, err := target.Loader.LoadAll(s.loadsCtx, sourceContentPath, options)
+	if err != nil {
+		return stats, fmt.Errorf("failed load content: %w", err)
+	}
+
+	return stats, nil
 }
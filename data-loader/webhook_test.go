@@ -18,6 +18,9 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -26,15 +29,17 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 type MockLoader struct {
 	mock.Mock
 }
 
-func (m *MockLoader) LoadAll(sourceContentPath string) (*LoaderStats, error) {
-	m.Called(sourceContentPath)
+func (m *MockLoader) LoadAll(ctx context.Context, sourceContentPath string, options LoadOptions) (*LoaderStats, error) {
+	m.Called(sourceContentPath, options)
 	return nil, nil
 }
 
@@ -44,11 +49,15 @@ type MockSourceContent struct {
 
 const mockContentPath = "source/content/path"
 
-func (m *MockSourceContent) Prepare() (string, error) {
+func (m *MockSourceContent) Prepare(ctx context.Context) (string, error) {
 	m.Called()
 	return mockContentPath, nil
 }
 
+func (m *MockSourceContent) Revision() string {
+	return "mock-revision"
+}
+
 func (m *MockSourceContent) Cleanup() {
 	m.Called()
 }
@@ -145,7 +154,7 @@ func TestWebhookServer_handleWebhook_PushRequest(t *testing.T) {
 
 	assert.Equal(t, 200, resp.Code)
 
-	loader.AssertCalled(t, "LoadAll", mockContentPath)
+	loader.AssertCalled(t, "LoadAll", mockContentPath, LoadOptions{Revision: "mock-revision"})
 	builder.AssertCalled(t, "build",
 		"https://github.com/Rackspace-Segment-Support/test-salus-data-loader-content.git",
 		"e4168647ae258ed748a8c765127c0f3595e34bf0")
@@ -171,7 +180,7 @@ func TestWebhookServer_handleWebhook_MatchesRefExact(t *testing.T) {
 
 	assert.Equal(t, 200, resp.Code)
 
-	loader.AssertCalled(t, "LoadAll", mockContentPath)
+	loader.AssertCalled(t, "LoadAll", mockContentPath, LoadOptions{Revision: "mock-revision"})
 	builder.AssertCalled(t, "build",
 		"https://github.com/Rackspace-Segment-Support/test-salus-data-loader-content.git",
 		"e4168647ae258ed748a8c765127c0f3595e34bf0")
@@ -197,7 +206,7 @@ func TestWebhookServer_handleWebhook_MatchesRefMulti(t *testing.T) {
 
 	assert.Equal(t, 200, resp.Code)
 
-	loader.AssertCalled(t, "LoadAll", mockContentPath)
+	loader.AssertCalled(t, "LoadAll", mockContentPath, LoadOptions{Revision: "mock-revision"})
 	builder.AssertCalled(t, "build",
 		"https://github.com/Rackspace-Segment-Support/test-salus-data-loader-content.git",
 		"e4168647ae258ed748a8c765127c0f3595e34bf0")
@@ -222,7 +231,7 @@ func TestWebhookServer_handleWebhook_MatchesRefRegex(t *testing.T) {
 
 	assert.Equal(t, 200, resp.Code)
 
-	loader.AssertCalled(t, "LoadAll", mockContentPath)
+	loader.AssertCalled(t, "LoadAll", mockContentPath, LoadOptions{Revision: "mock-revision"})
 	builder.AssertCalled(t, "build",
 		"https://github.com/Rackspace-Segment-Support/test-salus-data-loader-content.git",
 		"1cc985fd10b43a614fafd343190e7ee871732e25")
@@ -262,6 +271,225 @@ func TestWebhookServer_handleWebhook_MisMatchRef(t *testing.T) {
 	sourceContent.AssertExpectations(t)
 }
 
+func TestWebhookServer_handleReload_Sha(t *testing.T) {
+	server, loader, sourceContent, builder := createTestWebhookServer("", []string{}, true)
+	server.SetupReload("reload-token", nil)
+
+	req := createReloadReq(`{"repository":"https://github.com/example/content.git","sha":"abc123",
+		"options":{"definitions":["agent-releases"]}}`, "reload-token")
+	resp := httptest.NewRecorder()
+
+	server.handleReload(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+
+	loader.AssertCalled(t, "LoadAll", mockContentPath, LoadOptions{Definitions: []string{"agent-releases"}, Revision: "mock-revision"})
+	builder.AssertCalled(t, "build", "https://github.com/example/content.git", "abc123")
+	sourceContent.AssertCalled(t, "Prepare")
+	sourceContent.AssertCalled(t, "Cleanup")
+}
+
+func TestWebhookServer_handleReload_Ref(t *testing.T) {
+	server, loader, _, builder := createTestWebhookServer("", []string{}, true)
+	server.SetupReload("reload-token", func(repository string, ref string) (string, string, error) {
+		assert.Equal(t, "https://github.com/example/content.git", repository)
+		assert.Equal(t, "staging", ref)
+		return "refs/heads/staging", "def456", nil
+	})
+
+	req := createReloadReq(`{"repository":"https://github.com/example/content.git","ref":"staging"}`,
+		"reload-token")
+	resp := httptest.NewRecorder()
+
+	server.handleReload(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+
+	loader.AssertCalled(t, "LoadAll", mockContentPath, LoadOptions{Revision: "mock-revision"})
+	builder.AssertCalled(t, "build", "https://github.com/example/content.git", "def456")
+
+	var result LoadResult
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &result))
+	assert.Equal(t, "default", result.Target)
+	assert.Equal(t, "refs/heads/staging", result.Ref)
+	assert.Equal(t, "def456", result.Sha)
+}
+
+func TestWebhookServer_handleWebhook_RoutesToTarget(t *testing.T) {
+	stagingLoader := new(MockLoader)
+	prodLoader := new(MockLoader)
+	prodLoader.On("LoadAll", mockContentPath, mock.Anything).Return(nil)
+	router, err := NewRouter(&RoutingConfig{
+		Targets: []TargetConfig{
+			{Name: "staging", AdminUrl: "http://staging"},
+			{Name: "prod", AdminUrl: "http://prod"},
+		},
+		Routes: []RouteConfig{
+			{Refs: []string{"refs/heads/staging"}, Target: "staging"},
+			{Repository: "test-salus-data-loader-content", Refs: []string{`refs/tags/v.*`}, Target: "prod"},
+		},
+	}, func(target TargetConfig) (Loader, error) {
+		if target.Name == "prod" {
+			return prodLoader, nil
+		}
+		return stagingLoader, nil
+	})
+	require.NoError(t, err)
+
+	sourceContent := new(MockSourceContent)
+	sourceContent.On("Prepare").Return(mockContentPath, nil)
+	sourceContent.On("Cleanup").Return()
+	builder := &MockGitContentBuilder{sourceContent: sourceContent}
+	builder.On("build", mock.Anything, mock.Anything).Return(sourceContent)
+
+	server := NewWebhookServer(zap.NewNop().Sugar(), router, 8080, builder.build, "")
+
+	reqBody, err := os.Open("testdata/webhook_push_tag_req.json")
+	require.NoError(t, err)
+	defer reqBody.Close()
+
+	req := createWebhookReq(reqBody, "push", "")
+	resp := httptest.NewRecorder()
+
+	server.handleWebhook(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	var result LoadResult
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &result))
+	assert.Equal(t, "prod", result.Target)
+
+	prodLoader.AssertCalled(t, "LoadAll", mockContentPath, LoadOptions{Revision: "mock-revision"})
+	stagingLoader.AssertExpectations(t)
+}
+
+func TestWebhookServer_handleReload_Unauthorized(t *testing.T) {
+	server, loader, sourceContent, builder := createTestWebhookServer("", []string{}, false)
+	server.SetupReload("reload-token", nil)
+
+	req := createReloadReq(`{"repository":"https://github.com/example/content.git"}`, "WRONG TOKEN")
+	resp := httptest.NewRecorder()
+
+	server.handleReload(resp, req)
+
+	assert.Equal(t, 401, resp.Code)
+
+	loader.AssertExpectations(t)
+	builder.AssertExpectations(t)
+	sourceContent.AssertExpectations(t)
+}
+
+func TestWebhookServer_handleReload_UnknownDefinition(t *testing.T) {
+	server, loader, sourceContent, builder := createTestWebhookServer("", []string{}, false)
+	server.SetupReload("reload-token", nil)
+
+	req := createReloadReq(`{"repository":"https://github.com/example/content.git",
+		"options":{"definitions":["not-a-definition"]}}`, "reload-token")
+	resp := httptest.NewRecorder()
+
+	server.handleReload(resp, req)
+
+	assert.Equal(t, 400, resp.Code)
+	assert.Contains(t, resp.Body.String(), "unknown loader definition")
+
+	loader.AssertExpectations(t)
+	builder.AssertExpectations(t)
+	sourceContent.AssertExpectations(t)
+}
+
+// blockingLoader blocks each load until its context is cancelled
+type blockingLoader struct {
+	started chan struct{}
+}
+
+func (l *blockingLoader) LoadAll(ctx context.Context, sourceContentPath string, options LoadOptions) (*LoaderStats, error) {
+	close(l.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestWebhookServer_drainLoads_CancelsAfterTimeout(t *testing.T) {
+	loader := &blockingLoader{started: make(chan struct{})}
+	router, err := NewSingleTargetRouter(loader, nil)
+	require.NoError(t, err)
+
+	sourceContent := new(MockSourceContent)
+	sourceContent.On("Prepare").Return(mockContentPath, nil)
+	sourceContent.On("Cleanup").Return()
+	builder := &MockGitContentBuilder{sourceContent: sourceContent}
+	builder.On("build", mock.Anything, mock.Anything).Return(sourceContent)
+
+	server := NewWebhookServer(zap.NewNop().Sugar(), router, 8080, builder.build, "")
+	server.SetupShutdown(10 * time.Millisecond)
+
+	loadErrs := make(chan error, 1)
+	go func() {
+		_, err := server.loadFromGit(router.Target(defaultTargetName),
+			&LoadRecord{Repository: "https://github.com/example/content.git", Sha: "abc123"}, LoadOptions{})
+		loadErrs <- err
+	}()
+	<-loader.started
+
+	server.drainLoads()
+
+	err = <-loadErrs
+	assert.True(t, errors.Is(err, context.Canceled))
+	sourceContent.AssertCalled(t, "Cleanup")
+
+	// and new loads are refused
+	_, err = server.loadFromGit(router.Target(defaultTargetName),
+		&LoadRecord{Repository: "https://github.com/example/content.git", Sha: "abc123"}, LoadOptions{})
+	assert.Equal(t, errShuttingDown, err)
+}
+
+func TestWebhookServer_handleHistory(t *testing.T) {
+	server, _, _, _ := createTestWebhookServer("", []string{}, true)
+	server.SetupReload("reload-token", nil)
+	dataDir, err := ioutil.TempDir("", "history-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	historyStore, err := OpenHistoryStore(dataDir)
+	require.NoError(t, err)
+	defer historyStore.Close()
+	server.SetupHistory(historyStore)
+
+	reqBody, err := os.Open("testdata/webhook_push_req.json")
+	require.NoError(t, err)
+	defer reqBody.Close()
+	server.handleWebhook(httptest.NewRecorder(), createWebhookReq(reqBody, "push", ""))
+
+	req := httptest.NewRequest("GET", "/history?ref=refs/heads/master&outcome=success", nil)
+	req.Header.Set("Authorization", "Bearer reload-token")
+	resp := httptest.NewRecorder()
+
+	server.handleHistory(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	var records []*LoadRecord
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &records))
+	require.Len(t, records, 1)
+	assert.Equal(t, "webhook", records[0].Trigger)
+	assert.Equal(t, "id-1", records[0].DeliveryId)
+	assert.Equal(t, "default", records[0].Target)
+	assert.Equal(t, "https://github.com/Rackspace-Segment-Support/test-salus-data-loader-content.git", records[0].Repository)
+	assert.Equal(t, "mock-revision", records[0].Sha)
+
+	req = httptest.NewRequest("GET", "/history?outcome=failed", nil)
+	req.Header.Set("Authorization", "Bearer reload-token")
+	resp = httptest.NewRecorder()
+
+	server.handleHistory(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "[]", resp.Body.String())
+}
+
+func createReloadReq(body string, token string) *http.Request {
+	req := httptest.NewRequest("POST", "/reload", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
 func createWebhookReq(reqBody *os.File, eventType string, webhookSecret string) *http.Request {
 	req := httptest.NewRequest("POST", "/webhook", reqBody)
 	req.Header.Set("Content-Type", "application/json")
@@ -279,7 +507,11 @@ func createTestWebhookServer(webhookSecret string, matchingRefs []string, wireup
 	builder := &MockGitContentBuilder{
 		sourceContent: sourceContent,
 	}
-	server := NewWebhookServer(log, loader, 8080, builder.build, webhookSecret, matchingRefs)
+	router, err := NewSingleTargetRouter(loader, matchingRefs)
+	if err != nil {
+		panic(err)
+	}
+	server := NewWebhookServer(log, router, 8080, builder.build, webhookSecret)
 
 	if wireup {
 		builder.On("build", mock.Anything, mock.Anything).
@@ -288,7 +520,7 @@ func createTestWebhookServer(webhookSecret string, matchingRefs []string, wireup
 			Return(mockContentPath, nil)
 		sourceContent.On("Cleanup").
 			Return()
-		loader.On("LoadAll", mockContentPath).
+		loader.On("LoadAll", mockContentPath, mock.Anything).
 			Return(nil)
 	}
 